@@ -1,27 +1,47 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
 	"os"
+	"pullcsv/internal/config"
+	"pullcsv/internal/control"
 	"pullcsv/internal/http"
+	"pullcsv/internal/ledger"
 	"pullcsv/internal/logger"
 	"pullcsv/internal/prom"
 	"pullcsv/internal/pullcsv"
+	"time"
 )
 
 const DISPLAY_VERSION = "2.0.1"
 
 func main() {
+	configPath := flag.String("config", os.Getenv("PULLCSV_CONFIG"), "path to YAML/JSON config file, env variables are used if it's empty")
+	backfillFrom := flag.String("backfill-from", "", "the day (2006-01-02) the jobs with backfill_days pull the files from on start")
+	flag.Parse()
+	if _, err := time.Parse("2006-01-02", *backfillFrom); *backfillFrom != "" && err != nil {
+		fmt.Fprintln(os.Stderr, "The flag -backfill-from must be a day like 2006-01-02")
+		os.Exit(2)
+	}
+
 	fx.New(
 		logger.WithZapLoggerFx(),
+		config.WithConfigFx(*configPath),
+		fx.Supply(pullcsv.Flags{BackfillFrom: *backfillFrom}),
+		ledger.WithLedgerFx(),
+		control.WithControlFx(),
 		prom.WithPromFx(),
 		http.WithHttpServiceFx(),
-		fx.Invoke(func(logger *zap.Logger, metrics *prom.Metrics) {
+		fx.Invoke(func(logger *zap.Logger, metrics *prom.Metrics, cfg *config.Config) {
 			logger.Info("running PullCSV version " + DISPLAY_VERSION)
-			metrics.Info.With(prometheus.Labels{"version": DISPLAY_VERSION, "stand_name": os.Getenv("STAND_NAME"), "pod_name": os.Getenv("POD_NAME")}).Set(1)
+			metrics.Info.With(prometheus.Labels{"version": DISPLAY_VERSION, "stand_name": cfg.StandName, "pod_name": cfg.PodName}).Set(1)
 		}),
 		fx.Invoke(pullcsv.Pullcsv),
+		// the running jobs get ShutdownTimeout to finish and some time to clean up after the cancel
+		fx.StopTimeout(pullcsv.ShutdownTimeout+10*time.Second),
 	).Run()
 }
@@ -0,0 +1,695 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/helpers"
+	"pullcsv/internal/pathtmpl"
+	"pullcsv/internal/retry"
+	"pullcsv/internal/transcode"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/fx"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultDownloadCron    = "*/10 * * * *"
+	DefaultDeleteCron      = "1 */1 * * *"
+	DefaultDeleteOlderThan = 48
+	DefaultExcludeMaxLines = 20000
+	DefaultExcludeMaxSize  = 9437184
+	DefaultLedger          = "/var/lib/pullcsv/ledger.db"
+	DefaultStaleness       = "24h"
+	DefaultTimeout         = "1h"
+	DefaultRetryAttempts   = 3
+	DefaultRetryBackoff    = "30s"
+	DefaultRetryMaxBackoff = "5m"
+	// DefaultArchiveOlderThan is the archived files lifetime in hours, 30 days
+	DefaultArchiveOlderThan = 720
+
+	// DeliveryMove moves the files into the destination one by one
+	DeliveryMove = "move"
+	// DeliveryAtomic prepares the files in the hidden staging dir of the destination
+	// and renames them into it when the whole run (with unarchiving) is done
+	DeliveryAtomic = "atomic"
+)
+
+// Config is the whole pullcsv configuration: a list of named download jobs
+// plus the stand/pod names used in metric labels
+type Config struct {
+	StandName string `yaml:"stand_name" json:"stand_name"`
+	PodName   string `yaml:"pod_name" json:"pod_name"`
+	// Ledger is the path to the database of the downloaded files
+	Ledger string `yaml:"ledger" json:"ledger"`
+	Jobs   []Job  `yaml:"jobs" json:"jobs"`
+}
+
+// Job describes one DOWNLOAD_FROM -> DOWNLOAD_TO pair
+type Job struct {
+	Name        string    `yaml:"name" json:"name"`
+	Source      string    `yaml:"source" json:"source"`
+	Destination string    `yaml:"destination" json:"destination"`
+	Cron        string    `yaml:"cron" json:"cron"`
+	Retention   Retention `yaml:"retention" json:"retention"`
+	Options     Options   `yaml:"options" json:"options"`
+}
+
+// Retention describes when and what to delete from the job's destination
+type Retention struct {
+	Cron string `yaml:"cron" json:"cron"`
+	// OlderThan is the files lifetime in hours
+	OlderThan int `yaml:"older_than" json:"older_than"`
+	// MaxSize is the max total size of the destination's files in bytes,
+	// the oldest files are deleted above it, no limit if 0
+	MaxSize int64 `yaml:"max_size" json:"max_size"`
+	// MaxFiles is the max number of the destination's files, no limit if 0
+	MaxFiles int `yaml:"max_files" json:"max_files"`
+	// MinFreePercent is the min free space on the destination's filesystem,
+	// the oldest files are deleted below it, no limit if 0
+	MinFreePercent int `yaml:"min_free_percent" json:"min_free_percent"`
+	// DryRun only logs the files the cleanup would delete
+	DryRun bool `yaml:"dry_run" json:"dry_run"`
+	// Archive moves the files into the archive area instead of deleting them, none if nil
+	Archive *Archive `yaml:"archive" json:"archive"`
+}
+
+// Archive is the area the cleanup moves the destination's files into
+type Archive struct {
+	// Dir is the archive area outside the destination
+	Dir string `yaml:"dir" json:"dir"`
+	// Compress bundles the files into the daily <dir>/<YYYY-MM-DD>.tar.gz
+	// instead of moving them into <dir>/<YYYY-MM-DD>/
+	Compress bool `yaml:"compress" json:"compress"`
+	// OlderThan is the archived files lifetime in hours
+	OlderThan int `yaml:"older_than" json:"older_than"`
+}
+
+// Options tunes the way the job pulls files
+type Options struct {
+	// PartialDir keeps the interrupted downloads to resume them next time
+	PartialDir string `yaml:"partial_dir" json:"partial_dir"`
+	// ExcludeFileSync merges the exclude file on the source into the ledger
+	// before every run and uploads the ledger as the exclude file after it
+	ExcludeFileSync bool  `yaml:"exclude_file_sync" json:"exclude_file_sync"`
+	ExcludeMaxLines int   `yaml:"exclude_max_lines" json:"exclude_max_lines"`
+	ExcludeMaxSize  int64 `yaml:"exclude_max_size" json:"exclude_max_size"`
+	Dedup           Dedup `yaml:"dedup" json:"dedup"`
+	// Delivery is the way the files get into the destination: move or atomic
+	Delivery string `yaml:"delivery" json:"delivery"`
+	// Marker is the extension of the empty file created next to every
+	// delivered file: done or ok, none if empty. It requires atomic delivery
+	Marker string `yaml:"marker" json:"marker"`
+	// Manifest writes the JSON manifest of the delivered files into
+	// the destination after every run
+	Manifest bool `yaml:"manifest" json:"manifest"`
+	// Encoding converts the files from it to UTF-8 with LF line endings:
+	// auto to detect it or a name like windows-1251, none if empty
+	Encoding string                 `yaml:"encoding" json:"encoding"`
+	Archives helpers.ArchiveOptions `yaml:"archives" json:"archives"`
+	// Schema validates the CSV files before they are delivered, none if nil
+	Schema *Schema `yaml:"schema" json:"schema"`
+	// Dates are the rollover time and the time zone of the source's date templates
+	Dates pathtmpl.Options `yaml:"dates" json:"dates"`
+	// BackfillDays is how many days back the job pulls the days it missed
+	// since the last completed one, 0 to pull only today
+	BackfillDays int `yaml:"backfill_days" json:"backfill_days"`
+	// Staleness is how long the job may go without a successful run,
+	// a Go duration like 6h. The pod is not ready while any job is stale
+	Staleness string `yaml:"staleness" json:"staleness"`
+	// Timeout is how long a run of the job may take, a Go duration like 30m.
+	// The transfer and the unarchiving of the timed out run are interrupted
+	Timeout string `yaml:"timeout" json:"timeout"`
+	Retry   Retry  `yaml:"retry" json:"retry"`
+	// MinFreePercent is the min free space on the destination's filesystem
+	// to start a download, no check if 0
+	MinFreePercent int `yaml:"min_free_percent" json:"min_free_percent"`
+}
+
+// Retry is the policy of retrying the downloads failed with the transient errors within the run
+type Retry struct {
+	// Attempts is the max number of the downloads per run, 1 not to retry
+	Attempts int `yaml:"attempts" json:"attempts"`
+	// Backoff is the delay before the first retry (a Go duration like 30s),
+	// it doubles with every retry up to MaxBackoff
+	Backoff    string `yaml:"backoff" json:"backoff"`
+	MaxBackoff string `yaml:"max_backoff" json:"max_backoff"`
+	// ExitCodes are the retried rsync exit codes, 10, 12, 30 and 35 by default
+	ExitCodes []int `yaml:"exit_codes" json:"exit_codes"`
+}
+
+// Policy returns the validated retry policy with the parsed durations
+func (r Retry) Policy() retry.Policy {
+	backoff, _ := time.ParseDuration(r.Backoff)
+	maxBackoff, _ := time.ParseDuration(r.MaxBackoff)
+	return retry.Policy{Attempts: r.Attempts, Backoff: backoff, MaxBackoff: maxBackoff, ExitCodes: r.ExitCodes}
+}
+
+func (r Retry) validate() error {
+	if r.Attempts < 1 {
+		return errors.New("attempts must be positive!")
+	}
+	backoff, err := time.ParseDuration(r.Backoff)
+	if err != nil || backoff <= 0 {
+		return errors.New("backoff must be a positive duration like 30s!")
+	}
+	maxBackoff, err := time.ParseDuration(r.MaxBackoff)
+	if err != nil || maxBackoff < backoff {
+		return errors.New("max_backoff must be a duration not less than backoff!")
+	}
+	return nil
+}
+
+// Schema describes the valid CSV files of the job. The files which don't
+// match it are moved to the quarantine dir instead of the destination
+type Schema struct {
+	// Files is the glob of the validated file names, all the files if empty
+	Files     string `yaml:"files" json:"files"`
+	Delimiter string `yaml:"delimiter" json:"delimiter"`
+	// Header is the expected first line, it's not checked if empty
+	Header []string `yaml:"header" json:"header"`
+	// Columns is the number of columns in every line, len(Header) by default
+	Columns int `yaml:"columns" json:"columns"`
+	// Types maps a column (a header name or the number from 1) to its type,
+	// see ColumnTypes. Empty values are valid for any type
+	Types map[string]string `yaml:"types" json:"types"`
+	// Quarantine is the dir for the invalid files, <destination>/.pullcsv-quarantine/<name> by default
+	Quarantine string `yaml:"quarantine" json:"quarantine"`
+}
+
+// ColumnTypes are the types of the columns a schema may check
+var ColumnTypes = []string{"string", "int", "float", "bool", "date", "datetime"}
+
+// Dedup is the policy for the files the job has already downloaded. By default
+// a file with a known name is downloaded again if its size or mtime changed
+// and delivered again if its SHA-256 changed too
+type Dedup struct {
+	// ByName never downloads a file with a known name again
+	ByName bool `yaml:"by_name" json:"by_name"`
+	// ByContent skips the files with the same SHA-256 as another file of the job
+	ByContent bool `yaml:"by_content" json:"by_content"`
+}
+
+func (s *Schema) validate() error {
+	if _, err := filepath.Match(s.Files, ""); err != nil {
+		return errors.New("files must be a valid glob!")
+	}
+	if d := []rune(s.Delimiter); len(d) != 1 || d[0] == '"' || d[0] == '\r' || d[0] == '\n' {
+		return errors.New("delimiter must be a single character!")
+	}
+	if s.Columns < 0 || len(s.Header) > 0 && s.Columns != len(s.Header) {
+		return errors.New("columns must match the header!")
+	}
+	for column, columnType := range s.Types {
+		if !contains(ColumnTypes, columnType) {
+			return errors.New("type of " + column + " must be one of " + strings.Join(ColumnTypes, ", ") + "!")
+		}
+		if contains(s.Header, column) {
+			continue
+		}
+		if n, err := strconv.Atoi(column); err != nil || n < 1 || s.Columns > 0 && n > s.Columns {
+			return errors.New("column " + column + " is neither in the header nor a column number!")
+		}
+	}
+	return nil
+}
+
+func contains(s []string, v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the config file from path. If path is empty, the config
+// is built from the env variables (see FromEnv)
+func Load(path string) (*Config, error) {
+	if path == "" {
+		return FromEnv()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Could not read config file " + path + ", the error: " + err.Error())
+	}
+
+	cfg := &Config{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, errors.New("Could not parse config file " + path + ", the error: " + err.Error())
+	}
+
+	if cfg.StandName == "" {
+		cfg.StandName = os.Getenv("STAND_NAME")
+	}
+	if cfg.PodName == "" {
+		cfg.PodName = os.Getenv("POD_NAME")
+	}
+
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// FromEnv translates the legacy env variables (DOWNLOAD_FROM, DOWNLOAD_TO,
+// DOWNLOAD_CRON, DELETE_CRON, DELETE_OLDER_THAN...) into the Config.
+// DOWNLOAD_CRON and DELETE_CRON may hold one schedule per DOWNLOAD_FROM
+// path separated by ";", DELETE_OLDER_THAN - one value per path separated
+// by whitespace. A single value is applied to every path
+func FromEnv() (*Config, error) {
+	dFrom, dTo, standName, podName, err := helpers.PrepareEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// DuplicateEnvs appends the _TO-DAY_/_YES-TER-DAY_ copies of the paths
+	// to the end, so duplicate the indexes the same way to know
+	// which per-path value each of dFrom belongs to
+	origFrom := strings.Fields(os.Getenv("DOWNLOAD_FROM"))
+	pathsCount := len(origFrom)
+	origIdx := make([]string, pathsCount)
+	for i := range origFrom {
+		origIdx[i] = strconv.Itoa(i)
+	}
+	helpers.DuplicateEnvs(&origFrom, &origIdx)
+
+	downloadCrons, err := perPathValues("DOWNLOAD_CRON", splitTrim(os.Getenv("DOWNLOAD_CRON"), ";"), pathsCount)
+	if err != nil {
+		return nil, err
+	}
+	deleteCrons, err := perPathValues("DELETE_CRON", splitTrim(os.Getenv("DELETE_CRON"), ";"), pathsCount)
+	if err != nil {
+		return nil, err
+	}
+	deleteOlderThans, err := perPathValues("DELETE_OLDER_THAN", strings.Fields(os.Getenv("DELETE_OLDER_THAN")), pathsCount)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		StandName: standName,
+		PodName:   podName,
+	}
+	for i := range dFrom {
+		j, _ := strconv.Atoi(origIdx[i])
+		deleteOlderThan, err := strconv.Atoi(deleteOlderThans[j])
+		if err != nil {
+			return nil, errors.New("Env variable DELETE_OLDER_THAN must contain only digits!")
+		}
+		cfg.Jobs = append(cfg.Jobs, Job{
+			Source:      dFrom[i],
+			Destination: dTo[i],
+			Cron:        downloadCrons[j],
+			Retention: Retention{
+				Cron:      deleteCrons[j],
+				OlderThan: deleteOlderThan,
+			},
+			// the env deployments keep the state in the exclude file
+			// as before, they may have no persistent volume for the ledger
+			Options: Options{ExcludeFileSync: true},
+		})
+	}
+
+	if err := cfg.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// perPathValues returns one value per DOWNLOAD_FROM path: values itself
+// if there are count of them, or the single value repeated count times
+func perPathValues(envVar string, values []string, count int) ([]string, error) {
+	switch len(values) {
+	case count:
+		return values, nil
+	case 0, 1:
+		result := make([]string, count)
+		for i := range result {
+			if len(values) == 1 {
+				result[i] = values[0]
+			}
+		}
+		return result, nil
+	default:
+		return nil, errors.New("Number of items in " + envVar + " must be 1 or equal to number of items in DOWNLOAD_FROM!")
+	}
+}
+
+func splitTrim(s, sep string) (result []string) {
+	for _, v := range strings.Split(s, sep) {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func (cfg *Config) setDefaults() error {
+	if cfg.Ledger == "" {
+		cfg.Ledger = os.Getenv("PULLCSV_LEDGER")
+	}
+	if cfg.Ledger == "" {
+		cfg.Ledger = DefaultLedger
+	}
+
+	names := make(map[string]bool)
+	for i := range cfg.Jobs {
+		job := &cfg.Jobs[i]
+		if job.Name == "" {
+			job.Name = uniqueName(DefaultJobName(job.Source), names)
+		}
+		names[job.Name] = true
+
+		// unlike helpers.AddSeparator the destination is not split
+		// by whitespace, so it may contain spaces
+		if job.Destination != "" {
+			abs, err := filepath.Abs(job.Destination)
+			if err != nil {
+				return errors.New("Something was wrong with filepath.Abs for " + job.Destination)
+			}
+			job.Destination = abs + string(filepath.Separator)
+		}
+		if job.Cron == "" {
+			job.Cron = DefaultDownloadCron
+		}
+		if job.Retention.Cron == "" {
+			job.Retention.Cron = DefaultDeleteCron
+		}
+		if job.Retention.OlderThan == 0 {
+			job.Retention.OlderThan = DefaultDeleteOlderThan
+		}
+		if job.Retention.Archive != nil && job.Retention.Archive.OlderThan == 0 {
+			job.Retention.Archive.OlderThan = DefaultArchiveOlderThan
+		}
+		if job.Options.PartialDir == "" {
+			job.Options.PartialDir = filepath.Join(os.TempDir(), "pullcsv-partial", job.Name)
+		}
+		if job.Options.Delivery == "" {
+			job.Options.Delivery = DeliveryMove
+		}
+		if job.Options.ExcludeMaxLines == 0 {
+			job.Options.ExcludeMaxLines = DefaultExcludeMaxLines
+		}
+		if job.Options.ExcludeMaxSize == 0 {
+			job.Options.ExcludeMaxSize = DefaultExcludeMaxSize
+		}
+		if job.Options.Archives.MaxDepth == 0 {
+			job.Options.Archives.MaxDepth = helpers.DefaultArchiveMaxDepth
+		}
+		if job.Options.Archives.MaxSize == 0 {
+			job.Options.Archives.MaxSize = helpers.DefaultArchiveMaxSize
+		}
+		if job.Options.Archives.MaxEntries == 0 {
+			job.Options.Archives.MaxEntries = helpers.DefaultArchiveMaxEntries
+		}
+		if job.Options.Archives.MaxRatio == 0 {
+			job.Options.Archives.MaxRatio = helpers.DefaultArchiveMaxRatio
+		}
+		if job.Options.Archives.Naming == "" {
+			job.Options.Archives.Naming = helpers.NamingOriginal
+		}
+		if job.Options.Archives.Policy == "" {
+			job.Options.Archives.Policy = helpers.PolicyExtract
+		}
+		if job.Options.Dates.Rollover == "" {
+			job.Options.Dates.Rollover = pathtmpl.DefaultRollover
+		}
+		if job.Options.Staleness == "" {
+			job.Options.Staleness = DefaultStaleness
+		}
+		if job.Options.Timeout == "" {
+			job.Options.Timeout = DefaultTimeout
+		}
+		if job.Options.Retry.Attempts == 0 {
+			job.Options.Retry.Attempts = DefaultRetryAttempts
+		}
+		if job.Options.Retry.Backoff == "" {
+			job.Options.Retry.Backoff = DefaultRetryBackoff
+		}
+		if job.Options.Retry.MaxBackoff == "" {
+			job.Options.Retry.MaxBackoff = DefaultRetryMaxBackoff
+		}
+		if len(job.Options.Retry.ExitCodes) == 0 {
+			job.Options.Retry.ExitCodes = retry.DefaultExitCodes
+		}
+		if schema := job.Options.Schema; schema != nil {
+			if schema.Delimiter == "" {
+				schema.Delimiter = ","
+			}
+			if schema.Columns == 0 {
+				schema.Columns = len(schema.Header)
+			}
+			if schema.Quarantine == "" {
+				schema.Quarantine = filepath.Join(job.Destination, helpers.QuarantineDir, job.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate checks that every job is complete and job names are unique
+func (cfg *Config) Validate() error {
+	if len(cfg.Jobs) == 0 {
+		return errors.New("Config must contain at least one job!")
+	}
+
+	names := make(map[string]bool)
+	// archives are the retention archives of the destinations
+	archives := make(map[string]Archive)
+	archived := make(map[string]bool)
+	for i, job := range cfg.Jobs {
+		if job.Name == "" {
+			return errors.New("Job #" + strconv.Itoa(i) + " has no name!")
+		}
+		if names[job.Name] {
+			return errors.New("Job name " + job.Name + " is not unique!")
+		}
+		names[job.Name] = true
+
+		if job.Source == "" {
+			return errors.New("Job " + job.Name + " has no source!")
+		}
+		if job.Destination == "" {
+			return errors.New("Job " + job.Name + " has no destination!")
+		}
+		if err := pathtmpl.Validate(job.Source, job.Options.Dates); err != nil {
+			return errors.New("Job " + job.Name + ": " + err.Error())
+		}
+		if job.Options.BackfillDays < 0 {
+			return errors.New("Job " + job.Name + ": backfill_days must not be negative!")
+		}
+		if staleness, err := time.ParseDuration(job.Options.Staleness); err != nil || staleness <= 0 {
+			return errors.New("Job " + job.Name + ": staleness must be a positive duration like 6h!")
+		}
+		if timeout, err := time.ParseDuration(job.Options.Timeout); err != nil || timeout <= 0 {
+			return errors.New("Job " + job.Name + ": timeout must be a positive duration like 30m!")
+		}
+		if err := job.Options.Retry.validate(); err != nil {
+			return errors.New("Job " + job.Name + ": retry " + err.Error())
+		}
+		if job.Retention.OlderThan < 0 {
+			return errors.New("Job " + job.Name + ": retention older_than must not be negative!")
+		}
+		if job.Retention.MaxSize < 0 || job.Retention.MaxFiles < 0 {
+			return errors.New("Job " + job.Name + ": retention max_size and max_files must not be negative!")
+		}
+		if job.Retention.MinFreePercent < 0 || job.Retention.MinFreePercent > 100 {
+			return errors.New("Job " + job.Name + ": retention min_free_percent must be from 0 to 100!")
+		}
+		if job.Options.MinFreePercent < 0 || job.Options.MinFreePercent > 100 {
+			return errors.New("Job " + job.Name + ": min_free_percent must be from 0 to 100!")
+		}
+		if a := job.Retention.Archive; a != nil {
+			if !filepath.IsAbs(a.Dir) {
+				return errors.New("Job " + job.Name + ": retention archive dir must be an absolute path!")
+			}
+			if rel, err := filepath.Rel(job.Destination, a.Dir); err == nil && !strings.HasPrefix(rel, "..") {
+				return errors.New("Job " + job.Name + ": retention archive dir must be outside the destination!")
+			}
+			if a.OlderThan < 0 {
+				return errors.New("Job " + job.Name + ": retention archive older_than must not be negative!")
+			}
+			if other, ok := archives[job.Destination]; ok && (other.Dir != a.Dir || other.Compress != a.Compress) {
+				return errors.New("Job " + job.Name + ": the jobs of " + job.Destination + " must have the same retention archive dir and compress!")
+			}
+			archives[job.Destination] = *a
+		}
+		// the cleanup of the destination is shared, it would archive the files of all its jobs
+		if other, ok := archived[job.Destination]; ok && other != (job.Retention.Archive != nil) {
+			return errors.New("Job " + job.Name + ": either all or none of the jobs of " + job.Destination + " must have a retention archive!")
+		}
+		archived[job.Destination] = job.Retention.Archive != nil
+		if job.Options.Delivery != DeliveryMove && job.Options.Delivery != DeliveryAtomic {
+			return errors.New("Job " + job.Name + ": delivery must be " + DeliveryMove + " or " + DeliveryAtomic + "!")
+		}
+		if job.Options.Marker != "" && job.Options.Marker != "done" && job.Options.Marker != "ok" {
+			return errors.New("Job " + job.Name + ": marker must be done or ok!")
+		}
+		if job.Options.Marker != "" && job.Options.Delivery != DeliveryAtomic {
+			return errors.New("Job " + job.Name + ": marker requires " + DeliveryAtomic + " delivery!")
+		}
+		if err := job.Options.Archives.Validate(); err != nil {
+			return errors.New("Job " + job.Name + ": " + err.Error())
+		}
+		if job.Options.Encoding != "" && job.Options.Encoding != transcode.Auto {
+			if _, err := transcode.Lookup(job.Options.Encoding); err != nil {
+				return errors.New("Job " + job.Name + ": " + err.Error() + "!")
+			}
+		}
+		if job.Options.Schema != nil {
+			if err := job.Options.Schema.validate(); err != nil {
+				return errors.New("Job " + job.Name + ": schema " + err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Cleanup is a scheduled deletion of old files in one destination
+type Cleanup struct {
+	Destination string
+	Cron        string
+	// OlderThan is the files lifetime in hours
+	OlderThan int
+	// MaxSize, MaxFiles and MinFreePercent are the largest limits set
+	// among the jobs, no limit if 0
+	MaxSize        int64
+	MaxFiles       int
+	MinFreePercent int
+	// Jobs are the names of the jobs delivering into the destination
+	Jobs []string
+	// DryRun is set if any of the jobs has the dry run retention
+	DryRun bool
+	// Archive is the archive area of the destination with the longest
+	// archive retention among the jobs, none if nil
+	Archive *Archive
+}
+
+// Policy returns the retention policy of the cleanup's destination
+func (c Cleanup) Policy() helpers.Retention {
+	r := helpers.Retention{OlderThan: c.OlderThan, MaxSize: c.MaxSize, MaxFiles: c.MaxFiles, MinFreePercent: c.MinFreePercent}
+	if c.Archive != nil {
+		r.Archive = &helpers.ArchiveArea{Dir: c.Archive.Dir, Compress: c.Archive.Compress}
+	}
+	return r
+}
+
+// loosest returns the less strict of the limits a and b, 0 is no limit
+func loosest[T int | int64](a, b T) T {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// Cleanups returns the cleanup schedules of all jobs, one per unique
+// destination and cron. Jobs sharing a destination keep their own schedules,
+// but the files there live as long as the longest retention among the jobs,
+// so a job with a short retention can't delete the files of another one.
+// The same way the size and count limits are the largest ones set and the free
+// space limit is the smallest one, a job without a limit means no limit at all
+func (cfg *Config) Cleanups() (cleanups []Cleanup) {
+	limits := make(map[string]Retention)
+	jobs := make(map[string][]string)
+	for _, job := range cfg.Jobs {
+		l, ok := limits[job.Destination]
+		if !ok {
+			l = Retention{MaxSize: job.Retention.MaxSize, MaxFiles: job.Retention.MaxFiles, MinFreePercent: job.Retention.MinFreePercent}
+		}
+		l.DryRun = l.DryRun || job.Retention.DryRun
+		l.OlderThan = max(l.OlderThan, job.Retention.OlderThan)
+		l.MaxSize = loosest(l.MaxSize, job.Retention.MaxSize)
+		l.MaxFiles = loosest(l.MaxFiles, job.Retention.MaxFiles)
+		// the smaller free space is the looser limit
+		if l.MinFreePercent == 0 || job.Retention.MinFreePercent == 0 {
+			l.MinFreePercent = 0
+		} else {
+			l.MinFreePercent = min(l.MinFreePercent, job.Retention.MinFreePercent)
+		}
+		if a := job.Retention.Archive; a != nil {
+			if l.Archive == nil {
+				l.Archive = &Archive{Dir: a.Dir, Compress: a.Compress}
+			}
+			l.Archive.OlderThan = max(l.Archive.OlderThan, a.OlderThan)
+		}
+		limits[job.Destination] = l
+		jobs[job.Destination] = append(jobs[job.Destination], job.Name)
+	}
+
+	scheduled := make(map[string]bool)
+	for _, job := range cfg.Jobs {
+		key := job.Destination + "\x00" + job.Retention.Cron
+		if scheduled[key] {
+			continue
+		}
+		scheduled[key] = true
+		l := limits[job.Destination]
+		cleanups = append(cleanups, Cleanup{
+			Destination:    job.Destination,
+			Cron:           job.Retention.Cron,
+			OlderThan:      l.OlderThan,
+			MaxSize:        l.MaxSize,
+			MaxFiles:       l.MaxFiles,
+			MinFreePercent: l.MinFreePercent,
+			Jobs:           jobs[job.Destination],
+			DryRun:         l.DryRun,
+			Archive:        l.Archive,
+		})
+	}
+
+	return cleanups
+}
+
+// DefaultJobName makes a job name from the source path without
+// the scheme, user and host, e.g. pullcsv_some-files_TODAY_csv
+func DefaultJobName(source string) string {
+	name := regexp.MustCompile(`^[a-z0-9]+://[^/]*/`).ReplaceAllString(source, "")
+	name = regexp.MustCompile(`[^A-Za-z0-9._-]+`).ReplaceAllString(name, "_")
+	name = regexp.MustCompile(`_+`).ReplaceAllString(name, "_")
+	name = strings.Trim(name, "_")
+	if name == "" {
+		name = "job"
+	}
+
+	return name
+}
+
+func uniqueName(name string, names map[string]bool) string {
+	result := name
+	for i := 2; names[result]; i++ {
+		result = name + "-" + strconv.Itoa(i)
+	}
+
+	return result
+}
+
+// WithConfigFx provides *Config loaded from the file at path
+// (or from the env variables if path is empty)
+func WithConfigFx(path string) fx.Option {
+	return fx.Options(
+		fx.Provide(func() (*Config, error) {
+			return Load(path)
+		}),
+	)
+}
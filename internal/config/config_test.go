@@ -0,0 +1,414 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"pullcsv/internal/helpers"
+	"pullcsv/internal/pathtmpl"
+	"pullcsv/internal/retry"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	type testCase struct {
+		fileName, content string
+		want              *config.Config
+	}
+
+	want := &config.Config{
+		StandName: "dev25",
+		PodName:   "some-pod-name-5448486d5c-qjpvq",
+		Ledger:    "/data/pullcsv/ledger.db",
+		Jobs: []config.Job{
+			{
+				Name:        "stocks",
+				Source:      "rsync://USERNAME@server-name/pullcsv/stocks/*_TODAY_*csv",
+				Destination: "/path in pod/stocks/in/",
+				Cron:        "*/2 * * * *",
+				Retention:   config.Retention{Cron: "1 */1 * * *", OlderThan: 168, MaxSize: 10737418240, MinFreePercent: 10, Archive: &config.Archive{Dir: "/archive/stocks", Compress: true, OlderThan: config.DefaultArchiveOlderThan}},
+				Options: config.Options{
+					PartialDir:      filepath.Join(os.TempDir(), "pullcsv-partial", "stocks"),
+					ExcludeMaxLines: config.DefaultExcludeMaxLines,
+					ExcludeMaxSize:  config.DefaultExcludeMaxSize,
+					Dedup:           config.Dedup{ByContent: true},
+					Delivery:        config.DeliveryAtomic,
+					Marker:          "done",
+					Manifest:        true,
+					Encoding:        "windows-1251",
+					Archives: helpers.ArchiveOptions{
+						MaxDepth:   2,
+						MaxSize:    1 << 30,
+						MaxEntries: helpers.DefaultArchiveMaxEntries,
+						MaxRatio:   1000,
+						Include:    []string{"*.csv"},
+						Exclude:    []string{"__MACOSX/*"},
+						Flatten:    true,
+						Naming:     helpers.NamingPrefix,
+						Policy:     helpers.PolicyExtractAndKeep,
+					},
+					Dates:          pathtmpl.Options{Rollover: "06:00", TimeZone: "Europe/Moscow"},
+					BackfillDays:   7,
+					Staleness:      "6h",
+					Timeout:        "30m",
+					Retry:          config.Retry{Attempts: 5, Backoff: "10s", MaxBackoff: config.DefaultRetryMaxBackoff, ExitCodes: []int{12, 30}},
+					MinFreePercent: 5,
+					Schema: &config.Schema{
+						Files:      "*.csv",
+						Delimiter:  ";",
+						Header:     []string{"sku", "qty"},
+						Columns:    2,
+						Types:      map[string]string{"qty": "int"},
+						Quarantine: "/path in pod/stocks/in/.pullcsv-quarantine/stocks",
+					},
+				},
+			},
+			{
+				Name:        "pullcsv_catalog_csv",
+				Source:      "rsync://USERNAME@server-name/pullcsv/catalog/*csv",
+				Destination: "/path_in_pod/csv/in/",
+				Cron:        config.DefaultDownloadCron,
+				Retention:   config.Retention{Cron: config.DefaultDeleteCron, OlderThan: config.DefaultDeleteOlderThan},
+				Options: config.Options{
+					PartialDir:      "/var/tmp/pullcsv-partial",
+					ExcludeFileSync: true,
+					ExcludeMaxLines: config.DefaultExcludeMaxLines,
+					ExcludeMaxSize:  config.DefaultExcludeMaxSize,
+					Delivery:        config.DeliveryMove,
+					Archives: helpers.ArchiveOptions{
+						MaxDepth:   helpers.DefaultArchiveMaxDepth,
+						MaxSize:    helpers.DefaultArchiveMaxSize,
+						MaxEntries: helpers.DefaultArchiveMaxEntries,
+						MaxRatio:   helpers.DefaultArchiveMaxRatio,
+						Naming:     helpers.NamingOriginal,
+						Policy:     helpers.PolicyExtract,
+					},
+					Dates:     pathtmpl.Options{Rollover: pathtmpl.DefaultRollover},
+					Staleness: config.DefaultStaleness,
+					Timeout:   config.DefaultTimeout,
+					Retry:     config.Retry{Attempts: config.DefaultRetryAttempts, Backoff: config.DefaultRetryBackoff, MaxBackoff: config.DefaultRetryMaxBackoff, ExitCodes: retry.DefaultExitCodes},
+				},
+			},
+		},
+	}
+
+	testCases := []testCase{
+		{
+			fileName: "pullcsv.yaml",
+			content: `
+stand_name: dev25
+pod_name: some-pod-name-5448486d5c-qjpvq
+ledger: /data/pullcsv/ledger.db
+jobs:
+  - name: stocks
+    source: rsync://USERNAME@server-name/pullcsv/stocks/*_TODAY_*csv
+    destination: /path in pod/stocks/in
+    cron: "*/2 * * * *"
+    retention:
+      older_than: 168
+      max_size: 10737418240
+      min_free_percent: 10
+      archive:
+        dir: /archive/stocks
+        compress: true
+    options:
+      dedup:
+        by_content: true
+      delivery: atomic
+      marker: done
+      manifest: true
+      encoding: windows-1251
+      archives:
+        max_depth: 2
+        max_size: 1073741824
+        max_ratio: 1000
+        include: ["*.csv"]
+        exclude: ["__MACOSX/*"]
+        flatten: true
+        naming: prefix
+        policy: extract_and_keep
+      dates:
+        rollover: "06:00"
+        time_zone: Europe/Moscow
+      backfill_days: 7
+      staleness: 6h
+      timeout: 30m
+      retry:
+        attempts: 5
+        backoff: 10s
+        exit_codes: [12, 30]
+      min_free_percent: 5
+      schema:
+        files: "*.csv"
+        delimiter: ";"
+        header: [sku, qty]
+        types:
+          qty: int
+  - source: rsync://USERNAME@server-name/pullcsv/catalog/*csv
+    destination: /path_in_pod/csv/in/
+    options:
+      partial_dir: /var/tmp/pullcsv-partial
+      exclude_file_sync: true
+`,
+			want: want,
+		},
+		{
+			fileName: "pullcsv.json",
+			content: `{
+  "stand_name": "dev25",
+  "pod_name": "some-pod-name-5448486d5c-qjpvq",
+  "ledger": "/data/pullcsv/ledger.db",
+  "jobs": [
+    {"name": "stocks", "source": "rsync://USERNAME@server-name/pullcsv/stocks/*_TODAY_*csv",
+     "destination": "/path in pod/stocks/in", "cron": "*/2 * * * *", "retention": {"older_than": 168, "max_size": 10737418240, "min_free_percent": 10, "archive": {"dir": "/archive/stocks", "compress": true}}, "options": {"dedup": {"by_content": true}, "delivery": "atomic", "marker": "done", "manifest": true, "encoding": "windows-1251", "archives": {"max_depth": 2, "max_size": 1073741824, "max_ratio": 1000, "include": ["*.csv"], "exclude": ["__MACOSX/*"], "flatten": true, "naming": "prefix", "policy": "extract_and_keep"}, "dates": {"rollover": "06:00", "time_zone": "Europe/Moscow"}, "backfill_days": 7, "staleness": "6h", "timeout": "30m", "retry": {"attempts": 5, "backoff": "10s", "exit_codes": [12, 30]}, "min_free_percent": 5,
+       "schema": {"files": "*.csv", "delimiter": ";", "header": ["sku", "qty"], "types": {"qty": "int"}}}},
+    {"source": "rsync://USERNAME@server-name/pullcsv/catalog/*csv",
+     "destination": "/path_in_pod/csv/in/", "options": {"partial_dir": "/var/tmp/pullcsv-partial", "exclude_file_sync": true}}
+  ]
+}`,
+			want: want,
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := config.Load(writeConfig(t, tc.fileName, tc.content))
+		if err != nil {
+			t.Fatalf("%s: want nil, got error: %v", tc.fileName, err)
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: config mismatch (-want +got):\n%s", tc.fileName, diff)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	type testCase struct {
+		fileName, content string
+	}
+
+	testCases := []testCase{
+		{fileName: "empty.yaml", content: "jobs: []"},
+		{fileName: "unknown.yaml", content: "jobs:\n  - source: a\n    destination: /b\n    sourse: c\n"},
+		{fileName: "nosource.yaml", content: "jobs:\n  - destination: /b\n"},
+		{fileName: "nodestination.yaml", content: "jobs:\n  - source: a\n"},
+		{fileName: "duplicate.yaml", content: "jobs:\n  - {name: a, source: a, destination: /a}\n  - {name: a, source: b, destination: /b}\n"},
+		{fileName: "broken.json", content: `{"jobs": [`},
+		{fileName: "delivery.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {delivery: copy}}\n"},
+		{fileName: "marker.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {delivery: atomic, marker: ready}}\n"},
+		{fileName: "markermove.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {marker: done}}\n"},
+		{fileName: "maxdepth.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {max_depth: -1}}}\n"},
+		{fileName: "maxsize.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {max_size: -1}}}\n"},
+		{fileName: "maxratio.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {max_ratio: -5}}}\n"},
+		{fileName: "template.yaml", content: "jobs:\n  - {source: 'a/{{day -1d}}', destination: /a}\n"},
+		{fileName: "rollover.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {dates: {rollover: '25:00'}}}\n"},
+		{fileName: "timezone.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {dates: {time_zone: Mars/Olympus}}}\n"},
+		{fileName: "backfill.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {backfill_days: -1}}\n"},
+		{fileName: "staleness.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {staleness: 90}}\n"},
+		{fileName: "stalenesszero.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {staleness: 0s}}\n"},
+		{fileName: "timeout.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {timeout: -1m}}\n"},
+		{fileName: "attempts.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {retry: {attempts: -1}}}\n"},
+		{fileName: "backoff.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {retry: {backoff: 10m}}}\n"},
+		{fileName: "maxfiles.yaml", content: "jobs:\n  - {source: a, destination: /a, retention: {max_files: -1}}\n"},
+		{fileName: "minfree.yaml", content: "jobs:\n  - {source: a, destination: /a, retention: {min_free_percent: 101}}\n"},
+		{fileName: "minfreedownload.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {min_free_percent: -5}}\n"},
+		{fileName: "archivedir.yaml", content: "jobs:\n  - {source: a, destination: /a, retention: {archive: {dir: archive}}}\n"},
+		{fileName: "archiveinside.yaml", content: "jobs:\n  - {source: a, destination: /a, retention: {archive: {dir: /a/archive}}}\n"},
+		{fileName: "archivediffer.yaml", content: "jobs:\n  - {source: a, destination: /a, retention: {archive: {dir: /b}}}\n  - {source: b, destination: /a, retention: {archive: {dir: /b, compress: true}}}\n"},
+		{fileName: "archivemixed.yaml", content: "jobs:\n  - {source: a, destination: /a, retention: {archive: {dir: /b}}}\n  - {source: b, destination: /a}\n"},
+		{fileName: "policy.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {policy: delete}}}\n"},
+		{fileName: "naming.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {naming: suffix}}}\n"},
+		{fileName: "include.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {include: ['[a-']}}}\n"},
+		{fileName: "excluderegexp.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {archives: {exclude_regexp: '(csv'}}}\n"},
+		{fileName: "encoding.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {encoding: ebcdic-42}}\n"},
+		{fileName: "delimiter.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {schema: {delimiter: ';;'}}}\n"},
+		{fileName: "columns.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {schema: {header: [a, b], columns: 3}}}\n"},
+		{fileName: "type.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {schema: {header: [a], types: {a: money}}}}\n"},
+		{fileName: "typecolumn.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {schema: {header: [a], types: {b: int}}}}\n"},
+		{fileName: "typenumber.yaml", content: "jobs:\n  - {source: a, destination: /a, options: {schema: {columns: 2, types: {'3': int}}}}\n"},
+	}
+
+	for _, tc := range testCases {
+		if _, err := config.Load(writeConfig(t, tc.fileName, tc.content)); err == nil {
+			t.Errorf("%s: want error for invalid input, got nil", tc.fileName)
+		}
+	}
+
+	if _, err := config.Load("/tmp/doesntexist/pullcsv.yaml"); err == nil {
+		t.Error("want error for missing file, got nil")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("DOWNLOAD_FROM", "rsync://USERNAME@server-name/pullcsv/some-files/*_TODAY_*csv rsync://USERNAME@server-name/pullcsv/stocks/*csv")
+	t.Setenv("DOWNLOAD_TO", "/path_in_pod/csv/in/ /path_in_pod/stocks/in/")
+	t.Setenv("DOWNLOAD_CRON", "*/2 * * * *")
+	t.Setenv("DELETE_CRON", "5 */1 * * *")
+	t.Setenv("DELETE_OLDER_THAN", "24")
+	t.Setenv("RSYNC_PASSWORD", "123")
+	t.Setenv("POD_NAME", "some-pod-name-5448486d5c-qjpvq")
+	t.Setenv("STAND_NAME", "dev25")
+	t.Setenv("PULLCSV_LEDGER", "/data/ledger.db")
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+
+	wantNames := []string{"pullcsv_some-files_TODAY_csv", "pullcsv_stocks_csv", "pullcsv_some-files_TO-DAY_csv"}
+	var gotNames []string
+	for _, job := range cfg.Jobs {
+		gotNames = append(gotNames, job.Name)
+		if job.Cron != "*/2 * * * *" || job.Retention.Cron != "5 */1 * * *" || job.Retention.OlderThan != 24 {
+			t.Errorf("job %s: env schedules are not applied: %+v", job.Name, job)
+		}
+	}
+	if !cmp.Equal(wantNames, gotNames) {
+		t.Errorf("want: %v, got: %v", wantNames, gotNames)
+	}
+	if cfg.StandName != "dev25" || cfg.PodName != "some-pod-name-5448486d5c-qjpvq" {
+		t.Errorf("want stand and pod names from env, got: %s, %s", cfg.StandName, cfg.PodName)
+	}
+	for _, job := range cfg.Jobs {
+		if !job.Options.ExcludeFileSync {
+			t.Errorf("job %s: want the exclude file sync for env config", job.Name)
+		}
+	}
+	if cfg.Ledger != "/data/ledger.db" {
+		t.Errorf("want ledger from PULLCSV_LEDGER, got: %s", cfg.Ledger)
+	}
+}
+
+func TestDefaultJobName(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		source, want string
+	}
+
+	testCases := []testCase{
+		{source: "rsync://USERNAME@server-name/pullcsv/some-files/*_TODAY_*csv", want: "pullcsv_some-files_TODAY_csv"},
+		{source: "/local/dir/*.csv", want: "local_dir_.csv"},
+		{source: "rsync://server-name/", want: "job"},
+	}
+
+	for _, tc := range testCases {
+		if got := config.DefaultJobName(tc.source); got != tc.want {
+			t.Errorf("Want: %s, got: %s", tc.want, got)
+		}
+	}
+}
+
+func TestFromEnvPerPath(t *testing.T) {
+	t.Setenv("DOWNLOAD_FROM", "rsync://USERNAME@server-name/pullcsv/stocks/*_TODAY_*csv rsync://USERNAME@server-name/pullcsv/catalog/*csv")
+	t.Setenv("DOWNLOAD_TO", "/path_in_pod/stocks/in/ /path_in_pod/csv/in/")
+	t.Setenv("DOWNLOAD_CRON", "*/2 * * * *; 0 */1 * * *")
+	t.Setenv("DELETE_CRON", "1 */1 * * *")
+	t.Setenv("DELETE_OLDER_THAN", "48 168")
+	t.Setenv("RSYNC_PASSWORD", "123")
+	t.Setenv("POD_NAME", "some-pod-name-5448486d5c-qjpvq")
+	t.Setenv("STAND_NAME", "dev25")
+
+	type want struct {
+		source, cron, deleteCron string
+		olderThan                int
+	}
+
+	wants := []want{
+		{source: "rsync://USERNAME@server-name/pullcsv/stocks/*_TODAY_*csv", cron: "*/2 * * * *", deleteCron: "1 */1 * * *", olderThan: 48},
+		{source: "rsync://USERNAME@server-name/pullcsv/catalog/*csv", cron: "0 */1 * * *", deleteCron: "1 */1 * * *", olderThan: 168},
+		{source: "rsync://USERNAME@server-name/pullcsv/stocks/*_TO-DAY_*csv", cron: "*/2 * * * *", deleteCron: "1 */1 * * *", olderThan: 48},
+	}
+
+	cfg, err := config.FromEnv()
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if len(cfg.Jobs) != len(wants) {
+		t.Fatalf("want %d jobs, got: %d", len(wants), len(cfg.Jobs))
+	}
+	for i, w := range wants {
+		job := cfg.Jobs[i]
+		got := want{source: job.Source, cron: job.Cron, deleteCron: job.Retention.Cron, olderThan: job.Retention.OlderThan}
+		if got != w {
+			t.Errorf("Case %d, want: %+v, got: %+v", i, w, got)
+		}
+	}
+
+	t.Setenv("DOWNLOAD_CRON", "*/2 * * * *; 0 */1 * * *; 0 0 * * *")
+	if _, err := config.FromEnv(); err == nil {
+		t.Error("want error for too many DOWNLOAD_CRON items, got nil")
+	}
+}
+
+func TestCleanups(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Jobs: []config.Job{
+			{Name: "stocks", Destination: "/stocks/", Retention: config.Retention{Cron: "1 */1 * * *", OlderThan: 48, Archive: &config.Archive{Dir: "/archive/stocks", OlderThan: 720}}},
+			{Name: "stocks-delta", Destination: "/stocks/", Retention: config.Retention{Cron: "1 */1 * * *", OlderThan: 24, MaxSize: 1 << 30, MinFreePercent: 10, Archive: &config.Archive{Dir: "/archive/stocks", OlderThan: 2160}}},
+			{Name: "catalog", Destination: "/catalog/", Retention: config.Retention{Cron: "0 3 * * *", OlderThan: 168, MaxFiles: 1000}},
+			{Name: "catalog-full", Destination: "/catalog/", Retention: config.Retention{Cron: "0 4 * * *", OlderThan: 24, MaxFiles: 5000, DryRun: true}},
+		},
+	}
+
+	want := []config.Cleanup{
+		// stocks sets no size and free space limits, so there are none
+		{Destination: "/stocks/", Cron: "1 */1 * * *", OlderThan: 48, Jobs: []string{"stocks", "stocks-delta"}, Archive: &config.Archive{Dir: "/archive/stocks", OlderThan: 2160}},
+		{Destination: "/catalog/", Cron: "0 3 * * *", OlderThan: 168, MaxFiles: 5000, Jobs: []string{"catalog", "catalog-full"}, DryRun: true},
+		{Destination: "/catalog/", Cron: "0 4 * * *", OlderThan: 168, MaxFiles: 5000, Jobs: []string{"catalog", "catalog-full"}, DryRun: true},
+	}
+
+	got := cfg.Cleanups()
+	if !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if a := got[0].Policy().Archive; a == nil || a.Dir != "/archive/stocks" || a.Compress {
+		t.Errorf("want the archive area of /stocks/ in the policy, got: %+v", a)
+	}
+
+	// a job can't make the limits of another one stricter
+	for i, tc := range []struct {
+		retentions []config.Retention
+		want       config.Cleanup
+	}{
+		{
+			retentions: []config.Retention{{MaxFiles: 100}, {}},
+			want:       config.Cleanup{},
+		},
+		{
+			retentions: []config.Retention{{}, {MaxSize: 1 << 30, MinFreePercent: 10}},
+			want:       config.Cleanup{},
+		},
+		{
+			retentions: []config.Retention{{MaxSize: 1 << 20, MaxFiles: 100, MinFreePercent: 20}, {MaxSize: 1 << 30, MaxFiles: 50, MinFreePercent: 10}},
+			want:       config.Cleanup{MaxSize: 1 << 30, MaxFiles: 100, MinFreePercent: 10},
+		},
+	} {
+		cfg := &config.Config{}
+		for j, r := range tc.retentions {
+			cfg.Jobs = append(cfg.Jobs, config.Job{Name: strconv.Itoa(j), Destination: "/prices/", Retention: r})
+		}
+		cleanups := cfg.Cleanups()
+		if len(cleanups) != 1 {
+			t.Fatalf("Case %d: want 1 cleanup, got: %v", i, cleanups)
+		}
+		got := cleanups[0]
+		if got.MaxSize != tc.want.MaxSize || got.MaxFiles != tc.want.MaxFiles || got.MinFreePercent != tc.want.MinFreePercent {
+			t.Errorf("Case %d: want: %+v, got: %+v", i, tc.want, got)
+		}
+	}
+}
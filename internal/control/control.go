@@ -0,0 +1,232 @@
+// Package control keeps the state of the download jobs, so the operators
+// can run, pause and inspect them without waiting for cron or reading logs
+package control
+
+import (
+	"errors"
+	"pullcsv/internal/config"
+	"sync"
+	"time"
+
+	"go.uber.org/fx"
+)
+
+// The triggers of the runs
+const (
+	TriggerCron   = "cron"
+	TriggerManual = "manual"
+)
+
+var (
+	ErrUnknownJob = errors.New("Unknown job")
+	ErrRunning    = errors.New("The job is already running")
+	ErrStopped    = errors.New("The scheduler is stopped")
+)
+
+// Run is the current or the last run of a job, FinishedAt is nil while it's running
+type Run struct {
+	Trigger    string     `json:"trigger"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Status is the state of a job
+type Status struct {
+	Name        string     `json:"name"`
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Cron        string     `json:"cron"`
+	Paused      bool       `json:"paused"`
+	Running     bool       `json:"running"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+	LastRun     *Run       `json:"last_run,omitempty"`
+	// LastSuccess is the finish of the last run without errors
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// Scheduler runs the job by its name right now,
+// it's *gocron.Scheduler with the jobs tagged by their names
+type Scheduler interface {
+	RunByTag(tag string) error
+	IsRunning() bool
+}
+
+type job struct {
+	status    Status
+	scheduler Scheduler
+	next      func() time.Time
+	staleness time.Duration
+	// manual is set until the run requested by Run starts
+	manual bool
+}
+
+// Control is the state of all the jobs, it's safe for concurrent use
+type Control struct {
+	mu    sync.Mutex
+	names []string
+	jobs  map[string]*job
+	// startedAt is the time the staleness of the jobs without successful runs is counted from
+	startedAt time.Time
+}
+
+func New() *Control {
+	return &Control{jobs: make(map[string]*job), startedAt: time.Now().UTC()}
+}
+
+// Add registers the job run by s, next returns the time of its next scheduled run
+func (c *Control) Add(s Scheduler, j config.Job, next func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.jobs[j.Name]; !ok {
+		c.names = append(c.names, j.Name)
+	}
+	staleness, _ := time.ParseDuration(j.Options.Staleness)
+	c.jobs[j.Name] = &job{
+		status:    Status{Name: j.Name, Source: j.Source, Destination: j.Destination, Cron: j.Cron},
+		scheduler: s,
+		next:      next,
+		staleness: staleness,
+	}
+}
+
+// Start is called when the job starts, it reports whether the job may run
+// (the scheduled runs of the paused job are skipped) and the trigger of the run
+func (c *Control) Start(name string) (trigger string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	j, known := c.jobs[name]
+	if !known {
+		return TriggerCron, true
+	}
+	trigger = TriggerCron
+	if j.manual {
+		trigger = TriggerManual
+		j.manual = false
+	} else if j.status.Paused {
+		return "", false
+	}
+	j.status.Running = true
+	j.status.LastRun = &Run{Trigger: trigger, StartedAt: time.Now().UTC()}
+	return trigger, true
+}
+
+// Finish is called when the started job finishes, err is its error if it failed
+func (c *Control) Finish(name string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	j, known := c.jobs[name]
+	if !known || j.status.LastRun == nil {
+		return
+	}
+	finishedAt := time.Now().UTC()
+	j.status.Running = false
+	j.status.LastRun.FinishedAt = &finishedAt
+	if err != nil {
+		j.status.LastRun.Error = err.Error()
+		return
+	}
+	j.status.LastSuccess = &finishedAt
+}
+
+// Run runs the job right now, even if it's paused
+func (c *Control) Run(name string) error {
+	c.mu.Lock()
+	j, known := c.jobs[name]
+	if !known {
+		c.mu.Unlock()
+		return ErrUnknownJob
+	}
+	if j.status.Running {
+		c.mu.Unlock()
+		return ErrRunning
+	}
+	if !j.scheduler.IsRunning() {
+		c.mu.Unlock()
+		return ErrStopped
+	}
+	j.manual = true
+	c.mu.Unlock()
+
+	if err := j.scheduler.RunByTag(name); err != nil {
+		c.mu.Lock()
+		j.manual = false
+		c.mu.Unlock()
+		return errors.New("Could not run the job " + name + ", the error: " + err.Error())
+	}
+	return nil
+}
+
+// Pause makes the job skip its scheduled runs until Resume
+func (c *Control) Pause(name string) error {
+	return c.setPaused(name, true)
+}
+
+func (c *Control) Resume(name string) error {
+	return c.setPaused(name, false)
+}
+
+func (c *Control) setPaused(name string, paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	j, known := c.jobs[name]
+	if !known {
+		return ErrUnknownJob
+	}
+	j.status.Paused = paused
+	return nil
+}
+
+// Jobs returns the states of the jobs in the order they were added
+func (c *Control) Jobs() []Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	statuses := make([]Status, 0, len(c.names))
+	for _, name := range c.names {
+		statuses = append(statuses, c.jobs[name].snapshot())
+	}
+	return statuses
+}
+
+// Job returns the state of the job
+func (c *Control) Job(name string) (Status, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	j, known := c.jobs[name]
+	if !known {
+		return Status{}, ErrUnknownJob
+	}
+	return j.snapshot(), nil
+}
+
+// snapshot copies the status, so it may be read without the lock
+func (j *job) snapshot() Status {
+	status := j.status
+	if j.status.LastRun != nil {
+		run := *j.status.LastRun
+		status.LastRun = &run
+	}
+	if j.status.LastSuccess != nil {
+		lastSuccess := *j.status.LastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	if j.next != nil {
+		if next := j.next(); !next.IsZero() {
+			status.NextRun = &next
+		}
+	}
+	return status
+}
+
+// WithControlFx provides the *Control shared by the scheduler and the HTTP API
+func WithControlFx() fx.Option {
+	return fx.Options(
+		fx.Provide(New),
+	)
+}
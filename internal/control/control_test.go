@@ -0,0 +1,161 @@
+package control_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"pullcsv/internal/control"
+	"pullcsv/internal/helpers"
+	"testing"
+	"time"
+)
+
+// scheduler runs the job synchronously like gocron's RunByTag does asynchronously
+type scheduler struct {
+	ctl     *control.Control
+	runs    []string
+	err     error
+	stopped bool
+}
+
+func (s *scheduler) IsRunning() bool {
+	return !s.stopped
+}
+
+func (s *scheduler) RunByTag(tag string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if trigger, ok := s.ctl.Start(tag); ok {
+		s.runs = append(s.runs, trigger)
+		s.ctl.Finish(tag, nil)
+	}
+	return nil
+}
+
+func TestControl(t *testing.T) {
+	t.Parallel()
+
+	ctl := control.New()
+	s := &scheduler{ctl: ctl}
+	next := time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)
+	ctl.Add(s, config.Job{Name: "stocks", Source: "rsync://host/stocks/*", Destination: "/stocks/", Cron: "*/2 * * * *"}, func() time.Time { return next })
+	ctl.Add(s, config.Job{Name: "catalog"}, nil)
+
+	if jobs := ctl.Jobs(); len(jobs) != 2 || jobs[0].Name != "stocks" || jobs[1].Name != "catalog" {
+		t.Fatalf("want stocks and catalog, got: %v", jobs)
+	}
+	status, err := ctl.Job("stocks")
+	if err != nil || status.Source != "rsync://host/stocks/*" || status.Cron != "*/2 * * * *" || !status.NextRun.Equal(next) || status.LastRun != nil {
+		t.Errorf("want the stocks status, got: %+v, %v", status, err)
+	}
+
+	// a scheduled run
+	if trigger, ok := ctl.Start("stocks"); !ok || trigger != control.TriggerCron {
+		t.Errorf("want the cron run, got: %s %v", trigger, ok)
+	}
+	if status, _ := ctl.Job("stocks"); !status.Running || status.LastRun.FinishedAt != nil {
+		t.Errorf("want the running job, got: %+v", status)
+	}
+	if err := ctl.Run("stocks"); !errors.Is(err, control.ErrRunning) {
+		t.Errorf("want ErrRunning, got: %v", err)
+	}
+	ctl.Finish("stocks", errors.New("rsync failed"))
+	status, _ = ctl.Job("stocks")
+	if status.Running || status.LastRun.FinishedAt == nil || status.LastRun.Error != "rsync failed" {
+		t.Errorf("want the failed run, got: %+v", status.LastRun)
+	}
+
+	// the paused job skips the scheduled runs, but runs manually
+	if err := ctl.Pause("stocks"); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if _, ok := ctl.Start("stocks"); ok {
+		t.Error("want the paused job to skip the run")
+	}
+	if err := ctl.Run("stocks"); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if len(s.runs) != 1 || s.runs[0] != control.TriggerManual {
+		t.Errorf("want a manual run, got: %v", s.runs)
+	}
+	status, _ = ctl.Job("stocks")
+	if !status.Paused || status.LastRun.Trigger != control.TriggerManual || status.LastRun.Error != "" {
+		t.Errorf("want the paused job with the manual run, got: %+v", status)
+	}
+	ctl.Resume("stocks")
+	if _, ok := ctl.Start("stocks"); !ok {
+		t.Error("want the resumed job to run")
+	}
+
+	s.stopped = true
+	if err := ctl.Run("catalog"); !errors.Is(err, control.ErrStopped) {
+		t.Errorf("want ErrStopped, got: %v", err)
+	}
+	s.stopped = false
+
+	s.err = errors.New("no jobs found with given tag")
+	if err := ctl.Run("catalog"); err == nil {
+		t.Error("want the scheduler error, got nil")
+	}
+	for _, err := range []error{ctl.Run("prices"), ctl.Pause("prices"), ctl.Resume("prices")} {
+		if !errors.Is(err, control.ErrUnknownJob) {
+			t.Errorf("want ErrUnknownJob, got: %v", err)
+		}
+	}
+	if _, err := ctl.Job("prices"); !errors.Is(err, control.ErrUnknownJob) {
+		t.Errorf("want ErrUnknownJob, got: %v", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	ctl := control.New()
+	if err := ctl.Alive(); err == nil {
+		t.Error("want error without jobs, got nil")
+	}
+
+	dir := t.TempDir()
+	s := &scheduler{ctl: ctl}
+	ctl.Add(s, config.Job{Name: "stocks", Destination: filepath.Join(dir, "stocks"), Options: config.Options{Staleness: "1h"}}, nil)
+	ctl.Add(s, config.Job{Name: "catalog", Destination: filepath.Join(dir, "file", "catalog"), Options: config.Options{Staleness: "1h"}}, nil)
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.Alive(); err != nil {
+		t.Errorf("want nil, got error: %v", err)
+	}
+
+	// the staleness is counted from the start until the first success
+	now := time.Now().UTC()
+	jobs := ctl.Ready(now)
+	if len(jobs) != 2 || !jobs[0].Ready || !jobs[0].Writable || jobs[0].Staleness != "1h0m0s" {
+		t.Errorf("want the ready stocks, got: %+v", jobs)
+	}
+	if jobs[1].Ready || jobs[1].Writable || len(jobs[1].Errors) != 1 {
+		t.Errorf("want the catalog with the unwritable destination, got: %+v", jobs[1])
+	}
+	// the probe is done in the staging dir, the indexer doesn't see it
+	if entries, _ := os.ReadDir(filepath.Join(dir, "stocks")); len(entries) != 1 || entries[0].Name() != helpers.StagingDir {
+		t.Errorf("want only the staging dir, got: %v", entries)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "stocks", helpers.StagingDir)); len(entries) != 0 {
+		t.Errorf("want no probe files left, got: %v", entries)
+	}
+
+	if jobs := ctl.Ready(now.Add(2 * time.Hour)); jobs[0].Ready || !jobs[0].Stale || jobs[0].LastSuccess != nil {
+		t.Errorf("want the stale stocks, got: %+v", jobs[0])
+	}
+	ctl.Start("stocks")
+	ctl.Finish("stocks", nil)
+	if jobs := ctl.Ready(time.Now().UTC().Add(30 * time.Minute)); !jobs[0].Ready || jobs[0].LastSuccess == nil {
+		t.Errorf("want the fresh stocks, got: %+v", jobs[0])
+	}
+
+	s.stopped = true
+	if err := ctl.Alive(); err == nil {
+		t.Error("want error for the stopped scheduler, got nil")
+	}
+}
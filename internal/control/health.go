@@ -0,0 +1,88 @@
+package control
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/helpers"
+	"time"
+)
+
+// Readiness is the state of a job the readiness probe checks
+type Readiness struct {
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	Ready       bool   `json:"ready"`
+	Writable    bool   `json:"writable"`
+	Stale       bool   `json:"stale"`
+	// Staleness is how long the job may go without a successful run
+	Staleness   string     `json:"staleness"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Errors      []string   `json:"errors,omitempty"`
+}
+
+// Alive checks that the jobs are scheduled and the scheduler is running
+func (c *Control) Alive() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.names) == 0 {
+		return errors.New("No jobs are scheduled")
+	}
+	for _, name := range c.names {
+		if s := c.jobs[name].scheduler; s == nil || !s.IsRunning() {
+			return errors.New("The scheduler of the job " + name + " is not running")
+		}
+	}
+	return nil
+}
+
+// Ready checks every job: its destination is writable and it has a successful
+// run within its staleness at now. Until the first success the staleness
+// is counted from the start of the process
+func (c *Control) Ready(now time.Time) []Readiness {
+	c.mu.Lock()
+	jobs := make([]Readiness, 0, len(c.names))
+	for _, name := range c.names {
+		j := c.jobs[name]
+		r := Readiness{Name: name, Destination: j.status.Destination, Staleness: j.staleness.String()}
+		since := c.startedAt
+		if j.status.LastSuccess != nil {
+			lastSuccess := *j.status.LastSuccess
+			r.LastSuccess = &lastSuccess
+			since = lastSuccess
+		}
+		if j.staleness > 0 && now.Sub(since) > j.staleness {
+			r.Stale = true
+			r.Errors = append(r.Errors, "No successful runs since "+since.Format(time.RFC3339))
+		}
+		jobs = append(jobs, r)
+	}
+	c.mu.Unlock()
+
+	// the disk is checked without the lock, it may be slow
+	for i := range jobs {
+		if err := checkWritable(jobs[i].Destination); err != nil {
+			jobs[i].Errors = append(jobs[i].Errors, err.Error())
+		} else {
+			jobs[i].Writable = true
+		}
+		jobs[i].Ready = jobs[i].Writable && !jobs[i].Stale
+	}
+	return jobs
+}
+
+// checkWritable creates and removes a temporary file in the staging dir of dir,
+// creating them if needed, so the indexer never sees the probe files
+func checkWritable(dir string) error {
+	staging := filepath.Join(dir, helpers.StagingDir)
+	if err := os.MkdirAll(staging, 0770); err != nil {
+		return errors.New("Could not create the staging dir " + staging + ", the error: " + err.Error())
+	}
+	f, err := os.CreateTemp(staging, ".pullcsv-probe-")
+	if err != nil {
+		return errors.New("The destination " + dir + " is not writable, the error: " + err.Error())
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,190 @@
+package helpers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/logger"
+	"time"
+)
+
+// ArchiveArea is where the cleanup moves the files instead of deleting them,
+// to feed them to the indexer again when it rebuilds its database
+type ArchiveArea struct {
+	Dir string
+	// Compress bundles the files into the daily <Dir>/<YYYY-MM-DD>.tar.gz,
+	// otherwise they are moved into <Dir>/<YYYY-MM-DD>/. The day is the file's mtime
+	Compress bool
+}
+
+// archiveDay is the day of the archive the file with the mtime goes into
+func archiveDay(modTime time.Time) string {
+	return modTime.Format(time.DateOnly)
+}
+
+// archivePath returns the path of the file rel (relative to the cleaned dir)
+// in the archive area, for Compress it's the daily bundle
+func (a ArchiveArea) archivePath(rel string, modTime time.Time) string {
+	if a.Compress {
+		return filepath.Join(a.Dir, archiveDay(modTime)+".tar.gz")
+	}
+	return filepath.Join(a.Dir, archiveDay(modTime), rel)
+}
+
+// archive moves the files of p into the archive area, d.Archive are their paths
+// there. The files it could not archive are logged and left in place
+func (a ArchiveArea) archive(p string, deletions []Deletion) (archived []Deletion) {
+	if !a.Compress {
+		for _, d := range deletions {
+			if err := Move(d.Path, d.Archive); err != nil {
+				logger.Warn("Could not move " + d.Path + " to the archive " + d.Archive + ", the error: " + err.Error())
+				continue
+			}
+			// the archived files live by their original mtime
+			if err := os.Chtimes(d.Archive, d.ModTime, d.ModTime); err != nil {
+				logger.Warn("Could not keep the mtime of the archived " + d.Archive + ", the error: " + err.Error())
+			}
+			archived = append(archived, d)
+		}
+		return archived
+	}
+
+	var bundles []string
+	files := make(map[string][]Deletion)
+	for _, d := range deletions {
+		if files[d.Archive] == nil {
+			bundles = append(bundles, d.Archive)
+		}
+		files[d.Archive] = append(files[d.Archive], d)
+	}
+	for _, bundle := range bundles {
+		if err := appendBundle(p, bundle, files[bundle]); err != nil {
+			logger.Warn(err.Error())
+			continue
+		}
+		for _, d := range files[bundle] {
+			if err := os.Remove(d.Path); err != nil {
+				logger.Warn("Could not delete the archived file " + d.Path + ", the error: " + err.Error())
+				continue
+			}
+			archived = append(archived, d)
+		}
+	}
+	return archived
+}
+
+// appendBundle adds the files of p to the tar.gz bundle. A gzipped tar can't be
+// appended to, so the bundle is rewritten into a temp file with the old entries
+// first and renamed over the old one. The bundle's mtime is its newest file's
+func appendBundle(p, bundle string, files []Deletion) (err error) {
+	if err := os.MkdirAll(filepath.Dir(bundle), 0770); err != nil {
+		return errors.New("Could not create the archive dir " + filepath.Dir(bundle) + ", the error: " + err.Error())
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(bundle), "."+filepath.Base(bundle)+".")
+	if err != nil {
+		return errors.New("Could not create the temp bundle for " + bundle + ", the error: " + err.Error())
+	}
+	defer func() {
+		tmp.Close()
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	gw := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gw)
+	var newest time.Time
+	if old, errOpen := os.Open(bundle); errOpen == nil {
+		newest, err = copyBundle(tw, old)
+		old.Close()
+		if err != nil {
+			return errors.New("Could not read the bundle " + bundle + ", the error: " + err.Error())
+		}
+	} else if !os.IsNotExist(errOpen) {
+		return errors.New("Could not open the bundle " + bundle + ", the error: " + errOpen.Error())
+	}
+
+	for _, d := range files {
+		rel, err := filepath.Rel(p, d.Path)
+		if err != nil {
+			return err
+		}
+		if err := addToBundle(tw, d.Path, filepath.ToSlash(rel)); err != nil {
+			return errors.New("Could not add " + d.Path + " to the bundle " + bundle + ", the error: " + err.Error())
+		}
+		if d.ModTime.After(newest) {
+			newest = d.ModTime
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return errors.New("Could not write the bundle " + bundle + ", the error: " + err.Error())
+	}
+	if err = gw.Close(); err != nil {
+		return errors.New("Could not write the bundle " + bundle + ", the error: " + err.Error())
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.New("Could not write the bundle " + bundle + ", the error: " + err.Error())
+	}
+	if err = os.Rename(tmp.Name(), bundle); err != nil {
+		return errors.New("Could not replace the bundle " + bundle + ", the error: " + err.Error())
+	}
+	if err = os.Chtimes(bundle, newest, newest); err != nil {
+		return errors.New("Could not set the mtime of the bundle " + bundle + ", the error: " + err.Error())
+	}
+	return nil
+}
+
+// copyBundle copies the entries of the tar.gz r into tw, it returns the newest mtime of them
+func copyBundle(tw *tar.Writer, r io.Reader) (newest time.Time, err error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return newest, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return newest, nil
+		}
+		if err != nil {
+			return newest, err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return newest, err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return newest, err
+		}
+		if hdr.ModTime.After(newest) {
+			newest = hdr.ModTime
+		}
+	}
+}
+
+// addToBundle writes the file into tw as name
+func addToBundle(tw *tar.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,770 @@
+package helpers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"pullcsv/internal/logger"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/matchers"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// The default limits of the unarchiving. A compressed tar (tar.gz, tar.xz, ...)
+// is one level of the nested archives
+const (
+	DefaultArchiveMaxDepth   = 3
+	DefaultArchiveMaxSize    = 10 << 30
+	DefaultArchiveMaxEntries = 10000
+	DefaultArchiveMaxRatio   = 100
+)
+
+// ratioMinSize is the unpacked size of an archive from which its ratio is checked,
+// small files compress too well
+const ratioMinSize = 1 << 20
+
+// ArchiveOptions tunes the unarchiving of the job's files, the zero limits are the defaults
+type ArchiveOptions struct {
+	// MaxDepth is how many levels of nested archives are unpacked,
+	// the deeper archives are delivered as they are
+	MaxDepth int `yaml:"max_depth" json:"max_depth"`
+	// MaxSize is the total uncompressed size of an archive with the nested ones, in bytes
+	MaxSize int64 `yaml:"max_size" json:"max_size"`
+	// MaxEntries is the number of files and dirs in an archive with the nested ones
+	MaxEntries int `yaml:"max_entries" json:"max_entries"`
+	// MaxRatio is the uncompressed to compressed size ratio of every archive
+	MaxRatio int64 `yaml:"max_ratio" json:"max_ratio"`
+	// Include and Exclude are the globs of the unpacked files to deliver and to drop,
+	// a glob with / is matched against the path in the archive, the other ones against the file name
+	Include []string `yaml:"include" json:"include"`
+	Exclude []string `yaml:"exclude" json:"exclude"`
+	// IncludeRegexp and ExcludeRegexp are matched against the path in the archive
+	IncludeRegexp string `yaml:"include_regexp" json:"include_regexp"`
+	ExcludeRegexp string `yaml:"exclude_regexp" json:"exclude_regexp"`
+	// Flatten drops the dirs of the archive, the files are delivered right into the destination
+	Flatten bool `yaml:"flatten" json:"flatten"`
+	// Naming is how the unpacked files are named, NamingOriginal or NamingPrefix
+	Naming string `yaml:"naming" json:"naming"`
+	// Policy is what is done with the archives, PolicyExtract, PolicyExtractAndKeep or PolicyPassThrough
+	Policy string `yaml:"policy" json:"policy"`
+}
+
+// The policies of the archives: unpack and remove the archive,
+// unpack and deliver the archive too, deliver the archive as it is
+const (
+	PolicyExtract        = "extract"
+	PolicyExtractAndKeep = "extract_and_keep"
+	PolicyPassThrough    = "pass_through"
+)
+
+// The names of the unpacked files, with NamingPrefix stocks.csv
+// from stocks.tar.gz is delivered as stocks_stocks.csv
+const (
+	NamingOriginal = "original"
+	NamingPrefix   = "prefix"
+)
+
+// unpackDirPrefix is the prefix of the hidden dir the archive is unpacked to
+// before its files are delivered to the destination
+const unpackDirPrefix = ".pullcsv-unpack-"
+
+// Validate checks the limits, the globs and the regexps of the options
+func (o ArchiveOptions) Validate() error {
+	if o.MaxDepth < 0 || o.MaxSize < 0 || o.MaxEntries < 0 || o.MaxRatio < 0 {
+		return errors.New("archives max_depth, max_size, max_entries and max_ratio must not be negative!")
+	}
+	if o.Naming != "" && o.Naming != NamingOriginal && o.Naming != NamingPrefix {
+		return errors.New("archives naming must be " + NamingOriginal + " or " + NamingPrefix + ", not " + o.Naming + "!")
+	}
+	if o.Policy != "" && o.Policy != PolicyExtract && o.Policy != PolicyExtractAndKeep && o.Policy != PolicyPassThrough {
+		return errors.New("archives policy must be " + PolicyExtract + ", " + PolicyExtractAndKeep + " or " + PolicyPassThrough + ", not " + o.Policy + "!")
+	}
+	_, err := o.members()
+	return err
+}
+
+// memberFilter decides which unpacked files are delivered
+type memberFilter struct {
+	include, exclude     []string
+	includeRe, excludeRe *regexp.Regexp
+}
+
+func (o ArchiveOptions) members() (*memberFilter, error) {
+	f := &memberFilter{include: o.Include, exclude: o.Exclude}
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.New("Bad archives glob " + pattern + ", the error: " + err.Error())
+		}
+	}
+	var err error
+	if o.IncludeRegexp != "" {
+		if f.includeRe, err = regexp.Compile(o.IncludeRegexp); err != nil {
+			return nil, errors.New("Bad archives include_regexp " + o.IncludeRegexp + ", the error: " + err.Error())
+		}
+	}
+	if o.ExcludeRegexp != "" {
+		if f.excludeRe, err = regexp.Compile(o.ExcludeRegexp); err != nil {
+			return nil, errors.New("Bad archives exclude_regexp " + o.ExcludeRegexp + ", the error: " + err.Error())
+		}
+	}
+	return f, nil
+}
+
+// keep reports whether the file with the slash separated path in the archive is delivered
+func (f *memberFilter) keep(member string) bool {
+	if matchGlobs(f.exclude, member) || f.excludeRe != nil && f.excludeRe.MatchString(member) {
+		return false
+	}
+	if len(f.include) == 0 && f.includeRe == nil {
+		return true
+	}
+	return matchGlobs(f.include, member) || f.includeRe != nil && f.includeRe.MatchString(member)
+}
+
+func matchGlobs(patterns []string, member string) bool {
+	for _, pattern := range patterns {
+		name := member
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(member)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The limits of ArchiveOptions, they are used in the metric labels
+const (
+	LimitSize    = "size"
+	LimitEntries = "entries"
+	LimitRatio   = "ratio"
+)
+
+// LimitError is returned for the archive which exceeds one of the limits,
+// nothing is unpacked from it
+type LimitError struct {
+	Archive string
+	Limit   string
+	Msg     string
+}
+
+func (e *LimitError) Error() string {
+	return "the archive " + e.Archive + " exceeds the " + e.Limit + " limit: " + e.Msg
+}
+
+// extraction is the state of one archive being unpacked with the nested ones,
+// the zero limits of a nil extraction are not checked. It stops when ctx is done
+type extraction struct {
+	ctx     context.Context
+	opts    ArchiveOptions
+	size    int64
+	entries int
+}
+
+// entry counts the unpacked file or dir against the entries limit
+func (x *extraction) entry() error {
+	if x == nil {
+		return nil
+	}
+	if err := x.ctx.Err(); err != nil {
+		return err
+	}
+	x.entries++
+	if x.opts.MaxEntries > 0 && x.entries > x.opts.MaxEntries {
+		return &LimitError{Limit: LimitEntries, Msg: "more than " + strconv.Itoa(x.opts.MaxEntries) + " files and dirs"}
+	}
+	return nil
+}
+
+// archiveSize is the compressed size of an archive and how much is unpacked from it
+type archiveSize struct {
+	name             string
+	packed, unpacked int64
+}
+
+// copy copies r to w counting the bytes against the size and ratio limits
+func (x *extraction) copy(w io.Writer, r io.Reader, a *archiveSize) error {
+	if x == nil {
+		_, err := io.Copy(w, r)
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		n, err := r.Read(buf)
+		if n > 0 {
+			x.size += int64(n)
+			a.unpacked += int64(n)
+			if x.opts.MaxSize > 0 && x.size > x.opts.MaxSize {
+				return &LimitError{Limit: LimitSize, Msg: "more than " + strconv.FormatInt(x.opts.MaxSize, 10) + " bytes unpacked"}
+			}
+			if x.opts.MaxRatio > 0 && a.unpacked > ratioMinSize && a.unpacked > x.opts.MaxRatio*a.packed {
+				return &LimitError{Limit: LimitRatio, Msg: a.name + " is compressed more than " + strconv.FormatInt(x.opts.MaxRatio, 10) + " times"}
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// the MIME types of the supported archives
+const (
+	mimeZip   = "application/zip"
+	mimeTar   = "application/x-tar"
+	mimeGzip  = "application/gzip"
+	mimeBzip2 = "application/x-bzip2"
+	mimeXz    = "application/x-xz"
+	mimeZstd  = "application/zstd"
+	mime7z    = "application/x-7z-compressed"
+)
+
+// the extensions of the compressed files, the compressed tars become .tar
+var compressedExts = map[string]string{
+	".gz": "", ".gzip": "", ".bz2": "", ".xz": "", ".zst": "", ".zstd": "",
+	".tgz": ".tar", ".tbz": ".tar", ".tbz2": ".tar", ".txz": ".tar", ".tzst": ".tar",
+}
+
+func UnzipSource(source, destination string) error {
+	_, err := (*extraction)(nil).unzip(source, destination)
+	return err
+}
+
+func (x *extraction) unzip(source, destination string) (files []string, err error) {
+	reader, err := zip.OpenReader(source)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, reader.Close())
+	}()
+
+	destination, err = filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveSize{name: filepath.Base(source), packed: fi.Size()}
+
+	for _, f := range reader.File {
+		err := x.unzipFile(f, destination, a)
+		if err != nil {
+			return files, err
+		}
+		if !f.FileInfo().IsDir() {
+			files = append(files, filepath.Join(destination, f.Name))
+		}
+	}
+
+	return files, nil
+}
+
+// un7z unpacks the 7z archive into destination, the same way as unzip
+func (x *extraction) un7z(source, destination string) (files []string, err error) {
+	reader, err := sevenzip.OpenReader(source)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, reader.Close())
+	}()
+
+	destination, err = filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveSize{name: filepath.Base(source), packed: fi.Size()}
+
+	for _, f := range reader.File {
+		filePath, err := memberPath(destination, f.Name)
+		if err != nil {
+			return files, err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return files, err
+			}
+			if err := x.entry(); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if err := x.un7zFile(f, filePath, a); err != nil {
+			return files, err
+		}
+		files = append(files, filePath)
+	}
+
+	return files, nil
+}
+
+func (x *extraction) un7zFile(f *sevenzip.File, filePath string, a *archiveSize) (err error) {
+	packedFile, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, packedFile.Close())
+	}()
+
+	return x.writeFile(filePath, packedFile, f.Mode().Perm(), a)
+}
+
+// memberPath joins the archive member name to destination,
+// the names pointing outside of it (Zip Slip) are invalid
+func memberPath(destination, name string) (string, error) {
+	filePath := filepath.Join(destination, name)
+	if !strings.HasPrefix(filePath, filepath.Clean(destination)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid file path: %s", filePath)
+	}
+	return filePath, nil
+}
+
+func UnzipFile(f *zip.File, destination string) error {
+	return (*extraction)(nil).unzipFile(f, destination, nil)
+}
+
+func (x *extraction) unzipFile(f *zip.File, destination string, a *archiveSize) error {
+	//Check if file paths are not vulnerable to Zip Slip
+	filePath, err := memberPath(destination, f.Name)
+	if err != nil {
+		return err
+	}
+
+	if f.FileInfo().IsDir() {
+		if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+			return err
+		}
+		return x.entry()
+	}
+
+	zippedFile, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, zippedFile.Close())
+	}()
+
+	return x.writeFile(filePath, zippedFile, f.Mode(), a)
+}
+
+// untar unpacks the regular files and dirs of the tar stream into
+// destination, the links and devices are skipped
+func (x *extraction) untar(r io.Reader, destination string, a *archiveSize) (files []string, err error) {
+	destination, err = filepath.Abs(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		filePath, err := memberPath(destination, hdr.Name)
+		if err != nil {
+			return files, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
+				return files, err
+			}
+			if err := x.entry(); err != nil {
+				return files, err
+			}
+		case tar.TypeReg:
+			if err := x.writeFile(filePath, tr, hdr.FileInfo().Mode().Perm(), a); err != nil {
+				return files, err
+			}
+			files = append(files, filePath)
+		}
+	}
+}
+
+func (x *extraction) writeFile(filePath string, r io.Reader, perm os.FileMode, a *archiveSize) (err error) {
+	if err := x.entry(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	writer, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, writer.Close())
+	}()
+
+	return x.copy(writer, r, a)
+}
+
+func UngzipFile(fileName, destination string) error {
+	_, err := (*extraction)(nil).decompress(fileName, destination, mimeGzip)
+	return err
+}
+
+// decompress unpacks the gzip, bzip2, xz or zstd file into destination. A compressed
+// tar is unpacked at once, any other file is named by the gzip header or by
+// the file name without the extension
+func (x *extraction) decompress(fileName, destination, mime string) (files []string, err error) {
+	reader, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = errors.Join(err, reader.Close())
+	}()
+	fi, err := reader.Stat()
+	if err != nil {
+		return nil, err
+	}
+	a := &archiveSize{name: filepath.Base(fileName), packed: fi.Size()}
+
+	var r io.Reader
+	var name string
+	switch mime {
+	case mimeGzip:
+		archive, errGzip := gzip.NewReader(reader)
+		if errGzip != nil {
+			return nil, errGzip
+		}
+		defer func() {
+			err = errors.Join(err, archive.Close())
+		}()
+		r, name = archive, filepath.Base(archive.Name)
+	case mimeBzip2:
+		r = bzip2.NewReader(reader)
+	case mimeXz:
+		if r, err = xz.NewReader(reader); err != nil {
+			return nil, err
+		}
+	case mimeZstd:
+		archive, errZstd := zstd.NewReader(reader)
+		if errZstd != nil {
+			return nil, errZstd
+		}
+		defer archive.Close()
+		r = archive
+	default:
+		return nil, errors.New("application/type " + mime + " is not compressed")
+	}
+
+	br := bufio.NewReader(r)
+	if head, _ := br.Peek(262); matchers.Tar(head) {
+		return x.untar(br, destination, a)
+	}
+
+	if name == "" || name == "." || name == filepath.Base(fileName) {
+		name = decompressedName(fileName)
+	}
+	filePath := filepath.Join(destination, name)
+	if err := x.writeFile(filePath, br, 0644, a); err != nil {
+		return nil, err
+	}
+	return []string{filePath}, nil
+}
+
+// decompressedName is the name of the compressed file without the extension
+func decompressedName(fileName string) string {
+	name := filepath.Base(fileName)
+	ext := filepath.Ext(name)
+	if newExt, ok := compressedExts[strings.ToLower(ext)]; ok && len(name) > len(ext) {
+		return strings.TrimSuffix(name, ext) + newExt
+	}
+	return name + ".out"
+}
+
+// archiveType returns the MIME type of the file if it's a supported archive, "" if it's not.
+// Only the header of the file is read
+func archiveType(fileName string) (string, error) {
+	reader, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	kind, err := filetype.MatchReader(reader)
+	if err != nil {
+		return "", err
+	}
+
+	switch kind.MIME.Value {
+	case mimeZip, mimeTar, mimeGzip, mimeBzip2, mimeXz, mimeZstd, mime7z:
+		return kind.MIME.Value, nil
+	}
+	return "", nil
+}
+
+// unarchive unpacks one level of the archive into destination
+func (x *extraction) unarchive(fileName, destination string) ([]string, error) {
+	mime, err := archiveType(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mime {
+	case mimeZip:
+		return x.unzip(fileName, destination)
+	case mimeTar:
+		reader, err := os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		fi, err := reader.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return x.untar(reader, destination, &archiveSize{name: filepath.Base(fileName), packed: fi.Size()})
+	case mimeGzip, mimeBzip2, mimeXz, mimeZstd:
+		return x.decompress(fileName, destination, mime)
+	case mime7z:
+		return x.un7z(fileName, destination)
+	}
+	return nil, errors.New("application/type is not zip, tar, 7z, gzip, bzip2, xz or zstd " + fileName)
+}
+
+func UnarchiveFile(fileName, destination string) error {
+	_, err := ExtractArchive(context.Background(), fileName, destination, ArchiveOptions{})
+	return err
+}
+
+// ExtractArchive unpacks the archive into destination. The nested archives are
+// unpacked next to them and removed, up to opts.MaxDepth levels. A nested archive
+// which couldn't be unpacked is left as is and its error is returned
+// with the unpacked files. The archive is unpacked into a hidden dir first,
+// so if it exceeds the limits nothing is delivered and *LimitError is returned.
+// Then the files matching the opts rules are moved to destination.
+// If ctx is done while unpacking, nothing is delivered too
+func ExtractArchive(ctx context.Context, fileName, destination string, opts ArchiveOptions) (files []string, err error) {
+	if opts.MaxDepth < 1 {
+		opts.MaxDepth = DefaultArchiveMaxDepth
+	}
+	if opts.MaxSize < 1 {
+		opts.MaxSize = DefaultArchiveMaxSize
+	}
+	if opts.MaxEntries < 1 {
+		opts.MaxEntries = DefaultArchiveMaxEntries
+	}
+	if opts.MaxRatio < 1 {
+		opts.MaxRatio = DefaultArchiveMaxRatio
+	}
+	filter, err := opts.members()
+	if err != nil {
+		return nil, err
+	}
+	// the input is checked before anything is created in destination
+	mime, err := archiveType(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if mime == "" {
+		return nil, errors.New("application/type is not zip, tar, 7z, gzip, bzip2, xz or zstd " + fileName)
+	}
+
+	if err := os.MkdirAll(destination, os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(destination, unpackDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	x := &extraction{ctx: ctx, opts: opts}
+	unpacked, err := x.extract(fileName, tmp, 1)
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		limitErr.Archive = fileName
+		return nil, limitErr
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, errors.New("The unarchiving of " + fileName + " was interrupted, the error: " + ctxErr.Error())
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range unpacked {
+		rel, errRel := filepath.Rel(tmp, f)
+		if errRel != nil {
+			err = errors.Join(err, errRel)
+			continue
+		}
+		member := filepath.ToSlash(rel)
+		if !filter.keep(member) {
+			logger.Info("The file " + member + " of the archive " + fileName + " is skipped by the archives rules")
+			continue
+		}
+		target := rel
+		if opts.Flatten {
+			target = filepath.Base(rel)
+		}
+		if opts.Naming == NamingPrefix {
+			target = filepath.Join(filepath.Dir(target), archiveStem(fileName)+"_"+filepath.Base(target))
+		}
+		if seen[target] {
+			logger.Warn("The file " + member + " of the archive " + fileName + " has the same name " + target + " as another file of it, it is skipped")
+			continue
+		}
+		seen[target] = true
+
+		filePath := filepath.Join(destination, target)
+		if errMove := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); errMove != nil {
+			err = errors.Join(err, errMove)
+			continue
+		}
+		if errMove := os.Rename(f, filePath); errMove != nil {
+			err = errors.Join(err, errMove)
+			continue
+		}
+		files = append(files, filePath)
+	}
+	return files, err
+}
+
+// archiveStem returns the name of the archive without the archive extensions,
+// e.g. stocks for stocks.tar.gz
+func archiveStem(fileName string) string {
+	name := filepath.Base(fileName)
+	for {
+		ext := strings.ToLower(filepath.Ext(name))
+		_, compressed := compressedExts[ext]
+		if len(name) == len(ext) || !compressed && ext != ".zip" && ext != ".tar" && ext != ".7z" {
+			return name
+		}
+		name = name[:len(name)-len(ext)]
+	}
+}
+
+func (x *extraction) extract(fileName, destination string, depth int) (files []string, err error) {
+	unpacked, err := x.unarchive(fileName, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range unpacked {
+		mime, errType := archiveType(f)
+		if errType != nil || mime == "" {
+			files = append(files, f)
+			continue
+		}
+		if depth >= x.opts.MaxDepth {
+			logger.Info("The nested archive " + f + " is deeper than " + strconv.Itoa(x.opts.MaxDepth) + " levels, it is left as is")
+			files = append(files, f)
+			continue
+		}
+		nested, errNested := x.extract(f, filepath.Dir(f), depth+1)
+		var limitErr *LimitError
+		if errors.As(errNested, &limitErr) {
+			return nil, limitErr
+		}
+		if errNested != nil {
+			err = errors.Join(err, errors.New("Something was wrong with unarchive the nested file "+f+", the error: "+errNested.Error()))
+			files = append(files, f)
+			continue
+		}
+		os.Remove(f)
+		files = append(files, nested...)
+	}
+	return files, err
+}
+
+// IsArchive reports whether the file is a supported archive by its content
+func IsArchive(fileName string) bool {
+	mime, err := archiveType(fileName)
+	return err == nil && mime != ""
+}
+
+// WorkWithArchives unpacks the archives among the files names of p (all the files of p if names is nil)
+// and removes them with PolicyExtract. The archives are detected by their content.
+// The archives exceeding the limits are left as they are and returned as rejected.
+// If ctx is done, the rest of the archives are left as they are too.
+// extracted is the number of the archives anything was unpacked from, unpacked are the paths of the unpacked files
+func WorkWithArchives(ctx context.Context, p string, names []string, opts ArchiveOptions) (extracted int, unpacked []string, rejected []*LimitError, wwaerr error) {
+	if opts.Policy == PolicyPassThrough {
+		logger.Info("The archives in " + p + " are delivered as they are")
+		return 0, nil, nil, nil
+	}
+
+	logger.Info("Start unarchiving files in " + p)
+	if names == nil {
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return 0, nil, nil, errors.New("Could not read " + p + ", the error: " + err.Error())
+		}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return extracted, unpacked, rejected, errors.Join(wwaerr, errors.New("The unarchiving in "+p+" was interrupted, the error: "+err.Error()))
+		}
+		fArhive := filepath.Join(p, name)
+		if fi, err := os.Stat(fArhive); err != nil || fi.IsDir() || !IsArchive(fArhive) {
+			continue
+		}
+		logger.Info("Unarchive the file " + fArhive)
+		files, err := ExtractArchive(ctx, fArhive, p, opts)
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			logger.Warn("The archive " + fArhive + " is rejected, " + limitErr.Error())
+			rejected = append(rejected, limitErr)
+			continue
+		}
+		if err == nil || len(files) > 0 {
+			extracted++
+		}
+		unpacked = append(unpacked, files...)
+		// the archive is removed if anything was unpacked from it
+		if opts.Policy != PolicyExtractAndKeep && (err == nil || len(files) > 0) {
+			logger.Info("Remove the file " + fArhive)
+			os.Remove(fArhive)
+		}
+		if err != nil {
+			wwaerr = errors.Join(wwaerr, errors.New("Something was wrong with unarchive the file "+fArhive+", the error: "+err.Error()))
+		}
+	}
+	logger.Info("Stop unarchiving files in " + p)
+
+	return extracted, unpacked, rejected, wwaerr
+}
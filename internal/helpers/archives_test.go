@@ -0,0 +1,371 @@
+package helpers_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/helpers"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func tarball(t *testing.T, w io.Writer, files map[string]string) {
+	t.Helper()
+
+	tw := tar.NewWriter(w)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// walkFiles returns the files of dir relative to it
+func walkFiles(t *testing.T, dir string) (files []string) {
+	t.Helper()
+
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+func TestExtractArchive(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	fixtures := t.TempDir()
+	var buf bytes.Buffer
+	xw, _ := xz.NewWriter(&buf)
+	tarball(t, xw, map[string]string{"stocks.csv": "a;1\n", "dir/prices.csv": "b;2\n"})
+	xw.Close()
+	os.WriteFile(filepath.Join(fixtures, "stocks.txz"), buf.Bytes(), 0644)
+
+	buf.Reset()
+	zw, _ := zstd.NewWriter(&buf)
+	zw.Write([]byte("a;1\n"))
+	zw.Close()
+	os.WriteFile(filepath.Join(fixtures, "stocks.csv.zst"), buf.Bytes(), 0644)
+
+	buf.Reset()
+	gw := gzip.NewWriter(&buf)
+	gw.Name = "../../evil.csv"
+	gw.Write([]byte("a;1\n"))
+	gw.Close()
+	os.WriteFile(filepath.Join(fixtures, "named.gz"), buf.Bytes(), 0644)
+
+	buf.Reset()
+	gw = gzip.NewWriter(&buf)
+	tarball(t, gw, map[string]string{"../evil.csv": "a;1\n"})
+	gw.Close()
+	os.WriteFile(filepath.Join(fixtures, "zipslip.tar.gz"), buf.Bytes(), 0644)
+
+	os.WriteFile(filepath.Join(fixtures, "broken.7z"), []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0, 4}, 0644)
+	os.WriteFile(filepath.Join(fixtures, "stocks.csv"), []byte("a;1\n"), 0644)
+
+	type testCase struct {
+		archive  string
+		maxDepth int
+		want     []string
+		wantErr  bool
+	}
+
+	testCases := []testCase{
+		// stocks.tar.bz2 has in/stocks.csv and nested.zip with prices.csv and deep.csv.gz
+		{archive: "../../forTests/stocks.tar.bz2", want: []string{"deep.csv", "in/stocks.csv", "prices.csv"}},
+		{archive: "../../forTests/stocks.tar.bz2", maxDepth: 2, want: []string{"deep.csv.gz", "in/stocks.csv", "prices.csv"}},
+		{archive: "../../forTests/stocks.tar.bz2", maxDepth: 1, want: []string{"in/stocks.csv", "nested.zip"}},
+		{archive: filepath.Join(fixtures, "stocks.txz"), want: []string{"dir/prices.csv", "stocks.csv"}},
+		{archive: filepath.Join(fixtures, "stocks.csv.zst"), want: []string{"stocks.csv"}},
+		{archive: filepath.Join(fixtures, "named.gz"), want: []string{"evil.csv"}},
+		{archive: "../../forTests/README.md.zip", want: []string{"README.md", "__MACOSX/._README.md"}},
+		{archive: filepath.Join(fixtures, "zipslip.tar.gz"), wantErr: true},
+		// foobar.7z has foo and bar
+		{archive: "../../forTests/foobar.7z", want: []string{"bar", "foo"}},
+		{archive: filepath.Join(fixtures, "broken.7z"), wantErr: true},
+		{archive: filepath.Join(fixtures, "stocks.csv"), wantErr: true},
+	}
+
+	for i, tc := range testCases {
+		dst := t.TempDir()
+		files, err := helpers.ExtractArchive(context.Background(), tc.archive, dst, helpers.ArchiveOptions{MaxDepth: tc.maxDepth})
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Case %d: want error, got nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+
+		var got []string
+		for _, f := range files {
+			rel, _ := filepath.Rel(dst, f)
+			got = append(got, rel)
+		}
+		sort.Strings(got)
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("Case %d, want: %v, got: %v", i, tc.want, got)
+		}
+		if onDisk := walkFiles(t, dst); !cmp.Equal(tc.want, onDisk) {
+			t.Errorf("Case %d, want on disk: %v, got: %v", i, tc.want, onDisk)
+		}
+	}
+}
+
+func TestExtractArchiveRules(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	var buf bytes.Buffer
+	tarball(t, &buf, map[string]string{"a/x.csv": "a;1\n", "b/x.csv": "b;2\n"})
+	collision := filepath.Join(t.TempDir(), "collision.tar")
+	os.WriteFile(collision, buf.Bytes(), 0644)
+
+	type testCase struct {
+		archive string
+		opts    helpers.ArchiveOptions
+		want    []string
+	}
+
+	// stocks.tar.bz2 has in/stocks.csv and nested.zip with prices.csv and deep.csv.gz
+	stocks := "../../forTests/stocks.tar.bz2"
+	testCases := []testCase{
+		{archive: stocks, opts: helpers.ArchiveOptions{Include: []string{"*.csv"}}, want: []string{"deep.csv", "in/stocks.csv", "prices.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{Exclude: []string{"in/*"}}, want: []string{"deep.csv", "prices.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{IncludeRegexp: "^in/"}, want: []string{"in/stocks.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{Include: []string{"prices.csv"}, IncludeRegexp: "^in/"}, want: []string{"in/stocks.csv", "prices.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{ExcludeRegexp: "deep"}, want: []string{"in/stocks.csv", "prices.csv"}},
+		// the kept nested archive is filtered as any other file
+		{archive: stocks, opts: helpers.ArchiveOptions{MaxDepth: 1, Include: []string{"*.csv"}}, want: []string{"in/stocks.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{Flatten: true}, want: []string{"deep.csv", "prices.csv", "stocks.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{Naming: helpers.NamingPrefix}, want: []string{"in/stocks_stocks.csv", "stocks_deep.csv", "stocks_prices.csv"}},
+		{archive: stocks, opts: helpers.ArchiveOptions{Flatten: true, Naming: helpers.NamingPrefix}, want: []string{"stocks_deep.csv", "stocks_prices.csv", "stocks_stocks.csv"}},
+		{archive: "../../forTests/README.md.zip", opts: helpers.ArchiveOptions{Exclude: []string{"__MACOSX/*"}}, want: []string{"README.md"}},
+		{archive: "../../forTests/README.md.zip", opts: helpers.ArchiveOptions{Flatten: true, Naming: helpers.NamingPrefix}, want: []string{"README.md_._README.md", "README.md_README.md"}},
+		// only the first of the files with the same flattened name is delivered
+		{archive: collision, opts: helpers.ArchiveOptions{Flatten: true}, want: []string{"x.csv"}},
+	}
+
+	for i, tc := range testCases {
+		dst := t.TempDir()
+		if _, err := helpers.ExtractArchive(context.Background(), tc.archive, dst, tc.opts); err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if got := walkFiles(t, dst); !cmp.Equal(tc.want, got) {
+			t.Errorf("Case %d, want: %v, got: %v", i, tc.want, got)
+		}
+	}
+
+	if _, err := helpers.ExtractArchive(context.Background(), stocks, t.TempDir(), helpers.ArchiveOptions{IncludeRegexp: "(csv"}); err == nil {
+		t.Error("want error for bad regexp, got nil")
+	}
+}
+
+func TestExtractArchiveCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dst := t.TempDir()
+	if _, err := helpers.ExtractArchive(ctx, "../../forTests/stocks.tar.bz2", dst, helpers.ArchiveOptions{}); err == nil {
+		t.Error("want error for the canceled context, got nil")
+	}
+	if got := walkFiles(t, dst); len(got) != 0 {
+		t.Errorf("want nothing delivered, got: %v", got)
+	}
+}
+
+func TestWorkWithArchives(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	dir := t.TempDir()
+	data, _ := os.ReadFile("../../forTests/stocks.tar.bz2")
+	os.WriteFile(filepath.Join(dir, "stocks.tar.bz2"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "prices.csv"), []byte("a;1\n"), 0644)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(make([]byte, 4<<20))
+	gw.Close()
+	os.WriteFile(filepath.Join(dir, "bomb.csv.gz"), buf.Bytes(), 0644)
+
+	extracted, unpacked, rejected, err := helpers.WorkWithArchives(context.Background(), dir, nil, helpers.ArchiveOptions{MaxDepth: 3})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if extracted != 1 {
+		t.Errorf("want 1 extracted archive, got: %d", extracted)
+	}
+	var got []string
+	for _, f := range unpacked {
+		rel, _ := filepath.Rel(dir, f)
+		got = append(got, rel)
+	}
+	sort.Strings(got)
+	if want := []string{"deep.csv", "in/stocks.csv", "prices.csv"}; !cmp.Equal(want, got) {
+		t.Errorf("want unpacked: %v, got: %v", want, got)
+	}
+	if len(rejected) != 1 || rejected[0].Archive != filepath.Join(dir, "bomb.csv.gz") || rejected[0].Limit != helpers.LimitRatio {
+		t.Errorf("want bomb.csv.gz rejected by the ratio, got: %v", rejected)
+	}
+	// the rejected archive is left for the caller
+	want := []string{"bomb.csv.gz", "deep.csv", "in/stocks.csv", "prices.csv"}
+	if got := walkFiles(t, dir); !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestWorkWithArchivesPolicy(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	stocks, _ := os.ReadFile("../../forTests/stocks.tar.bz2")
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Name = "quotes.csv"
+	gw.Write([]byte("a;1\n"))
+	gw.Close()
+
+	type testCase struct {
+		names  []string
+		policy string
+		want   []string
+	}
+
+	testCases := []testCase{
+		{want: []string{"deep.csv", "gzprices.csv", "in/stocks.csv", "prices.csv", "quotes.csv"}},
+		{policy: helpers.PolicyExtract, want: []string{"deep.csv", "gzprices.csv", "in/stocks.csv", "prices.csv", "quotes.csv"}},
+		{policy: helpers.PolicyExtractAndKeep, want: []string{"deep.csv", "gzprices.csv", "in/stocks.csv", "prices.csv", "quotes", "quotes.csv", "stocks.tar.bz2"}},
+		{policy: helpers.PolicyPassThrough, want: []string{"gzprices.csv", "quotes", "stocks.tar.bz2"}},
+		// only the files of the run are unarchived
+		{names: []string{"quotes", "gzprices.csv"}, want: []string{"gzprices.csv", "quotes.csv", "stocks.tar.bz2"}},
+	}
+
+	for i, tc := range testCases {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "stocks.tar.bz2"), stocks, 0644)
+		// the archive without an extension is detected by the content, the text file with gz in the name is not an archive
+		os.WriteFile(filepath.Join(dir, "quotes"), buf.Bytes(), 0644)
+		os.WriteFile(filepath.Join(dir, "gzprices.csv"), []byte("a;1\n"), 0644)
+
+		if _, _, _, err := helpers.WorkWithArchives(context.Background(), dir, tc.names, helpers.ArchiveOptions{Policy: tc.policy}); err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if got := walkFiles(t, dir); !cmp.Equal(tc.want, got) {
+			t.Errorf("Case %d, want: %v, got: %v", i, tc.want, got)
+		}
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	fixtures := t.TempDir()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write(make([]byte, 4<<20))
+	gw.Close()
+	os.WriteFile(filepath.Join(fixtures, "bomb.csv.gz"), buf.Bytes(), 0644)
+
+	buf.Reset()
+	tarball(t, &buf, map[string]string{"a.csv": strings.Repeat("a", 1000), "dir/b.csv": strings.Repeat("b", 1000)})
+	os.WriteFile(filepath.Join(fixtures, "stocks.tar"), buf.Bytes(), 0644)
+
+	type testCase struct {
+		archive   string
+		opts      helpers.ArchiveOptions
+		wantLimit string
+	}
+
+	testCases := []testCase{
+		{archive: filepath.Join(fixtures, "bomb.csv.gz"), wantLimit: helpers.LimitRatio},
+		{archive: filepath.Join(fixtures, "bomb.csv.gz"), opts: helpers.ArchiveOptions{MaxRatio: 10000}},
+		{archive: filepath.Join(fixtures, "bomb.csv.gz"), opts: helpers.ArchiveOptions{MaxSize: 1 << 20, MaxRatio: 10000}, wantLimit: helpers.LimitSize},
+		{archive: filepath.Join(fixtures, "stocks.tar"), opts: helpers.ArchiveOptions{MaxSize: 1500}, wantLimit: helpers.LimitSize},
+		{archive: filepath.Join(fixtures, "stocks.tar"), opts: helpers.ArchiveOptions{MaxSize: 2000}},
+		{archive: filepath.Join(fixtures, "stocks.tar"), opts: helpers.ArchiveOptions{MaxEntries: 1}, wantLimit: helpers.LimitEntries},
+		// the limits count the nested archives too
+		{archive: "../../forTests/stocks.tar.bz2", opts: helpers.ArchiveOptions{MaxEntries: 3}, wantLimit: helpers.LimitEntries},
+		{archive: "../../forTests/stocks.tar.bz2", opts: helpers.ArchiveOptions{MaxEntries: 3, MaxDepth: 1}},
+	}
+
+	for i, tc := range testCases {
+		dst := t.TempDir()
+		_, err := helpers.ExtractArchive(context.Background(), tc.archive, dst, tc.opts)
+		if tc.wantLimit == "" {
+			if err != nil {
+				t.Errorf("Case %d: want nil, got error: %v", i, err)
+			}
+			continue
+		}
+		var limitErr *helpers.LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("Case %d: want limit error, got: %v", i, err)
+			continue
+		}
+		if limitErr.Limit != tc.wantLimit || limitErr.Archive != tc.archive {
+			t.Errorf("Case %d, want: %s %s, got: %s %s", i, tc.archive, tc.wantLimit, limitErr.Archive, limitErr.Limit)
+		}
+		// nothing is left from the rejected archive
+		if entries, _ := os.ReadDir(dst); len(entries) != 0 {
+			t.Errorf("Case %d, want empty destination, got: %v", i, entries)
+		}
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	t.Parallel()
+
+	zipped, _ := os.ReadFile("../../forTests/README.md.zip")
+	stocks, _ := os.ReadFile("../../forTests/stocks.tar.bz2")
+	var buf bytes.Buffer
+	zw, _ := zstd.NewWriter(&buf)
+	zw.Write([]byte("a;1\n"))
+	zw.Close()
+
+	dir := t.TempDir()
+	for name, tc := range map[string]struct {
+		content []byte
+		want    bool
+	}{
+		"stocks.zip":     {content: zipped, want: true},
+		"stocks":         {content: zipped, want: true},
+		"stocks.tar.bz2": {content: stocks, want: true},
+		"stocks.csv.zst": {content: buf.Bytes(), want: true},
+		"stocks.csv.gz":  {content: []byte("a;1\n")},
+		"gzprices.csv":   {content: []byte("a;1\n")},
+		"empty.zip":      {},
+	} {
+		os.WriteFile(filepath.Join(dir, name), tc.content, 0644)
+		if got := helpers.IsArchive(filepath.Join(dir, name)); got != tc.want {
+			t.Errorf("%s, want: %v, got: %v", name, tc.want, got)
+		}
+	}
+	if helpers.IsArchive(filepath.Join(dir, "doesntexist.zip")) {
+		t.Error("want false for missing file, got true")
+	}
+}
@@ -0,0 +1,274 @@
+package helpers
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/logger"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The reasons the cleanup deletes a file for
+const (
+	// ReasonExpired is a file older than the retention
+	ReasonExpired = "expired"
+	// ReasonPartial is an rsync partial file older than PartialMaxAge
+	ReasonPartial = "partial"
+	// ReasonMaxSize, ReasonMaxFiles and ReasonMinFree are the oldest files
+	// evicted to keep the dir within the Retention limits
+	ReasonMaxSize  = "max_size"
+	ReasonMaxFiles = "max_files"
+	ReasonMinFree  = "min_free"
+)
+
+// Retention is the cleanup policy of a dir, the zero limits are not checked
+type Retention struct {
+	// OlderThan is the files lifetime in hours
+	OlderThan int
+	// MaxSize is the max total size of the files in bytes
+	MaxSize  int64
+	MaxFiles int
+	// MinFreePercent is the min free space on the dir's filesystem in percent
+	MinFreePercent int
+	// Archive is where the files are moved instead of deleting, the partial
+	// files and the files evicted for MinFreePercent are always deleted.
+	// Nil to delete the files
+	Archive *ArchiveArea
+}
+
+// PartialMaxAge is the lifetime of the rsync partial files in hours
+const PartialMaxAge = 4
+
+// partialFileNameRe matches the rsync partial files, e.g. .stocks.csv.aw3dfq
+var partialFileNameRe = regexp.MustCompile(`\..*\.\w{6}`)
+
+// Deletion is a file the cleanup deletes
+type Deletion struct {
+	Path    string    `json:"path"`
+	Reason  string    `json:"reason"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Archive is the path in the archive area the file is moved to, empty if it's deleted
+	Archive string `json:"archive,omitempty"`
+}
+
+// FreeSpace returns the available to the user and the total bytes of the filesystem of p
+func FreeSpace(p string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, 0, errors.New("Could not get the free space of " + p + ", the error: " + err.Error())
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+// sameFilesystem reports whether p and dir (or its nearest existing parent)
+// are on the same filesystem, moving files between them frees nothing
+func sameFilesystem(p, dir string) bool {
+	pi, err := os.Stat(p)
+	if err != nil {
+		return true
+	}
+	di, err := os.Stat(dir)
+	for err != nil && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		di, err = os.Stat(dir)
+	}
+	if err != nil {
+		return true
+	}
+	pst, ok1 := pi.Sys().(*syscall.Stat_t)
+	dst, ok2 := di.Sys().(*syscall.Stat_t)
+	return !ok1 || !ok2 || pst.Dev == dst.Dev
+}
+
+// FreePercent returns the available space of the filesystem of p in percent
+func FreePercent(p string) (float64, error) {
+	free, total, err := FreeSpace(p)
+	if err != nil || total == 0 {
+		return 100, err
+	}
+	return float64(free) * 100 / float64(total), nil
+}
+
+// inProgress reports whether the file is being prepared by a running job,
+// such files are not evicted
+func inProgress(rel string) bool {
+	for _, dir := range strings.Split(filepath.ToSlash(rel), "/") {
+		if dir == StagingDir || strings.HasPrefix(dir, unpackDirPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// planDeletion returns the files of p older than r.OlderThan hours, the rsync
+// partial files older than PartialMaxAge hours and then the oldest of the rest
+// of the files while p exceeds the r limits
+func planDeletion(p string, r Retention) (planned []Deletion, err error) {
+	deleteOlderThan := r.OlderThan
+	var kept []Deletion
+	err = filepath.WalkDir(p, func(path string, di fs.DirEntry, err error) error {
+		if err != nil {
+			logger.Warn("Could not read " + path + ", the error: " + err.Error())
+			return nil
+		}
+		// the files being prepared by a running job are skipped whatever their age
+		if rel, errRel := filepath.Rel(p, path); errRel == nil && inProgress(rel) {
+			if di.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if di.IsDir() {
+			return nil
+		}
+		info, err := di.Info()
+		if err != nil {
+			logger.Warn("Could not get info about " + path + ", the error: " + err.Error())
+			return nil
+		}
+
+		d := Deletion{Path: path, Size: info.Size(), ModTime: info.ModTime()}
+		switch {
+		case IsOlderThan(info.ModTime(), deleteOlderThan):
+			d.Reason = ReasonExpired
+		case IsOlderThan(info.ModTime(), PartialMaxAge) && partialFileNameRe.MatchString(info.Name()):
+			d.Reason = ReasonPartial
+		default:
+			kept = append(kept, d)
+			return nil
+		}
+		planned = append(planned, d)
+		return nil
+	})
+	if err != nil {
+		return planned, errors.New("Could not walk through " + p + ", the error: " + err.Error())
+	}
+	if r.MaxSize <= 0 && r.MaxFiles <= 0 && r.MinFreePercent <= 0 {
+		return planned, nil
+	}
+
+	var size int64
+	count := len(kept)
+	for _, d := range kept {
+		size += d.Size
+	}
+	archiveFrees := r.Archive == nil || !sameFilesystem(p, r.Archive.Dir)
+	var free, total uint64
+	if r.MinFreePercent > 0 {
+		free, total, err = FreeSpace(p)
+		if err != nil {
+			return planned, err
+		}
+		// the planned files are freed first, the archived ones only if
+		// the archive area is on another filesystem
+		for _, d := range planned {
+			if d.Reason == ReasonPartial || archiveFrees {
+				free += uint64(d.Size)
+			}
+		}
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].ModTime.Before(kept[j].ModTime) })
+	for _, d := range kept {
+		switch {
+		case r.MaxSize > 0 && size > r.MaxSize:
+			d.Reason = ReasonMaxSize
+		case r.MaxFiles > 0 && count > r.MaxFiles:
+			d.Reason = ReasonMaxFiles
+		case r.MinFreePercent > 0 && total > 0 && free*100 < uint64(r.MinFreePercent)*total:
+			d.Reason = ReasonMinFree
+		default:
+			return planned, nil
+		}
+		planned = append(planned, d)
+		size -= d.Size
+		count--
+		// the min_free files are deleted even with the archive area
+		if d.Reason == ReasonMinFree || archiveFrees {
+			free += uint64(d.Size)
+		}
+	}
+	return planned, nil
+}
+
+// PlanDeletion returns the files of p older than r.OlderThan hours, the rsync
+// partial files older than PartialMaxAge hours and then the oldest of the rest
+// of the files while p exceeds the r limits. With r.Archive the files but
+// the partial ones and the ones evicted for the free space have their paths
+// in the archive area: moving them to the same disk would free nothing
+func PlanDeletion(p string, r Retention) ([]Deletion, error) {
+	planned, err := planDeletion(p, r)
+	if r.Archive == nil {
+		return planned, err
+	}
+	for i, d := range planned {
+		if d.Reason == ReasonPartial || d.Reason == ReasonMinFree {
+			continue
+		}
+		if rel, errRel := filepath.Rel(p, d.Path); errRel == nil {
+			planned[i].Archive = r.Archive.archivePath(rel, d.ModTime)
+		}
+	}
+	return planned, err
+}
+
+// DeleteFiles deletes the files PlanDeletion returns for p: older than r.OlderThan
+// hours, partial rsync files older than PartialMaxAge hours and the oldest files
+// exceeding the r limits, or moves them into r.Archive. With dryRun nothing is
+// deleted, the files are only logged. It returns the deleted (or to be deleted) files
+func DeleteFiles(p string, r Retention, dryRun bool) (deleted []Deletion, err error) {
+	logger.Info("Start deleting old files in " + p)
+
+	planned, err := PlanDeletion(p, r)
+	var toArchive []Deletion
+	for _, d := range planned {
+		var msg string
+		switch d.Reason {
+		case ReasonExpired:
+			msg = "The file " + d.Path + " is older than " + strconv.Itoa(r.OlderThan) + " hours"
+		case ReasonPartial:
+			msg = "Partial rsync file " + d.Path + " is older than " + strconv.Itoa(PartialMaxAge) + " hours"
+		case ReasonMaxSize:
+			msg = "The file " + d.Path + " is the oldest one while " + p + " is larger than " + strconv.FormatInt(r.MaxSize, 10) + " bytes"
+		case ReasonMaxFiles:
+			msg = "The file " + d.Path + " is the oldest one while " + p + " has more than " + strconv.Itoa(r.MaxFiles) + " files"
+		case ReasonMinFree:
+			msg = "The file " + d.Path + " is the oldest one while less than " + strconv.Itoa(r.MinFreePercent) + "% of the disk of " + p + " is free"
+		}
+		if d.Archive != "" {
+			if dryRun {
+				logger.Info("Dry run: " + msg + " and would be archived to " + d.Archive)
+				deleted = append(deleted, d)
+				continue
+			}
+			logger.Info(msg + " and will be archived to " + d.Archive)
+			toArchive = append(toArchive, d)
+			continue
+		}
+		if dryRun {
+			logger.Info("Dry run: " + msg + " and would be deleted")
+			deleted = append(deleted, d)
+			continue
+		}
+		logger.Info(msg + " and will be deleted")
+		if errRemove := os.Remove(d.Path); errRemove != nil {
+			logger.Warn("Could not delete the file " + d.Path + ", the error: " + errRemove.Error())
+			continue
+		}
+		deleted = append(deleted, d)
+	}
+	if len(toArchive) > 0 {
+		deleted = append(deleted, r.Archive.archive(p, toArchive)...)
+	}
+
+	logger.Info("Stop deleting old files in " + p)
+
+	return deleted, err
+}
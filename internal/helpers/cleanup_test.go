@@ -0,0 +1,239 @@
+package helpers_test
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/helpers"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDeleteFilesDryRun(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	dir := t.TempDir()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"old.csv":            49 * time.Hour,
+		"new.csv":            time.Hour,
+		".stocks.csv.aw3dfq": 5 * time.Hour,
+		".prices.csv.3cav02": 2 * time.Hour,
+	} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte("a;1\n"), 0644)
+		os.Chtimes(p, now.Add(-age), now.Add(-age))
+	}
+
+	want := map[string]string{"old.csv": helpers.ReasonExpired, ".stocks.csv.aw3dfq": helpers.ReasonPartial}
+	got := func(deletions []helpers.Deletion) map[string]string {
+		reasons := make(map[string]string)
+		for _, d := range deletions {
+			reasons[filepath.Base(d.Path)] = d.Reason
+			if d.Size != 4 {
+				t.Errorf("want the size of %s, got: %d", d.Path, d.Size)
+			}
+		}
+		return reasons
+	}
+
+	deleted, err := helpers.DeleteFiles(dir, helpers.Retention{OlderThan: 48}, true)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if diff := cmp.Diff(want, got(deleted)); diff != "" {
+		t.Errorf("dry run mismatch (-want +got):\n%s", diff)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 4 {
+		t.Errorf("want nothing deleted by the dry run, got: %d files", len(entries))
+	}
+
+	deleted, err = helpers.DeleteFiles(dir, helpers.Retention{OlderThan: 48}, false)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if diff := cmp.Diff(want, got(deleted)); diff != "" {
+		t.Errorf("deleted mismatch (-want +got):\n%s", diff)
+	}
+	var left []string
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	sort.Strings(left)
+	if wantLeft := []string{".prices.csv.3cav02", "new.csv"}; !cmp.Equal(wantLeft, left) {
+		t.Errorf("want: %v, got: %v", wantLeft, left)
+	}
+}
+
+func TestPlanDeletionLimits(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	dir := t.TempDir()
+	now := time.Now()
+	// file1 is the oldest one, the staging files are never evicted
+	for i, name := range []string{"file1.csv", "file2.csv", "file3.csv", "file4.csv", ".pullcsv-staging/file0.csv"} {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, make([]byte, 100), 0644)
+		age := time.Duration(10-i)*time.Hour - 30*time.Minute
+		os.Chtimes(p, now.Add(-age), now.Add(-age))
+	}
+	// even the expired and partial files of a running job are kept
+	for _, name := range []string{".pullcsv-staging/stocks/expired.csv", ".pullcsv-unpack-1234/.prices.csv.3cav02"} {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, make([]byte, 100), 0644)
+		os.Chtimes(p, now.Add(-72*time.Hour), now.Add(-72*time.Hour))
+	}
+
+	type testCase struct {
+		retention helpers.Retention
+		want      map[string]string
+	}
+
+	testCases := []testCase{
+		{retention: helpers.Retention{OlderThan: 48}, want: map[string]string{}},
+		{retention: helpers.Retention{OlderThan: 48, MaxSize: 250}, want: map[string]string{"file1.csv": helpers.ReasonMaxSize, "file2.csv": helpers.ReasonMaxSize}},
+		{retention: helpers.Retention{OlderThan: 48, MaxFiles: 3}, want: map[string]string{"file1.csv": helpers.ReasonMaxFiles}},
+		{retention: helpers.Retention{OlderThan: 48, MaxSize: 350, MaxFiles: 2}, want: map[string]string{"file1.csv": helpers.ReasonMaxSize, "file2.csv": helpers.ReasonMaxFiles}},
+		{retention: helpers.Retention{OlderThan: 9}, want: map[string]string{"file1.csv": helpers.ReasonExpired}},
+		{retention: helpers.Retention{OlderThan: 9, MaxFiles: 2}, want: map[string]string{"file1.csv": helpers.ReasonExpired, "file2.csv": helpers.ReasonMaxFiles}},
+		// a disk can't be free for more than 100%, all the files are evicted
+		{retention: helpers.Retention{OlderThan: 48, MinFreePercent: 100}, want: map[string]string{"file1.csv": helpers.ReasonMinFree, "file2.csv": helpers.ReasonMinFree, "file3.csv": helpers.ReasonMinFree, "file4.csv": helpers.ReasonMinFree}},
+	}
+
+	for i, tc := range testCases {
+		planned, err := helpers.PlanDeletion(dir, tc.retention)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		got := make(map[string]string)
+		for _, d := range planned {
+			got[filepath.Base(d.Path)] = d.Reason
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Case %d: planned mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestDeleteFilesArchive(t *testing.T) {
+	t.Parallel()
+	provideFX()
+
+	type testCase struct {
+		compress bool
+		want     []string
+	}
+
+	now := time.Now()
+	old := now.Add(-49 * time.Hour)
+	day := old.Format(time.DateOnly)
+
+	testCases := []testCase{
+		{want: []string{day + "/a/old.csv", day + "/old.csv"}},
+		{compress: true, want: []string{day + ".tar.gz"}},
+	}
+
+	for i, tc := range testCases {
+		dir, archiveDir := t.TempDir(), t.TempDir()
+		for name, mtime := range map[string]time.Time{
+			"old.csv":                old,
+			"a/old.csv":              old,
+			"new.csv":                now,
+			".stocks.csv.aw3dfq":     now.Add(-5 * time.Hour),
+			".pullcsv-staging/x.csv": now,
+		} {
+			p := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(p), 0755)
+			os.WriteFile(p, []byte("a;1\n"), 0644)
+			os.Chtimes(p, mtime, mtime)
+		}
+
+		r := helpers.Retention{OlderThan: 48, Archive: &helpers.ArchiveArea{Dir: archiveDir, Compress: tc.compress}}
+		deleted, err := helpers.DeleteFiles(dir, r, false)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		archived := 0
+		for _, d := range deleted {
+			if d.Archive != "" {
+				archived++
+			}
+		}
+		// the partial file is deleted, not archived
+		if len(deleted) != 3 || archived != 2 {
+			t.Errorf("Case %d: want 2 archived and 1 deleted files, got: %+v", i, deleted)
+		}
+
+		var got []string
+		filepath.WalkDir(archiveDir, func(path string, di fs.DirEntry, err error) error {
+			if err == nil && !di.IsDir() {
+				rel, _ := filepath.Rel(archiveDir, path)
+				got = append(got, rel)
+				if info, _ := di.Info(); !info.ModTime().Equal(old) {
+					t.Errorf("Case %d: want the mtime %s of %s, got: %s", i, old, rel, info.ModTime())
+				}
+			}
+			return nil
+		})
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("Case %d, want: %v, got: %v", i, tc.want, got)
+		}
+		if helpers.Exists(filepath.Join(dir, "old.csv")) || !helpers.Exists(filepath.Join(dir, "new.csv")) {
+			t.Errorf("Case %d: want only the old files moved out of %s", i, dir)
+		}
+	}
+
+	// the files evicted for the free space are deleted, not archived,
+	// moving them into the archive area may free nothing
+	dir, archiveDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"first.csv", "second.csv"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+	}
+	r := helpers.Retention{OlderThan: 48, MinFreePercent: 100, Archive: &helpers.ArchiveArea{Dir: archiveDir}}
+	deleted, err := helpers.DeleteFiles(dir, r, false)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if len(deleted) != 2 || deleted[0].Reason != helpers.ReasonMinFree || deleted[0].Archive != "" || deleted[1].Archive != "" {
+		t.Errorf("want 2 files deleted for min_free, got: %+v", deleted)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("want the files deleted, got: %v", entries)
+	}
+	if entries, _ := os.ReadDir(archiveDir); len(entries) != 0 {
+		t.Errorf("want nothing archived, got: %v", entries)
+	}
+
+	// the next day's cleanup adds the files to the bundle
+	dir, archiveDir = t.TempDir(), t.TempDir()
+	r = helpers.Retention{OlderThan: 48, Archive: &helpers.ArchiveArea{Dir: archiveDir, Compress: true}}
+	for _, name := range []string{"first.csv", "second.csv"} {
+		p := filepath.Join(dir, name)
+		os.WriteFile(p, []byte(name), 0644)
+		os.Chtimes(p, old, old)
+		if _, err := helpers.DeleteFiles(dir, r, false); err != nil {
+			t.Fatalf("want nil, got error: %v", err)
+		}
+	}
+	files, err := helpers.ExtractArchive(context.Background(), filepath.Join(archiveDir, day+".tar.gz"), t.TempDir(), helpers.ArchiveOptions{Naming: helpers.NamingOriginal})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, filepath.Base(f))
+	}
+	sort.Strings(names)
+	if want := []string{"first.csv", "second.csv"}; !cmp.Equal(want, names) {
+		t.Errorf("want: %v, got: %v", want, names)
+	}
+}
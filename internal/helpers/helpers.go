@@ -1,28 +1,30 @@
 package helpers
 
 import (
-	"archive/zip"
-	"bufio"
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"pullcsv/internal/logger"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bitfield/script"
-	"github.com/h2non/filetype"
 )
 
+// StagingDir is the hidden dir in DOWNLOAD_TO where the files are
+// prepared before they are published to the indexer
+const StagingDir = ".pullcsv-staging"
+
+// QuarantineDir is the hidden dir in DOWNLOAD_TO where the invalid
+// files are kept by default, they are deleted by the retention
+const QuarantineDir = ".pullcsv-quarantine"
+
 // Exists returns whether a file or path exists
 func Exists(name string) bool {
 	_, err := os.Stat(name)
@@ -96,31 +98,6 @@ func IsOlderThan(t time.Time, olderThan int) bool {
 	return time.Now().Sub(t) > time.Duration(olderThan)*time.Hour
 }
 
-func EnvReplacement(s string) (result string) {
-	result = s
-	now := time.Now()
-	yesterdayNofmt := now.AddDate(0, 0, -1)
-	yyyy, mm, dd := now.Date()
-	timeBeforeTodayIsYesterday := time.Date(yyyy, mm, dd, 00, 11, 0, 0, now.Location())
-
-	if now.Compare(timeBeforeTodayIsYesterday) < 0 {
-		now = yesterdayNofmt
-	}
-
-	switch {
-	case strings.Contains(s, "_YESTERDAY_"):
-		result = strings.ReplaceAll(s, "_YESTERDAY_", yesterdayNofmt.Format("20060102"))
-	case strings.Contains(s, "_YES-TER-DAY_"):
-		result = strings.ReplaceAll(s, "_YES-TER-DAY_", yesterdayNofmt.Format("2006-01-02"))
-	case strings.Contains(s, "_TODAY_"):
-		result = strings.ReplaceAll(s, "_TODAY_", now.Format("20060102"))
-	case strings.Contains(s, "_TO-DAY_"):
-		result = strings.ReplaceAll(s, "_TO-DAY_", now.Format("2006-01-02"))
-	}
-
-	return result
-}
-
 func AddSeparator(s string) (sl []string, err error) {
 	for _, sr := range strings.Fields(s) {
 		sr, err := filepath.Abs(sr)
@@ -158,7 +135,8 @@ func PrepareEnv() (dFrom, dTo []string, standName, podName string, err error) {
 		}
 	}
 
-	var re = regexp.MustCompile(`^[0-9]+$`)
+	// DELETE_OLDER_THAN is either one value for all paths or one value per DOWNLOAD_FROM path
+	var re = regexp.MustCompile(`^\s*[0-9]+(\s+[0-9]+)*\s*$`)
 	if !re.MatchString(os.Getenv("DELETE_OLDER_THAN")) {
 		return nil, nil, "", "", errors.New("Env variable DELETE_OLDER_THAN must contain only digits!")
 	}
@@ -183,153 +161,29 @@ func PrepareEnv() (dFrom, dTo []string, standName, podName string, err error) {
 	return dFrom, dTo, standName, podName, nil
 }
 
-func UnzipSource(source, destination string) error {
-	reader, err := zip.OpenReader(source)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = errors.Join(err, reader.Close())
-	}()
-
-	destination, err = filepath.Abs(destination)
-	if err != nil {
-		return err
-	}
-
-	for _, f := range reader.File {
-		err := UnzipFile(f, destination)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func UnzipFile(f *zip.File, destination string) error {
-	//Check if file paths are not vulnerable to Zip Slip
-	filePath := filepath.Join(destination, f.Name)
-	if !strings.HasPrefix(filePath, filepath.Clean(destination)+string(os.PathSeparator)) {
-		return fmt.Errorf("invalid file path: %s", filePath)
-	}
-
-	if f.FileInfo().IsDir() {
-		if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
-			return err
-		}
-		return nil
-	}
-
-	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-		return err
-	}
-
-	destinationFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = errors.Join(err, destinationFile.Close())
-	}()
-
-	zippedFile, err := f.Open()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = errors.Join(err, zippedFile.Close())
-	}()
-
-	if _, err := io.Copy(destinationFile, zippedFile); err != nil {
-		return err
-	}
-	return nil
-}
-
-func UngzipFile(fileName, destination string) error {
-	reader, err := os.Open(fileName)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = errors.Join(err, reader.Close())
-	}()
-
-	archive, err := gzip.NewReader(reader)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = errors.Join(err, archive.Close())
-	}()
-
-	destination = filepath.Join(destination, archive.Name)
-	writer, err := os.Create(destination)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = errors.Join(err, writer.Close())
-	}()
-
-	_, err = io.Copy(writer, archive)
-	return err
-}
-
-func UnarchiveFile(fileName, destination string) error {
-	buf, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return err
-	}
-
-	kind, err := filetype.Match(buf)
-	if err != nil {
-		return err
-	}
-
-	if kind == filetype.Unknown {
-		return errors.New("Unknown file type " + fileName)
-	}
-
-	switch kind.MIME.Value {
-	case "application/zip":
-		if err := UnzipSource(fileName, destination); err != nil {
-			return err
-		}
-	case "application/gzip":
-		if err := UngzipFile(fileName, destination); err != nil {
-			return err
-		}
-	default:
-		return errors.New("application/type is not zip or gzip")
-	}
-
-	return nil
-}
-
 func GetRsyncExitCodeMeaning(code int) (meaning string) {
 	codeMeanings := map[int]string{
-		0:  "Success",
-		1:  "Syntax or usage error",
-		2:  "Protocol incompatibility",
-		3:  "Errors selecting input/output files, dirs",
-		4:  "Requested action not supported: an attempt was made to manipulate 64-bit files on a platform that cannot support them; or an option was specified that is supported by the client and not by the server.",
-		5:  "Error starting client-server protocol",
-		6:  "Daemon unable to append to log-file",
-		10: "Error in socket I/O (maybe there is a problem with DNS resolution)",
-		11: "Error in file I/O (maybe there is no destination)",
-		12: "Error in rsync protocol data stream",
-		13: "Errors with program diagnostics",
-		14: "Error in IPC code",
-		20: "Received SIGUSR1 or SIGINT",
-		21: "Some error returned by waitpid()",
-		22: "Error allocating core memory buffers",
-		23: "Partial transfer due to error (maybe there are not files on remote side by the mask)",
-		24: "Partial transfer due to vanished source files",
-		25: "The --max-delete limit stopped deletions",
-		30: "Timeout in data send/receive",
-		35: "Timeout waiting for daemon connection",
+		0:   "Success",
+		1:   "Syntax or usage error",
+		2:   "Protocol incompatibility",
+		3:   "Errors selecting input/output files, dirs",
+		4:   "Requested action not supported: an attempt was made to manipulate 64-bit files on a platform that cannot support them; or an option was specified that is supported by the client and not by the server.",
+		5:   "Error starting client-server protocol",
+		6:   "Daemon unable to append to log-file",
+		10:  "Error in socket I/O (maybe there is a problem with DNS resolution)",
+		11:  "Error in file I/O (maybe there is no destination)",
+		12:  "Error in rsync protocol data stream",
+		13:  "Errors with program diagnostics",
+		14:  "Error in IPC code",
+		20:  "Received SIGUSR1 or SIGINT",
+		21:  "Some error returned by waitpid()",
+		22:  "Error allocating core memory buffers",
+		23:  "Partial transfer due to error (maybe there are not files on remote side by the mask)",
+		24:  "Partial transfer due to vanished source files",
+		25:  "The --max-delete limit stopped deletions",
+		30:  "Timeout in data send/receive",
+		35:  "Timeout waiting for daemon connection",
+		124: "The run of the job timed out (options.timeout)",
 	}
 	if _, found := codeMeanings[code]; found {
 		return codeMeanings[code]
@@ -350,70 +204,12 @@ func GetUniqueSlice(s []string) []string {
 	return result
 }
 
-func SaveExcludeFile(pp, fileName string) (resultToFile []string, err error) {
-	f, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		err = errors.Join(err, f.Close())
-	}()
-
-	var fileExFN []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		fileExFN = append(fileExFN, scanner.Text())
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	var listingpp []string
-	err = filepath.Walk(pp, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			listingpp = append(listingpp, filepath.Base(path))
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	lenListingpp := len(listingpp)
-	lenFileExFN := len(fileExFN)
-
-	resultToFile = fileExFN
-	if lenListingpp > 0 && lenFileExFN > 0 {
-		for _, val1 := range listingpp {
-			found := false
-			for _, val2 := range fileExFN {
-				if filepath.Base(val1) == val2 {
-					found = true
-					break
-				}
-			}
-			if !found {
-				resultToFile = append(resultToFile, val1)
-			}
-		}
-	} else if lenListingpp > 0 && lenFileExFN == 0 {
-		resultToFile = listingpp
-	}
-
-	sort.Strings(resultToFile)
-	return resultToFile, err
-}
-
 func GetExludeFileName(dFromPath, dToPath string) (excludeFileName string, err error) {
 	var deploymentName, tmp1ExcludeFileName string
 	re := regexp.MustCompile(`(.+)-([a-z0-9]{8,10}-[a-z0-9]{5})`)
 	if deploymentNameSL := re.FindAllStringSubmatch(os.Getenv("POD_NAME"), -1); len(deploymentNameSL) != 0 {
 		deploymentName = deploymentNameSL[0][1]
-		re = regexp.MustCompile(`(rsync.+@.+)(\/[a-z].+/.+$)`)
+		re = regexp.MustCompile(`(rsync.+@.+|^(?:sftp|ftp|https?|s3|file)://.*|^/.*|^)(\/[a-z].+/.+$)`)
 		if tmp1ExcludeFileNameSL := re.FindAllStringSubmatch(dFromPath, -1); len(tmp1ExcludeFileNameSL) != 0 {
 			tmp1ExcludeFileName = tmp1ExcludeFileNameSL[0][2]
 
@@ -424,7 +220,7 @@ func GetExludeFileName(dFromPath, dToPath string) (excludeFileName string, err e
 			re = regexp.MustCompile(`\*`)
 			excludeFileName = deploymentName + re.ReplaceAllString(tmp2ExcludeFileName, "") + "-" + os.Getenv("STAND_NAME") + dToPathReplaced + "-excludeFile"
 		} else {
-			err = errors.New("Couldn't get full OS path on rsyncd server from DOWNLOAD_FROM env variable")
+			err = errors.New("Couldn't get full OS path on the source server from DOWNLOAD_FROM env variable")
 		}
 	} else {
 		err = errors.New("Couldn't get deployment name from env variable POD_NAME")
@@ -460,7 +256,10 @@ func GetFileSize(filename string) (fileSize int64, err error) {
 	return fileSize, err
 }
 
-func LogEveryFileAndMoveIt(dTo, p string) (err error) {
+// LogEveryFileAndMoveIt logs every file of p and moves it to dTo. If prepare
+// is not nil, it's called for the file first: note is added to the log line,
+// the file is skipped if deliver is false
+func LogEveryFileAndMoveIt(dTo, p string, prepare func(path string) (note string, deliver bool)) (err error) {
 	err = filepath.WalkDir(p, func(path string, di fs.DirEntry, err error) error {
 		diInfoGet, err := di.Info()
 		if err != nil {
@@ -469,6 +268,12 @@ func LogEveryFileAndMoveIt(dTo, p string) (err error) {
 		if !diInfoGet.IsDir() {
 			fName := diInfoGet.Name()
 			fFullName := p + string(filepath.Separator) + fName
+			note, deliver := "", true
+			if prepare != nil {
+				if note, deliver = prepare(fFullName); !deliver {
+					return nil
+				}
+			}
 			countLines, err := GetCountLines(fFullName)
 			if err != nil {
 				logger.Warn(err.Error())
@@ -477,7 +282,7 @@ func LogEveryFileAndMoveIt(dTo, p string) (err error) {
 			if err != nil {
 				logger.Warn(err.Error())
 			}
-			logger.Info("The file " + fName + " was downloaded, it has " + strconv.Itoa(countLines) + " lines, size is: " + strconv.FormatInt(fileSize, 10))
+			logger.Info("The file " + fName + " was downloaded" + note + ", it has " + strconv.Itoa(countLines) + " lines, size is: " + strconv.FormatInt(fileSize, 10))
 			err = Move(fFullName, dTo+fName)
 			if err != nil {
 				logger.Warn("Could not move the file " + path + ", the error: " + err.Error())
@@ -492,69 +297,52 @@ func LogEveryFileAndMoveIt(dTo, p string) (err error) {
 	return err
 }
 
-func DeleteFiles(p string) (err error) {
-	logger.Info("Start deleting old files in " + p)
-
-	err = filepath.WalkDir(p, func(path string, di fs.DirEntry, err error) error {
-		diInfoGet, err := di.Info()
-		if err != nil {
-			logger.Warn("Could not get info about " + path + ", the error: " + err.Error())
+// PublishFiles renames every file of the staging dir into dTo, so each of them
+// appears there at once. The dirs are merged into the ones in dTo file by file.
+// staging must be on the same filesystem as dTo. published are the paths of the files
+// relative to dTo, an empty <name>.<marker> file is created for each of them
+// if marker is not empty. The staging dir is removed only if all the files are published,
+// otherwise it's left with the rest of the files and the error is returned
+func PublishFiles(staging, dTo, marker string) (published []string, err error) {
+	errWalk := filepath.WalkDir(staging, func(p string, d fs.DirEntry, errWalk error) error {
+		if errWalk != nil || d.IsDir() {
+			return errWalk
 		}
-
-		partialFileNameRe := regexp.MustCompile(`\..*\.\w{6}`)
-		deleteOlderThan, err := strconv.Atoi(os.Getenv("DELETE_OLDER_THAN"))
-		if err != nil {
-			logger.Warn("Could not convert env variable DELETE_OLDER_THAN to integer. Skip deleting files..." + err.Error())
-			return err
+		rel, errRel := filepath.Rel(staging, p)
+		if errRel != nil {
+			return errRel
 		}
-		if IsOlderThan(diInfoGet.ModTime(), deleteOlderThan) && !diInfoGet.IsDir() {
-			logger.Info("The file " + path + " is older than 48 hours and will be deleted")
-			err := os.Remove(path)
-			if err != nil {
-				logger.Warn("Could not delete the file " + path + ", the error: " + err.Error())
-			}
-		} else if IsOlderThan(diInfoGet.ModTime(), 4) && partialFileNameRe.MatchString(diInfoGet.Name()) && !diInfoGet.IsDir() {
-			logger.Info("Partial rsync file " + path + " older than 4 hours and will be deleted")
-			err := os.Remove(path)
-			if err != nil {
-				logger.Warn("Could not delete partial rsync file " + path + ", the error: " + err.Error())
-			}
+		target := filepath.Join(dTo, rel)
+		errRename := os.MkdirAll(filepath.Dir(target), os.ModePerm)
+		if errRename == nil {
+			errRename = os.Rename(p, target)
+		}
+		if errRename != nil {
+			err = errors.Join(err, errors.New("Could not publish "+rel+", the error: "+errRename.Error()))
+			return nil
 		}
+		published = append(published, rel)
 		return nil
 	})
+	if errWalk != nil {
+		err = errors.Join(err, errors.New("Could not read staging dir "+staging+", the error: "+errWalk.Error()))
+	}
 
-	logger.Info("Stop deleting old files in " + p)
-
-	return err
-}
-
-func Rsync(cmd string) (exitCode int) {
-	pipeExec := script.Exec(cmd)
-	pipeExec.Wait()
-	exitCode = pipeExec.ExitStatus()
-
-	return exitCode
-}
-
-func WorkWithArchives(p string) (wwaerr error) {
-	logger.Info("Start unarchiving files in " + p)
-	fArchives, _ := script.ListFiles(p).Slice()
-	re := regexp.MustCompile("(.*zip|.*gz|.*gzip)")
-	for _, fArhive := range fArchives {
-		if re.MatchString(fArhive) {
-			logger.Info("Unarchive the file " + fArhive)
-			if err := UnarchiveFile(fArhive, p); err == nil {
-				logger.Info("Remove the file " + fArhive)
-				os.Remove(fArhive)
-			} else {
-				wwaerr = errors.New("Something was wrong with unarchive the file " + fArhive + ", the error: " + err.Error())
+	if marker != "" {
+		for _, name := range published {
+			f, errCreate := os.Create(filepath.Join(dTo, name+"."+marker))
+			if errCreate != nil {
+				err = errors.Join(err, errors.New("Could not create marker for "+name+", the error: "+errCreate.Error()))
+				continue
 			}
-
+			f.Close()
 		}
 	}
-	logger.Info("Stop unarchiving files in " + p)
 
-	return wwaerr
+	if err != nil {
+		return published, err
+	}
+	return published, os.RemoveAll(staging)
 }
 
 func TruncateExcludeFile(fileName string, i, truncateLines int, fileSize int64) (err error) {
@@ -598,6 +386,9 @@ func GetOldestNewestCountFiles(path string) (newestFileTimestamp, oldestFileTime
 	}
 
 	for _, file := range files {
+		if file.Name() == StagingDir || file.Name() == QuarantineDir {
+			continue
+		}
 		fInfo, _ := file.Info()
 		currentFileTimestamp := fInfo.ModTime().Unix()
 		if !fInfo.IsDir() && currentFileTimestamp < oldestFileTimestamp {
@@ -2,6 +2,7 @@ package helpers_test
 
 import (
 	"archive/zip"
+	"context"
 	"fmt"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -101,47 +102,6 @@ func TestUngzipFile(t *testing.T) {
 	}
 }
 
-func TestEnvReplacement(t *testing.T) {
-	t.Parallel()
-
-	now := time.Now()
-	yesterdayNofmt := now.AddDate(0, 0, -1)
-	todayWith := now.Format("2006-01-02")
-	todayWithout := now.Format("20060102")
-	yesterdayWith := yesterdayNofmt.Format("2006-01-02")
-	yesterdayWithout := yesterdayNofmt.Format("20060102")
-
-	type testCase struct {
-		dFromSource, dFromResult string
-	}
-
-	testCases := []testCase{
-		{
-			dFromSource: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*_TODAY_*",
-			dFromResult: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*" + todayWithout + "*",
-		},
-		{
-			dFromSource: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*_YESTERDAY_*",
-			dFromResult: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*" + yesterdayWithout + "*",
-		},
-		{
-			dFromSource: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*_TO-DAY_*",
-			dFromResult: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*" + todayWith + "*",
-		},
-		{
-			dFromSource: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*_YES-TER-DAY_*",
-			dFromResult: "rsync://USERNAME@server-name/pullcsv/shops_stocks_rf/FULLSTOCK*" + yesterdayWith + "*",
-		},
-	}
-
-	for _, tc := range testCases {
-		got := helpers.EnvReplacement(tc.dFromSource)
-		if tc.dFromResult != got {
-			t.Errorf("Expected: %s, got: %s", tc.dFromResult, got)
-		}
-	}
-}
-
 func TestGetRsyncExitCodeMeaning(t *testing.T) {
 	t.Parallel()
 
@@ -183,73 +143,6 @@ func TestGetRsyncExitCodeMeaning(t *testing.T) {
 	}
 }
 
-func TestSaveExcludeFileInvalid(t *testing.T) {
-	t.Parallel()
-
-	type testCase struct {
-		want            []string
-		fileSlice, exFN string
-	}
-
-	testCases := []testCase{
-		{fileSlice: "../../forTests/SaveExcludeFile/case0/", exFN: "../doesntexist"},
-		{fileSlice: "doesntexist", exFN: "../doesntexist"},
-		{fileSlice: "doesntexist", exFN: "../../forTests/SaveExcludeFile/exFNcase1"},
-	}
-
-	var i int
-	for _, tc := range testCases {
-		_, err := helpers.SaveExcludeFile(tc.fileSlice, tc.exFN)
-		if err == nil {
-			t.Error("want error for invalid input, got nil")
-		}
-		i++
-	}
-}
-
-func TestSaveExcludeFile(t *testing.T) {
-	t.Parallel()
-
-	os.Mkdir("../../forTests/SaveExcludeFile/case1/", 0755)
-	os.Mkdir("../../forTests/SaveExcludeFile/case2/", 0755)
-
-	type testCase struct {
-		want            []string
-		fileSlice, exFN string
-	}
-
-	wantCase0 := []string{"f1", "f2", "f3"}
-	wantCase1 := []string{"first", "second", "third", "something"}
-	wantCase2 := []string{}
-	wantCase3 := []string{"f1", "f2", "f3", "first", "second", "third", "something"}
-	wantCase4 := []string{"case4-f1"}
-
-	sort.Strings(wantCase0)
-	sort.Strings(wantCase1)
-	sort.Strings(wantCase3)
-
-	testCases := []testCase{
-		{fileSlice: "../../forTests/SaveExcludeFile/case0/", exFN: "../../forTests/SaveExcludeFile/exFNcase0", want: wantCase0},
-		{fileSlice: "../../forTests/SaveExcludeFile/case1/", exFN: "../../forTests/SaveExcludeFile/exFNcase1", want: wantCase1},
-		{fileSlice: "../../forTests/SaveExcludeFile/case2/", exFN: "../../forTests/SaveExcludeFile/exFNcase2", want: wantCase2},
-		{fileSlice: "../../forTests/SaveExcludeFile/case3/", exFN: "../../forTests/SaveExcludeFile/exFNcase3", want: wantCase3},
-		{fileSlice: "../../forTests/SaveExcludeFile/case4/", exFN: "../../forTests/SaveExcludeFile/exFNcase4", want: wantCase4},
-	}
-
-	var i int
-	for _, tc := range testCases {
-		got, _ := helpers.SaveExcludeFile(tc.fileSlice, tc.exFN)
-		if !stringSlicesEqual(tc.want, got) {
-			t.Errorf("Case %d, Want: %s, got: %s", i, tc.want, got)
-		}
-		i++
-	}
-
-	os.Remove("../../forTests/SaveExcludeFile/case1")
-	os.Remove("../../forTests/SaveExcludeFile/case2")
-
-}
-
 func TestGetExludeFileNameWrongENV(t *testing.T) {
 	os.Setenv("STAND_NAME", "dev25")
 
@@ -335,7 +228,7 @@ func TestLogEveryFileAndMoveIt(t *testing.T) {
 	os.Create("/tmp/LogEveryFileAndMoveIt/random123/file2")
 	os.Create("/tmp/LogEveryFileAndMoveIt/random123/file3")
 
-	helpers.LogEveryFileAndMoveIt("/tmp/LogEveryFileAndMoveIt/", "/tmp/LogEveryFileAndMoveIt/random123/")
+	helpers.LogEveryFileAndMoveIt("/tmp/LogEveryFileAndMoveIt/", "/tmp/LogEveryFileAndMoveIt/random123/", nil)
 
 	sl := []string{
 		"/tmp/LogEveryFileAndMoveIt/file1",
@@ -372,7 +265,7 @@ func TestDeleteFilesOlderThan(t *testing.T) {
 	emptySl := []string{
 		"",
 	}
-	helpers.DeleteFiles("/tmp/TestDeleteFilesOlderThan/")
+	helpers.DeleteFiles("/tmp/TestDeleteFilesOlderThan/", helpers.Retention{OlderThan: 48}, false)
 	filesIndDir, _ := script.ListFiles("/tmp/TestDeleteFilesOlderThan/").Slice()
 	if !cmp.Equal(emptySl, filesIndDir) {
 		t.Error("sl and filesIndDir aren'r equal")
@@ -399,7 +292,7 @@ func TestDeleteFilesPartialRsync(t *testing.T) {
 	emptySl := []string{
 		"",
 	}
-	helpers.DeleteFiles("/tmp/TestDeleteFilesPartialRsync/")
+	helpers.DeleteFiles("/tmp/TestDeleteFilesPartialRsync/", helpers.Retention{OlderThan: 48}, false)
 	filesIndDir, _ := script.ListFiles("/tmp/TestDeleteFilesPartialRsync/").Slice()
 	if !cmp.Equal(emptySl, filesIndDir) {
 		t.Error("emptySl and filesIndDir aren'r equal")
@@ -407,41 +300,107 @@ func TestDeleteFilesPartialRsync(t *testing.T) {
 	os.RemoveAll("/tmp/TestDeleteFilesPartialRsync")
 }
 
-func TestRsync(t *testing.T) {
+func TestWorkWithArchivesInvalid(t *testing.T) {
 	t.Parallel()
 	provideFX()
 
+	// 123.zip is a text file, the archives are detected by the content
+	if _, _, _, err := helpers.WorkWithArchives(context.Background(), "../../forTests/WorkWithArchivesInvalid/", nil, helpers.ArchiveOptions{}); err != nil {
+		t.Errorf("want nil for not an archive, got error: %v", err)
+	}
+	if !helpers.Exists("../../forTests/WorkWithArchivesInvalid/123.zip") {
+		t.Error("want not an archive to be left as is")
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "broken.csv"), []byte("PK\x03\x04broken"), 0644)
+	if _, _, _, err := helpers.WorkWithArchives(context.Background(), dir, nil, helpers.ArchiveOptions{}); err == nil {
+		t.Error("want error for broken archive, got nil")
+	}
+}
+
+func TestPublishFiles(t *testing.T) {
+	t.Parallel()
+
 	type testCase struct {
-		want     int
-		from, to string
+		marker string
+		want   []string
 	}
 
 	testCases := []testCase{
-		{want: 0, from: "/tmp/TestRsync/From/file1", to: "/tmp/TestRsync/To/"},
-		{want: 23, from: "/blablabla", to: "/proc/"},
+		// the staging dir of other jobs is kept
+		{marker: "", want: []string{helpers.StagingDir, "a.csv", "b.csv", "old.csv", "unzipped"}},
+		{marker: "done", want: []string{helpers.StagingDir, "a.csv", "a.csv.done", "b.csv", "b.csv.done", "old.csv", "unzipped"}},
+		{marker: "ok", want: []string{helpers.StagingDir, "a.csv", "a.csv.ok", "b.csv", "b.csv.ok", "old.csv", "unzipped"}},
 	}
 
-	os.Mkdir("/tmp/TestRsync", 0755)
-	os.Mkdir("/tmp/TestRsync/From", 0755)
-	os.Mkdir("/tmp/TestRsync/To", 0755)
-	os.Create("/tmp/TestRsync/From/file1")
-
 	for _, tc := range testCases {
-		if got := helpers.Rsync("/usr/bin/rsync " + tc.from + " " + tc.to); got != tc.want {
-			t.Errorf("Expected: %v, got: %v", tc.want, got)
+		dTo := t.TempDir()
+		staging := filepath.Join(dTo, helpers.StagingDir, "job")
+		os.MkdirAll(filepath.Join(staging, "unzipped"), 0755)
+		os.WriteFile(filepath.Join(staging, "a.csv"), []byte("a"), 0644)
+		os.WriteFile(filepath.Join(staging, "b.csv"), []byte("b"), 0644)
+		os.WriteFile(filepath.Join(staging, "unzipped", "c.csv"), []byte("c"), 0644)
+		os.WriteFile(filepath.Join(dTo, "b.csv"), []byte("old b"), 0644)
+		os.WriteFile(filepath.Join(dTo, "old.csv"), []byte("old"), 0644)
+		// the dir published by the previous run
+		os.MkdirAll(filepath.Join(dTo, "unzipped"), 0755)
+		os.WriteFile(filepath.Join(dTo, "unzipped", "old.csv"), []byte("old"), 0644)
+
+		published, err := helpers.PublishFiles(staging, dTo, tc.marker)
+		if err != nil {
+			t.Fatalf("%q: want nil, got error: %v", tc.marker, err)
+		}
+		if want := []string{"a.csv", "b.csv", filepath.Join("unzipped", "c.csv")}; !cmp.Equal(want, published) {
+			t.Errorf("%q: want published: %v, got: %v", tc.marker, want, published)
 		}
-	}
-
-	os.RemoveAll("/tmp/TestRsync")
-}
 
-func TestWorkWithArchivesInvalid(t *testing.T) {
-	t.Parallel()
-	provideFX()
+		got, _ := script.ListFiles(dTo).Slice()
+		for i := range got {
+			got[i] = filepath.Base(got[i])
+		}
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("%q: want: %v, got: %v", tc.marker, tc.want, got)
+		}
+		wantUnzipped := []string{"c.csv", "old.csv"}
+		if tc.marker != "" {
+			wantUnzipped = []string{"c.csv", "c.csv." + tc.marker, "old.csv"}
+		}
+		got, _ = script.ListFiles(filepath.Join(dTo, "unzipped")).Slice()
+		for i := range got {
+			got[i] = filepath.Base(got[i])
+		}
+		if !cmp.Equal(wantUnzipped, got) {
+			t.Errorf("%q: want merged dir: %v, got: %v", tc.marker, wantUnzipped, got)
+		}
+		if content, _ := os.ReadFile(filepath.Join(dTo, "b.csv")); string(content) != "b" {
+			t.Errorf("%q: want the new b.csv, got: %s", tc.marker, content)
+		}
+		if helpers.Exists(staging) {
+			t.Errorf("%q: want staging dir to be removed", tc.marker)
+		}
+	}
 
-	err := helpers.WorkWithArchives("../../forTests/WorkWithArchivesInvalid/")
+	// a.csv can't replace the dir, the staging dir is kept with it
+	dTo := t.TempDir()
+	staging := filepath.Join(dTo, helpers.StagingDir, "job")
+	os.MkdirAll(staging, 0755)
+	os.WriteFile(filepath.Join(staging, "a.csv"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(staging, "b.csv"), []byte("b"), 0644)
+	os.MkdirAll(filepath.Join(dTo, "a.csv", "dir"), 0755)
+	published, err := helpers.PublishFiles(staging, dTo, "")
 	if err == nil {
-		t.Error("want error for invalid input, got nil")
+		t.Error("want error for the failed rename, got nil")
+	}
+	if want := []string{"b.csv"}; !cmp.Equal(want, published) {
+		t.Errorf("want published: %v, got: %v", want, published)
+	}
+	if !helpers.Exists(filepath.Join(staging, "a.csv")) {
+		t.Error("want the unpublished file to be left in staging dir")
+	}
+
+	if _, err := helpers.PublishFiles("/tmp/doesntexist", t.TempDir(), ""); err == nil {
+		t.Error("want error for missing staging dir, got nil")
 	}
 }
 
@@ -457,17 +416,9 @@ func TestTruncateExcludeFileInvalid(t *testing.T) {
 func TestTruncateExcludeFile(t *testing.T) {
 	t.Parallel()
 
-	src := "../../forTests/SaveExcludeFile/exFNcase3"
-	dest := "../../forTests/TestTruncateExcludeFile"
-
-	bytesRead, err := ioutil.ReadFile(src)
-
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = ioutil.WriteFile(dest, bytesRead, 0644)
+	dest := filepath.Join(t.TempDir(), "TestTruncateExcludeFile")
 
+	err := ioutil.WriteFile(dest, []byte("first\nsecond\nthird\nsomething\n"), 0644)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -477,18 +428,16 @@ func TestTruncateExcludeFile(t *testing.T) {
 		"something",
 	}
 
-	err = helpers.TruncateExcludeFile("../../forTests/TestTruncateExcludeFile", 1, 2, 20)
+	err = helpers.TruncateExcludeFile(dest, 1, 2, 20)
 	if err != nil {
 		t.Errorf("want nil, got error: %v\n", err)
 	}
 
-	linesInFile, _ := script.File("../../forTests/TestTruncateExcludeFile").Slice()
+	linesInFile, _ := script.File(dest).Slice()
 
 	if !cmp.Equal(sl, linesInFile) {
 		t.Errorf("sl and linesInFile aren't equal")
 	}
-
-	os.Remove("../../forTests/TestTruncateExcludeFile")
 }
 
 func TestAddSeparator(t *testing.T) {
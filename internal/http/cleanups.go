@@ -0,0 +1,48 @@
+package http
+
+import (
+	"net/http"
+	"pullcsv/internal/config"
+	"pullcsv/internal/helpers"
+)
+
+// cleanupPreview is a scheduled cleanup with the files it would delete now
+type cleanupPreview struct {
+	Destination    string             `json:"destination"`
+	Cron           string             `json:"cron"`
+	OlderThan      int                `json:"older_than"`
+	MaxSize        int64              `json:"max_size,omitempty"`
+	MaxFiles       int                `json:"max_files,omitempty"`
+	MinFreePercent int                `json:"min_free_percent,omitempty"`
+	Archive        *config.Archive    `json:"archive,omitempty"`
+	Jobs           []string           `json:"jobs"`
+	DryRun         bool               `json:"dry_run"`
+	Files          []helpers.Deletion `json:"files"`
+	Bytes          int64              `json:"bytes"`
+	Error          string             `json:"error,omitempty"`
+}
+
+// handleCleanups adds GET /cleanups to mux, it lists what every cleanup
+// would delete if it ran now, nothing is deleted
+func handleCleanups(mux *http.ServeMux, cfg *config.Config) {
+	mux.HandleFunc("GET /cleanups", func(w http.ResponseWriter, r *http.Request) {
+		previews := []cleanupPreview{}
+		for _, c := range cfg.Cleanups() {
+			preview := cleanupPreview{
+				Destination: c.Destination, Cron: c.Cron, OlderThan: c.OlderThan,
+				MaxSize: c.MaxSize, MaxFiles: c.MaxFiles, MinFreePercent: c.MinFreePercent,
+				Archive: c.Archive, Jobs: c.Jobs, DryRun: c.DryRun, Files: []helpers.Deletion{},
+			}
+			planned, err := helpers.PlanDeletion(c.Destination, c.Policy())
+			if err != nil {
+				preview.Error = err.Error()
+			}
+			for _, d := range planned {
+				preview.Files = append(preview.Files, d)
+				preview.Bytes += d.Size
+			}
+			previews = append(previews, preview)
+		}
+		writeJSON(w, http.StatusOK, previews)
+	})
+}
@@ -6,11 +6,16 @@ import (
 	"go.uber.org/zap"
 	"net"
 	"net/http"
+	"pullcsv/internal/config"
+	"pullcsv/internal/control"
 )
 
-func pullcsvServeMux(metricsHandler http.Handler) *http.ServeMux {
+func pullcsvServeMux(metricsHandler http.Handler, ctl *control.Control, cfg *config.Config) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", metricsHandler)
+	handleJobs(mux, ctl)
+	handleProbes(mux, ctl)
+	handleCleanups(mux, cfg)
 
 	return mux
 }
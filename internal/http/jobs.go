@@ -0,0 +1,60 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"pullcsv/internal/control"
+)
+
+// handleJobs adds the control API of the jobs to mux:
+// GET /jobs, GET /jobs/{name}, POST /jobs/{name}/run, /pause and /resume
+func handleJobs(mux *http.ServeMux, ctl *control.Control) {
+	mux.HandleFunc("GET /jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ctl.Jobs())
+	})
+	mux.HandleFunc("GET /jobs/{name}", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, ctl, r.PathValue("name"), http.StatusOK, nil)
+	})
+	mux.HandleFunc("POST /jobs/{name}/run", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		writeStatus(w, ctl, name, http.StatusAccepted, ctl.Run(name))
+	})
+	mux.HandleFunc("POST /jobs/{name}/pause", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		writeStatus(w, ctl, name, http.StatusOK, ctl.Pause(name))
+	})
+	mux.HandleFunc("POST /jobs/{name}/resume", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		writeStatus(w, ctl, name, http.StatusOK, ctl.Resume(name))
+	})
+}
+
+// writeStatus writes the job's status with code or the error of the action
+func writeStatus(w http.ResponseWriter, ctl *control.Control, name string, code int, err error) {
+	if err == nil {
+		var status control.Status
+		if status, err = ctl.Job(name); err == nil {
+			writeJSON(w, code, status)
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, control.ErrUnknownJob):
+		code = http.StatusNotFound
+	case errors.Is(err, control.ErrRunning):
+		code = http.StatusConflict
+	case errors.Is(err, control.ErrStopped):
+		code = http.StatusServiceUnavailable
+	default:
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
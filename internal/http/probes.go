@@ -0,0 +1,47 @@
+package http
+
+import (
+	"net/http"
+	"pullcsv/internal/control"
+	"time"
+)
+
+// liveness is the body of /healthz
+type liveness struct {
+	Alive bool   `json:"alive"`
+	Error string `json:"error,omitempty"`
+}
+
+// readiness is the body of /readyz
+type readiness struct {
+	Ready bool                `json:"ready"`
+	Jobs  []control.Readiness `json:"jobs"`
+}
+
+// handleProbes adds the Kubernetes probes to mux: /healthz is OK while the
+// process and the scheduler are alive, /readyz while every job can write
+// its destination and has a fresh successful run. The config isn't checked,
+// it's validated at the start and never changes
+func handleProbes(mux *http.ServeMux, ctl *control.Control) {
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := ctl.Alive(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, liveness{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, liveness{Alive: true})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		body := readiness{Ready: true, Jobs: ctl.Ready(time.Now().UTC())}
+		for _, job := range body.Jobs {
+			body.Ready = body.Ready && job.Ready
+		}
+		if len(body.Jobs) == 0 {
+			body.Ready = false
+		}
+		code := http.StatusOK
+		if !body.Ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, body)
+	})
+}
@@ -0,0 +1,297 @@
+// Package ledger keeps the list of the files every job has already
+// downloaded in the local bbolt database, so the state doesn't depend
+// on the remote exclude file and is never truncated
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/fx"
+)
+
+// Entry is a downloaded file. Size is -1 and ModTime is zero
+// if they are unknown, e.g. the entry is imported from the exclude file
+type Entry struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+	Checksum     string    `json:"checksum,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+// Ledger is the bbolt database with a bucket per job,
+// the entries are stored as JSON under the file names.
+// The checksums bucket of the job maps SHA-256 to the first
+// file name with that content
+type Ledger struct {
+	db *bolt.DB
+}
+
+// Decision is what is done with a fetched file
+type Decision string
+
+const (
+	// New is a file the job has never seen, it's delivered
+	New Decision = "new"
+	// Changed is a known file with changed size, mtime or hash, it's delivered again
+	Changed Decision = "changed"
+	// Unchanged is a known file with changed size or mtime but the same hash, it's skipped
+	Unchanged Decision = "unchanged"
+	// Duplicate has the same content as another file of the job, it's skipped
+	Duplicate Decision = "duplicate"
+)
+
+func checksumsBucket(job string) []byte {
+	return []byte(job + "\x00sha256")
+}
+
+// stateBucket of the job keeps the last day the job completed
+func stateBucket(job string) []byte {
+	return []byte(job + "\x00state")
+}
+
+var lastDayKey = []byte("last_day")
+
+// Open opens the ledger at path, creating it if needed. It fails
+// if the file is locked by another process for more than a second
+func Open(path string) (*Ledger, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.New("Could not create the dir for ledger " + path + ", the error: " + err.Error())
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.New("Could not open ledger " + path + ", the error: " + err.Error())
+	}
+	return &Ledger{db: db}, nil
+}
+
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// Downloaded reports whether the job has already downloaded the file: there
+// is an entry with the same name, size and mtime. The file is matched
+// by name only if byName is set or either of them doesn't know the size or mtime
+func (l *Ledger) Downloaded(job string, e Entry, byName bool) (downloaded bool, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(job))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(e.Name))
+		if data == nil {
+			return nil
+		}
+		var got Entry
+		if err := json.Unmarshal(data, &got); err != nil {
+			return err
+		}
+		downloaded = byName || (got.Size < 0 || e.Size < 0 || got.Size == e.Size) &&
+			(got.ModTime.IsZero() || e.ModTime.IsZero() || got.ModTime.Equal(e.ModTime))
+		return nil
+	})
+	if err != nil {
+		return false, errors.New("Could not read ledger of " + job + ", the error: " + err.Error())
+	}
+	return downloaded, nil
+}
+
+// Decide compares the fetched file with the ledger: a file with a known name
+// is Unchanged if the hash is the same and Changed otherwise. If byContent is set,
+// a file with the same hash as another file of the job is a Duplicate, other is
+// the name of that file. The ledger is not modified, see Add
+func (l *Ledger) Decide(job string, e Entry, byContent bool) (d Decision, other string, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		d = New
+		if b := tx.Bucket([]byte(job)); b != nil {
+			if data := b.Get([]byte(e.Name)); data != nil {
+				var got Entry
+				if err := json.Unmarshal(data, &got); err != nil {
+					return err
+				}
+				d = Changed
+				if got.Checksum != "" && got.Checksum == e.Checksum {
+					d = Unchanged
+					return nil
+				}
+			}
+		}
+		if !byContent || e.Checksum == "" {
+			return nil
+		}
+		if b := tx.Bucket(checksumsBucket(job)); b != nil {
+			if name := b.Get([]byte(e.Checksum)); name != nil && string(name) != e.Name {
+				d, other = Duplicate, string(name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", errors.New("Could not read ledger of " + job + ", the error: " + err.Error())
+	}
+	return d, other, nil
+}
+
+// Add stores the entries of the job, replacing the old entries with the same names
+func (l *Ledger) Add(job string, entries ...Entry) error {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(job))
+		if err != nil {
+			return err
+		}
+		checksums, err := tx.CreateBucketIfNotExists(checksumsBucket(job))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Checksum != "" && checksums.Get([]byte(e.Checksum)) == nil {
+				if err := checksums.Put([]byte(e.Checksum), []byte(e.Name)); err != nil {
+					return err
+				}
+			}
+			if e.DownloadedAt.IsZero() {
+				e.DownloadedAt = time.Now().UTC()
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(e.Name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.New("Could not write ledger of " + job + ", the error: " + err.Error())
+	}
+	return nil
+}
+
+// Import adds the file names from the exclude file which the job doesn't know
+// yet, with the unknown size and mtime. It returns how many names were added
+func (l *Ledger) Import(job string, names []string) (added int, err error) {
+	err = l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(job))
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, name := range names {
+			if name == "" || b.Get([]byte(name)) != nil {
+				continue
+			}
+			data, err := json.Marshal(Entry{Name: name, Size: -1, DownloadedAt: now})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(name), data); err != nil {
+				return err
+			}
+			added++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.New("Could not import exclude file into ledger of " + job + ", the error: " + err.Error())
+	}
+	return added, nil
+}
+
+// Entries returns the entries of the job ordered by the download time
+func (l *Ledger) Entries(job string) (entries []Entry, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(job))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errors.New("Could not read ledger of " + job + ", the error: " + err.Error())
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].DownloadedAt.Before(entries[j].DownloadedAt)
+	})
+	return entries, nil
+}
+
+// LastDay returns the last day (2006-01-02) the job pulled the files of, "" if none
+func (l *Ledger) LastDay(job string) (day string, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(stateBucket(job)); b != nil {
+			day = string(b.Get(lastDayKey))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.New("Could not read the last day of " + job + " from ledger, the error: " + err.Error())
+	}
+	return day, nil
+}
+
+// SetLastDay remembers the last day (2006-01-02) the job pulled the files of
+func (l *Ledger) SetLastDay(job, day string) error {
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket(job))
+		if err != nil {
+			return err
+		}
+		return b.Put(lastDayKey, []byte(day))
+	})
+	if err != nil {
+		return errors.New("Could not save the last day of " + job + " into ledger, the error: " + err.Error())
+	}
+	return nil
+}
+
+// Checksum returns the hex SHA-256 of the file
+func Checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WithLedgerFx provides *Ledger opened at the config's ledger path and closes it on stop
+func WithLedgerFx() fx.Option {
+	return fx.Options(
+		fx.Provide(func(lc fx.Lifecycle, cfg *config.Config) (*Ledger, error) {
+			l, err := Open(cfg.Ledger)
+			if err != nil {
+				return nil, err
+			}
+			lc.Append(fx.Hook{
+				OnStop: func(ctx context.Context) error {
+					return l.Close()
+				},
+			})
+			return l, nil
+		}),
+	)
+}
@@ -0,0 +1,211 @@
+package ledger_test
+
+import (
+	"os"
+	"path/filepath"
+	"pullcsv/internal/ledger"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var mtime = time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)
+
+func openLedger(t *testing.T) *ledger.Ledger {
+	t.Helper()
+
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "state", "ledger.db"))
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestDownloaded(t *testing.T) {
+	t.Parallel()
+	l := openLedger(t)
+
+	if err := l.Add("stocks", ledger.Entry{Name: "stocks_20240224.csv", Size: 10, ModTime: mtime, Checksum: "abc"}); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if _, err := l.Import("stocks", []string{"stocks_20240223.csv", "stocks_20240224.csv", ""}); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+
+	type testCase struct {
+		job    string
+		entry  ledger.Entry
+		byName bool
+		want   bool
+	}
+
+	testCases := []testCase{
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: 10, ModTime: mtime}, want: true},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: 10, ModTime: mtime.In(time.Local)}, want: true},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: -1}, want: true},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: 11, ModTime: mtime}, want: false},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: 10, ModTime: mtime.Add(time.Second)}, want: false},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: 11, ModTime: mtime.Add(time.Second)}, byName: true, want: true},
+		// imported from the exclude file, matched by name
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240223.csv", Size: 10, ModTime: mtime}, want: true},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240225.csv", Size: 10, ModTime: mtime}, want: false},
+		{job: "stocks", entry: ledger.Entry{Name: "stocks_20240225.csv", Size: 10, ModTime: mtime}, byName: true, want: false},
+		{job: "prices", entry: ledger.Entry{Name: "stocks_20240224.csv", Size: 10, ModTime: mtime}, want: false},
+	}
+
+	for i, tc := range testCases {
+		got, err := l.Downloaded(tc.job, tc.entry, tc.byName)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if got != tc.want {
+			t.Errorf("Case %d, want: %v, got: %v", i, tc.want, got)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	t.Parallel()
+	l := openLedger(t)
+
+	l.Add("stocks", ledger.Entry{Name: "a.csv", Size: 4, ModTime: mtime, Checksum: "aaa"})
+	l.Add("stocks", ledger.Entry{Name: "b.csv", Size: 4, ModTime: mtime, Checksum: "bbb"})
+	l.Import("stocks", []string{"c.csv"})
+
+	type testCase struct {
+		job       string
+		entry     ledger.Entry
+		byContent bool
+		want      ledger.Decision
+		wantOther string
+	}
+
+	testCases := []testCase{
+		{job: "stocks", entry: ledger.Entry{Name: "d.csv", Checksum: "ddd"}, byContent: true, want: ledger.New},
+		{job: "stocks", entry: ledger.Entry{Name: "a.csv", Size: 5, Checksum: "aaa"}, byContent: true, want: ledger.Unchanged},
+		{job: "stocks", entry: ledger.Entry{Name: "a.csv", Size: 5, Checksum: "abc"}, want: ledger.Changed},
+		// the imported entries have no checksum
+		{job: "stocks", entry: ledger.Entry{Name: "c.csv", Checksum: "ccc"}, byContent: true, want: ledger.Changed},
+		{job: "stocks", entry: ledger.Entry{Name: "d.csv", Checksum: "aaa"}, byContent: true, want: ledger.Duplicate, wantOther: "a.csv"},
+		{job: "stocks", entry: ledger.Entry{Name: "a.csv", Checksum: "bbb"}, byContent: true, want: ledger.Duplicate, wantOther: "b.csv"},
+		{job: "stocks", entry: ledger.Entry{Name: "d.csv", Checksum: "aaa"}, want: ledger.New},
+		{job: "prices", entry: ledger.Entry{Name: "d.csv", Checksum: "aaa"}, byContent: true, want: ledger.New},
+	}
+
+	for i, tc := range testCases {
+		got, other, err := l.Decide(tc.job, tc.entry, tc.byContent)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if got != tc.want || other != tc.wantOther {
+			t.Errorf("Case %d, want: %s %s, got: %s %s", i, tc.want, tc.wantOther, got, other)
+		}
+	}
+}
+
+func TestEntries(t *testing.T) {
+	t.Parallel()
+	l := openLedger(t)
+
+	added, err := l.Import("stocks", []string{"b.csv", "a.csv"})
+	if err != nil || added != 2 {
+		t.Fatalf("want 2 imported names, got: %d, %v", added, err)
+	}
+	if added, _ := l.Import("stocks", []string{"a.csv"}); added != 0 {
+		t.Errorf("want known name not to be imported, got: %d", added)
+	}
+	later := time.Now().Add(time.Hour).UTC()
+	if err := l.Add("stocks", ledger.Entry{Name: "a.csv", Size: 4, ModTime: mtime, Checksum: "abc", DownloadedAt: later}); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+
+	entries, err := l.Entries("stocks")
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"b.csv", "a.csv"}; !cmp.Equal(want, names) {
+		t.Errorf("want: %v, got: %v", want, names)
+	}
+	if want := (ledger.Entry{Name: "a.csv", Size: 4, ModTime: mtime, Checksum: "abc", DownloadedAt: later}); !cmp.Equal(want, entries[1]) {
+		t.Errorf("want: %+v, got: %+v", want, entries[1])
+	}
+
+	if entries, err := l.Entries("doesntexist"); err != nil || len(entries) != 0 {
+		t.Errorf("want no entries for unknown job, got: %v, %v", entries, err)
+	}
+}
+
+func TestLastDay(t *testing.T) {
+	t.Parallel()
+
+	l := openLedger(t)
+	if day, err := l.LastDay("stocks"); day != "" || err != nil {
+		t.Errorf("want no last day, got: %q, %v", day, err)
+	}
+	l.SetLastDay("stocks", "2024-02-23")
+	l.SetLastDay("stocks", "2024-02-24")
+	l.Add("stocks", ledger.Entry{Name: "a.csv", Size: 4, ModTime: mtime})
+	if day, err := l.LastDay("stocks"); day != "2024-02-24" || err != nil {
+		t.Errorf("want 2024-02-24, got: %q, %v", day, err)
+	}
+	if day, _ := l.LastDay("catalog"); day != "" {
+		t.Errorf("want no last day for another job, got: %q", day)
+	}
+	// the state is not an entry of the job
+	if entries, _ := l.Entries("stocks"); len(entries) != 1 {
+		t.Errorf("want 1 entry, got: %v", entries)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "ledger.db")
+	l, err := ledger.Open(path)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	l.Add("stocks", ledger.Entry{Name: "a.csv", Size: 4, ModTime: mtime})
+
+	// the file is locked while it's open
+	if _, err := ledger.Open(path); err == nil {
+		t.Error("want error for the locked ledger, got nil")
+	}
+	l.Close()
+
+	l, err = ledger.Open(path)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	defer l.Close()
+	if ok, _ := l.Downloaded("stocks", ledger.Entry{Name: "a.csv", Size: 4, ModTime: mtime}, false); !ok {
+		t.Error("want the entry to survive reopening")
+	}
+
+	if _, err := ledger.Open("/proc/doesntexist/ledger.db"); err == nil {
+		t.Error("want error for invalid path, got nil")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "a.csv")
+	os.WriteFile(path, []byte("hello"), 0644)
+	got, err := ledger.Checksum(path)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"; got != want {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+	if _, err := ledger.Checksum("/tmp/doesntexist"); err == nil {
+		t.Error("want error for missing file, got nil")
+	}
+}
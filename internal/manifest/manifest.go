@@ -0,0 +1,98 @@
+// Package manifest describes the files delivered by one download run,
+// so the indexer can process the run as a unit
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/helpers"
+	"pullcsv/internal/ledger"
+	"time"
+)
+
+const timeLayout = "20060102T150405Z"
+
+// Manifest is the JSON file written into the destination after the run
+type Manifest struct {
+	Job         string    `json:"job"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Files       []File    `json:"files"`
+}
+
+// File is a delivered file. SourceModTime is set for the downloaded
+// files and is empty for the files unpacked from archives
+type File struct {
+	Name          string     `json:"name"`
+	Size          int64      `json:"size"`
+	Lines         int        `json:"lines"`
+	SHA256        string     `json:"sha256"`
+	SourceModTime *time.Time `json:"source_mod_time,omitempty"`
+	DeliveredAt   time.Time  `json:"delivered_at"`
+}
+
+// Files describes the files with names in dir delivered at deliveredAt, downloaded are
+// the ledger entries of the downloaded files to take the source mtime from
+func Files(dir string, names []string, downloaded []ledger.Entry, deliveredAt time.Time) ([]File, error) {
+	modTimes := make(map[string]time.Time)
+	for _, e := range downloaded {
+		modTimes[e.Name] = e.ModTime
+	}
+
+	files := []File{}
+	for _, name := range names {
+		p := filepath.Join(dir, name)
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, errors.New("Could not describe " + p + " in the manifest, the error: " + err.Error())
+		}
+		if fi.IsDir() {
+			continue
+		}
+		checksum, err := ledger.Checksum(p)
+		if err != nil {
+			return nil, errors.New("Could not get checksum of " + p + ", the error: " + err.Error())
+		}
+		lines, err := helpers.GetCountLines(p)
+		if err != nil {
+			return nil, err
+		}
+
+		f := File{Name: name, Size: fi.Size(), Lines: lines, SHA256: checksum, DeliveredAt: deliveredAt.UTC()}
+		if modTime, ok := modTimes[name]; ok && !modTime.IsZero() {
+			modTime = modTime.UTC()
+			f.SourceModTime = &modTime
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Name is the file name of the manifest: pullcsv-manifest-<job>-<finish time>.json
+func (m *Manifest) Name() string {
+	return "pullcsv-manifest-" + m.Job + "-" + m.FinishedAt.UTC().Format(timeLayout) + ".json"
+}
+
+// Write writes the manifest into the destination dir through a hidden temp file,
+// so it appears at once, and returns its path
+func (m *Manifest) Write() (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(m.Destination, m.Name())
+	tmp := filepath.Join(m.Destination, "."+m.Name()+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", errors.New("Could not write manifest " + tmp + ", the error: " + err.Error())
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return "", errors.New("Could not write manifest " + p + ", the error: " + err.Error())
+	}
+	return p, nil
+}
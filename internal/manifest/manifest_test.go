@@ -0,0 +1,76 @@
+package manifest_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/ledger"
+	"pullcsv/internal/manifest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManifest(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "stocks.csv"), []byte("a;1\nb;2\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "unzipped.csv"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(dir, "subdir"), 0755)
+	// the downloaded files keep the source mtime, it's not the delivery time
+	mtime := time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(dir, "stocks.csv"), mtime, mtime)
+	os.Chtimes(filepath.Join(dir, "unzipped.csv"), mtime, mtime)
+
+	delivered := time.Date(2024, 2, 24, 13, 5, 0, 0, time.FixedZone("MSK", 3*60*60))
+	files, err := manifest.Files(dir, []string{"stocks.csv", "unzipped.csv", "subdir"}, []ledger.Entry{{Name: "stocks.csv", ModTime: mtime}}, delivered)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+
+	m := &manifest.Manifest{
+		Job:         "stocks",
+		Source:      "rsync://USERNAME@server-name/pullcsv/stocks/*csv",
+		Destination: dir,
+		StartedAt:   time.Date(2024, 2, 24, 10, 4, 0, 0, time.UTC),
+		FinishedAt:  time.Date(2024, 2, 24, 10, 5, 30, 0, time.UTC),
+		Files:       files,
+	}
+	p, err := m.Write()
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if want := filepath.Join(dir, "pullcsv-manifest-stocks-20240224T100530Z.json"); p != want {
+		t.Errorf("want: %s, got: %s", want, p)
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got manifest.Manifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("want valid JSON, got error: %v", err)
+	}
+	want := *m
+	want.Files = []manifest.File{
+		{Name: "stocks.csv", Size: 8, Lines: 2, SHA256: "161073d84f15fea3f76da91d60f8c5f65a678bb437e4dc0b6dae98ed0bdfec39", SourceModTime: &mtime, DeliveredAt: delivered.UTC()},
+		{Name: "unzipped.csv", Size: 5, Lines: 1, SHA256: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", DeliveredAt: delivered.UTC()},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("manifest mismatch (-want +got):\n%s", diff)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(matches) != 0 {
+		t.Errorf("want no temp files left, got: %v", matches)
+	}
+
+	if _, err := manifest.Files(dir, []string{"doesntexist.csv"}, nil, delivered); err == nil {
+		t.Error("want error for missing file, got nil")
+	}
+	m.Destination = "/tmp/doesntexist"
+	if _, err := m.Write(); err == nil {
+		t.Error("want error for missing destination, got nil")
+	}
+}
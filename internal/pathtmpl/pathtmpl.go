@@ -0,0 +1,218 @@
+// Package pathtmpl expands the date templates in the source paths, e.g.
+// rsync://user@host/pullcsv/stocks/*{{date -1d "2006-01-02"}}*.csv
+package pathtmpl
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultRollover is the time before which the day tokens are still yesterday,
+// the files of the day may be not ready right after midnight
+const DefaultRollover = "00:11"
+
+// Options are the job's settings of the templates
+type Options struct {
+	// Rollover is the HH:MM the day tokens switch to the new day at
+	Rollover string `yaml:"rollover" json:"rollover"`
+	// TimeZone is the IANA name of the zone the tokens are in, the local one if empty
+	TimeZone string `yaml:"time_zone" json:"time_zone"`
+}
+
+// The tokens and their default layouts. week without a layout is
+// the ISO year and week (2006-W01), with a layout - the Monday of the week
+var layouts = map[string]string{
+	"date":  "20060102",
+	"week":  "",
+	"month": "200601",
+	"hour":  "2006010215",
+}
+
+// legacy are the magic words the templates replace. _YESTERDAY_ and
+// _YES-TER-DAY_ are not templates: they are the calendar day before now,
+// without the rollover, see legacyYesterday
+var legacy = strings.NewReplacer(
+	"_TODAY_", `{{date}}`,
+	"_TO-DAY_", `{{date "2006-01-02"}}`,
+)
+
+// legacyYesterday replaces _YESTERDAY_ and _YES-TER-DAY_ with the day before now
+func legacyYesterday(s string, now time.Time) string {
+	yesterday := now.AddDate(0, 0, -1)
+	return strings.NewReplacer(
+		"_YESTERDAY_", yesterday.Format("20060102"),
+		"_YES-TER-DAY_", yesterday.Format("2006-01-02"),
+	).Replace(s)
+}
+
+var (
+	tokenRe  = regexp.MustCompile(`{{(.*?)}}`)
+	argsRe   = regexp.MustCompile(`^\s*([a-z]+)(?:\s+([+-]\d+[hdwmy]))?(?:\s+"([^"]*)")?\s*$`)
+	offsetRe = regexp.MustCompile(`^([+-]\d+)([hdwmy])$`)
+)
+
+// token is one parsed {{name offset "layout"}}
+type token struct {
+	name   string
+	offset string
+	layout string
+}
+
+func parse(s string) (token, error) {
+	m := argsRe.FindStringSubmatch(s)
+	if m == nil {
+		return token{}, errors.New("Bad template {{" + s + "}}, it must be {{name [offset] [\"layout\"]}}")
+	}
+	layout, ok := layouts[m[1]]
+	if !ok {
+		return token{}, errors.New("Unknown template {{" + s + "}}, the tokens are date, week, month and hour")
+	}
+	t := token{name: m[1], offset: m[2], layout: layout}
+	if m[3] != "" {
+		t.layout = m[3]
+	}
+	return t, nil
+}
+
+// Validate checks the templates of s and the options
+func Validate(s string, opts Options) error {
+	if _, err := opts.location(); err != nil {
+		return err
+	}
+	if _, _, err := opts.rollover(); err != nil {
+		return err
+	}
+	for _, m := range tokenRe.FindAllStringSubmatch(legacy.Replace(s), -1) {
+		if _, err := parse(m[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expand replaces every template and legacy magic word of s (_TODAY_, _TO-DAY_,
+// _YESTERDAY_, _YES-TER-DAY_) with now in the options' time zone. Before the
+// rollover time the date, week and month tokens are of the previous day,
+// _YESTERDAY_ is always the calendar day before now
+func Expand(s string, now time.Time, opts Options) (string, error) {
+	today, err := Today(now, opts)
+	if err != nil {
+		return "", err
+	}
+	now = now.In(today.Location())
+	day := now
+	if now.Day() != today.Day() {
+		day = now.AddDate(0, 0, -1)
+	}
+	return expand(s, day, now)
+}
+
+// ExpandDay replaces the templates of s with the day returned by Today for
+// another time, the hour tokens get the midnight of the day
+func ExpandDay(s string, day time.Time) (string, error) {
+	return expand(s, day, day)
+}
+
+// Today returns the midnight of the day the date, week and month tokens
+// are of at now in the options' time zone
+func Today(now time.Time, opts Options) (time.Time, error) {
+	loc, err := opts.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	hh, mm, err := opts.rollover()
+	if err != nil {
+		return time.Time{}, err
+	}
+	now = now.In(loc)
+	yyyy, month, dd := now.Date()
+	if now.Before(time.Date(yyyy, month, dd, hh, mm, 0, 0, loc)) {
+		dd--
+	}
+	return time.Date(yyyy, month, dd, 0, 0, 0, 0, loc), nil
+}
+
+func expand(s string, day, now time.Time) (string, error) {
+	var errs error
+	result := tokenRe.ReplaceAllStringFunc(legacy.Replace(legacyYesterday(s, now)), func(m string) string {
+		t, err := parse(m[2 : len(m)-2])
+		if err != nil {
+			errs = errors.Join(errs, err)
+			return m
+		}
+		base := day
+		if t.name == "hour" {
+			base = now
+		}
+		return t.format(shift(base, t.offset))
+	})
+	if errs != nil {
+		return "", errs
+	}
+	return result, nil
+}
+
+// shift moves t by the offset, e.g. -3d or +1m
+func shift(t time.Time, offset string) time.Time {
+	m := offsetRe.FindStringSubmatch(offset)
+	if m == nil {
+		return t
+	}
+	n, _ := strconv.Atoi(m[1])
+	switch m[2] {
+	case "h":
+		return t.Add(time.Duration(n) * time.Hour)
+	case "d":
+		return t.AddDate(0, 0, n)
+	case "w":
+		return t.AddDate(0, 0, 7*n)
+	case "m":
+		return t.AddDate(0, n, 0)
+	}
+	return t.AddDate(n, 0, 0)
+}
+
+func (t token) format(tm time.Time) string {
+	if t.name != "week" {
+		return tm.Format(t.layout)
+	}
+	if t.layout == "" {
+		year, week := tm.ISOWeek()
+		return strconv.Itoa(year) + "-W" + twoDigits(week)
+	}
+	monday := tm.AddDate(0, 0, -((int(tm.Weekday()) + 6) % 7))
+	return monday.Format(t.layout)
+}
+
+func twoDigits(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
+
+func (o Options) location() (*time.Location, error) {
+	if o.TimeZone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(o.TimeZone)
+	if err != nil {
+		return nil, errors.New("Unknown time zone " + o.TimeZone + ", the error: " + err.Error())
+	}
+	return loc, nil
+}
+
+func (o Options) rollover() (hh, mm int, err error) {
+	rollover := o.Rollover
+	if rollover == "" {
+		rollover = DefaultRollover
+	}
+	t, err := time.Parse("15:04", rollover)
+	if err != nil {
+		return 0, 0, errors.New("Bad rollover " + rollover + ", it must be HH:MM")
+	}
+	return t.Hour(), t.Minute(), nil
+}
@@ -0,0 +1,131 @@
+package pathtmpl_test
+
+import (
+	"pullcsv/internal/pathtmpl"
+	"testing"
+	"time"
+)
+
+func TestExpand(t *testing.T) {
+	t.Parallel()
+
+	// before the default rollover the day is still 2024-02-29
+	now := time.Date(2024, 3, 1, 0, 5, 0, 0, time.UTC)
+	utc := pathtmpl.Options{TimeZone: "UTC"}
+
+	type testCase struct {
+		s    string
+		opts pathtmpl.Options
+		want string
+	}
+
+	testCases := []testCase{
+		{s: "stocks/*_TODAY_*", opts: utc, want: "stocks/*20240229*"},
+		// yesterday is the calendar day, it's not shifted by the rollover
+		{s: "stocks/*_TO-DAY_*_YESTERDAY_*_YES-TER-DAY_*", opts: utc, want: "stocks/*2024-02-29*20240229*2024-02-29*"},
+		{s: "stocks/*{{date}}*", opts: utc, want: "stocks/*20240229*"},
+		{s: `stocks/*{{date -3d "2006-01-02"}}*`, opts: utc, want: "stocks/*2024-02-26*"},
+		{s: "stocks/{{ date +1d }}", opts: utc, want: "stocks/20240301"},
+		{s: "stocks/{{hour}}", opts: utc, want: "stocks/2024030100"},
+		{s: "stocks/{{hour -1h}}", opts: utc, want: "stocks/2024022923"},
+		{s: "stocks/{{month}}", opts: utc, want: "stocks/202402"},
+		{s: `stocks/{{month -1m "2006-01"}}`, opts: utc, want: "stocks/2024-01"},
+		{s: "stocks/{{week}}", opts: utc, want: "stocks/2024-W09"},
+		{s: `stocks/{{week -1w "20060102"}}`, opts: utc, want: "stocks/20240219"},
+		{s: `stocks/{{date -1y "2006"}}/{{date "01"}}/*{{date}}*`, opts: utc, want: "stocks/2023/02/*20240229*"},
+		{s: "stocks/{{date}}", opts: pathtmpl.Options{Rollover: "00:00", TimeZone: "UTC"}, want: "stocks/20240301"},
+		{s: "stocks/{{date}}_{{hour}}", opts: pathtmpl.Options{TimeZone: "Europe/Moscow"}, want: "stocks/20240301_2024030103"},
+		{s: "stocks/*.csv", opts: utc, want: "stocks/*.csv"},
+	}
+
+	for i, tc := range testCases {
+		got, err := pathtmpl.Expand(tc.s, now, tc.opts)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if got != tc.want {
+			t.Errorf("Case %d, want: %s, got: %s", i, tc.want, got)
+		}
+	}
+}
+
+func TestExpandLegacy(t *testing.T) {
+	t.Parallel()
+
+	// the magic words expand as they did before the templates:
+	// at 00:05 today is still yesterday and yesterday is the calendar one
+	now := time.Date(2024, 3, 1, 0, 5, 0, 0, time.Local)
+	for s, want := range map[string]string{
+		"stocks/*_TODAY_*.csv":       "stocks/*20240229*.csv",
+		"stocks/*_TO-DAY_*.csv":      "stocks/*2024-02-29*.csv",
+		"stocks/*_YESTERDAY_*.csv":   "stocks/*20240229*.csv",
+		"stocks/*_YES-TER-DAY_*.csv": "stocks/*2024-02-29*.csv",
+	} {
+		got, err := pathtmpl.Expand(s, now, pathtmpl.Options{})
+		if err != nil {
+			t.Fatalf("%s: want nil, got error: %v", s, err)
+		}
+		if got != want {
+			t.Errorf("%s: want: %s, got: %s", s, want, got)
+		}
+	}
+}
+
+func TestExpandDay(t *testing.T) {
+	t.Parallel()
+
+	utc := pathtmpl.Options{TimeZone: "UTC"}
+	for i, tc := range []struct {
+		now  time.Time
+		opts pathtmpl.Options
+		want string
+	}{
+		{now: time.Date(2024, 3, 1, 0, 5, 0, 0, time.UTC), opts: utc, want: "2024-02-29"},
+		{now: time.Date(2024, 3, 1, 0, 11, 0, 0, time.UTC), opts: utc, want: "2024-03-01"},
+		{now: time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC), opts: pathtmpl.Options{Rollover: "06:00", TimeZone: "UTC"}, want: "2024-02-29"},
+		{now: time.Date(2024, 2, 29, 22, 0, 0, 0, time.UTC), opts: pathtmpl.Options{TimeZone: "Europe/Moscow"}, want: "2024-03-01"},
+	} {
+		today, err := pathtmpl.Today(tc.now, tc.opts)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if got := today.Format("2006-01-02"); got != tc.want {
+			t.Errorf("Case %d, want: %s, got: %s", i, tc.want, got)
+		}
+	}
+
+	today, _ := pathtmpl.Today(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), utc)
+	got, err := pathtmpl.ExpandDay(`stocks/*_YESTERDAY_*{{date "2006-01-02"}}*{{hour}}`, today.AddDate(0, 0, -2))
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if want := "stocks/*20240227*2024-02-28*2024022800"; got != want {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	if err := pathtmpl.Validate(`stocks/{{date -1d "2006-01-02"}}/_TODAY_/{{week}}`, pathtmpl.Options{}); err != nil {
+		t.Errorf("want nil, got error: %v", err)
+	}
+
+	for i, tc := range []struct {
+		s    string
+		opts pathtmpl.Options
+	}{
+		{s: "stocks/{{day}}"},
+		{s: "stocks/{{date -3x}}"},
+		{s: "stocks/{{date 2006}}"},
+		{s: "stocks", opts: pathtmpl.Options{Rollover: "25:00"}},
+		{s: "stocks", opts: pathtmpl.Options{TimeZone: "Mars/Olympus"}},
+	} {
+		if err := pathtmpl.Validate(tc.s, tc.opts); err == nil {
+			t.Errorf("Case %d: want error, got nil", i)
+		}
+		if _, err := pathtmpl.Expand(tc.s, time.Now(), tc.opts); err == nil {
+			t.Errorf("Case %d: want error from Expand, got nil", i)
+		}
+	}
+}
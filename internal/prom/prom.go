@@ -7,6 +7,13 @@ import (
 	"net/http"
 )
 
+// The outcomes of the job's runs
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeTimeout = "timeout"
+)
+
 type Metrics struct {
 	MaxModifiedFileLifetime *prometheus.GaugeVec
 	MinModifiedFileLifetime *prometheus.GaugeVec
@@ -17,6 +24,22 @@ type Metrics struct {
 	RsyncEXfileStopTime     *prometheus.GaugeVec
 	RsyncCSVExitCode        *prometheus.GaugeVec
 	RsyncEXfileExitCode     *prometheus.GaugeVec
+	DedupDecisions          *prometheus.CounterVec
+	QuarantinedFiles        *prometheus.CounterVec
+	ArchivesRejected        *prometheus.CounterVec
+	DownloadAttempts        *prometheus.CounterVec
+	DownloadLastAttempts    *prometheus.GaugeVec
+	Runs                    *prometheus.CounterVec
+	DownloadedFiles         *prometheus.CounterVec
+	DownloadedBytes         *prometheus.CounterVec
+	ArchivesExtracted       *prometheus.CounterVec
+	DeletedFiles            *prometheus.CounterVec
+	DeletedBytes            *prometheus.CounterVec
+	DownloadsRefused        *prometheus.CounterVec
+	ArchivedFiles           *prometheus.CounterVec
+	ArchivedBytes           *prometheus.CounterVec
+	RunDuration             *prometheus.HistogramVec
+	FileSize                *prometheus.HistogramVec
 	Info                    *prometheus.GaugeVec
 }
 
@@ -76,6 +99,106 @@ func pullcsvMetrics() (http.Handler, *Metrics) {
 			Help:      "Rsync exit code (uploading exclude file).",
 		},
 			[]string{"path", "stand_name", "pod_name"}),
+		DedupDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "dedup_decisions_total",
+			Help:      "How many downloaded files were delivered (new, changed) or skipped (unchanged, duplicate).",
+		},
+			[]string{"job", "decision", "stand_name", "pod_name"}),
+		QuarantinedFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "quarantined_files_total",
+			Help:      "How many downloaded files didn't match the job's CSV schema and were moved to the quarantine dir.",
+		},
+			[]string{"job", "reason", "stand_name", "pod_name"}),
+		ArchivesRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "archives_rejected_total",
+			Help:      "How many downloaded archives exceeded the unarchiving limits and were moved to the quarantine dir.",
+		},
+			[]string{"job", "limit", "stand_name", "pod_name"}),
+		DownloadAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "download_attempts_total",
+			Help:      "How many download attempts were made, by the rsync exit code of the attempt (0 is success).",
+		},
+			[]string{"job", "exit_code", "stand_name", "pod_name"}),
+		DownloadLastAttempts: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "pullcsv",
+			Name:      "download_last_attempts",
+			Help:      "How many attempts the last download took.",
+		},
+			[]string{"job", "stand_name", "pod_name"}),
+		Runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "runs_total",
+			Help:      "How many runs of the job finished, by the outcome: success, failure or timeout.",
+		},
+			[]string{"job", "outcome", "stand_name", "pod_name"}),
+		DownloadedFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "downloaded_files_total",
+			Help:      "How many files the job downloaded.",
+		},
+			[]string{"job", "stand_name", "pod_name"}),
+		DownloadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "downloaded_bytes_total",
+			Help:      "How many bytes of the files the job downloaded.",
+		},
+			[]string{"job", "stand_name", "pod_name"}),
+		ArchivesExtracted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "archives_extracted_total",
+			Help:      "How many downloaded archives the job unpacked.",
+		},
+			[]string{"job", "stand_name", "pod_name"}),
+		DeletedFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "deleted_files_total",
+			Help:      "How many old files the cleanup deleted in the destination of the jobs, by the reason: expired, partial, max_size, max_files or min_free.",
+		},
+			[]string{"path", "reason", "stand_name", "pod_name"}),
+		DeletedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "deleted_bytes_total",
+			Help:      "How many bytes of the old files the cleanup deleted in the destination of the jobs, by the reason: expired, partial, max_size, max_files or min_free.",
+		},
+			[]string{"path", "reason", "stand_name", "pod_name"}),
+		ArchivedFiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "archived_files_total",
+			Help:      "How many old files the cleanup moved from the destination of the jobs into the archive area, by the reason.",
+		},
+			[]string{"path", "reason", "stand_name", "pod_name"}),
+		ArchivedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "archived_bytes_total",
+			Help:      "How many bytes of the old files the cleanup moved from the destination of the jobs into the archive area, by the reason.",
+		},
+			[]string{"path", "reason", "stand_name", "pod_name"}),
+		DownloadsRefused: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pullcsv",
+			Name:      "downloads_refused_total",
+			Help:      "How many runs of the job did not start the download because of the low free space in the destination.",
+		},
+			[]string{"job", "stand_name", "pod_name"}),
+		RunDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "pullcsv",
+			Name:      "run_duration_seconds",
+			Help:      "How long the runs of the job took, with the retries and the delivery.",
+			// from 1 second to 4.5 hours
+			Buckets: prometheus.ExponentialBuckets(1, 2, 15),
+		},
+			[]string{"job", "stand_name", "pod_name"}),
+		FileSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "pullcsv",
+			Name:      "downloaded_file_size_bytes",
+			Help:      "The sizes of the files the job downloaded.",
+			// from 1 KB to 4 GB
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		},
+			[]string{"job", "stand_name", "pod_name"}),
 		Info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: "pullcsv",
 			Name:      "info",
@@ -95,6 +218,22 @@ func pullcsvMetrics() (http.Handler, *Metrics) {
 		m.RsyncEXfileStartTime,
 		m.RsyncEXfileStopTime,
 		m.RsyncEXfileExitCode,
+		m.DedupDecisions,
+		m.QuarantinedFiles,
+		m.ArchivesRejected,
+		m.DownloadAttempts,
+		m.DownloadLastAttempts,
+		m.Runs,
+		m.DownloadedFiles,
+		m.DownloadedBytes,
+		m.ArchivesExtracted,
+		m.DeletedFiles,
+		m.DeletedBytes,
+		m.DownloadsRefused,
+		m.ArchivedFiles,
+		m.ArchivedBytes,
+		m.RunDuration,
+		m.FileSize,
 		m.Info,
 	)
 
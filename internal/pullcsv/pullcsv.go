@@ -1,122 +1,744 @@
 package pullcsv
 
 import (
+	"context"
+	"errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"pullcsv/internal/control"
+	"pullcsv/internal/ledger"
 	"pullcsv/internal/logger"
+	"pullcsv/internal/manifest"
+	"pullcsv/internal/pathtmpl"
 	"pullcsv/internal/prom"
-	"regexp"
+	"pullcsv/internal/retry"
+	"pullcsv/internal/rsync"
+	"pullcsv/internal/schema"
+	"pullcsv/internal/source"
+	"pullcsv/internal/transcode"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bitfield/script"
 	"github.com/go-co-op/gocron"
+	"go.uber.org/fx"
 	"pullcsv/internal/helpers"
 )
 
-func Pullcsv(metrics *prom.Metrics) {
+// notDownloaded returns the files which are not in the job's ledger
+func notDownloaded(led *ledger.Ledger, job string, policy config.Dedup, files []source.File) ([]source.File, error) {
+	var result []source.File
+	for _, f := range files {
+		downloaded, err := led.Downloaded(job, ledger.Entry{Name: f.Name, Size: f.Size, ModTime: f.ModTime}, policy.ByName)
+		if err != nil {
+			return nil, err
+		}
+		if !downloaded {
+			result = append(result, f)
+		}
+	}
+	return result, nil
+}
+
+// dedup decides what to do with every file fetched into dir, the unchanged files
+// and the duplicates are removed from dir, so they are not delivered.
+// It returns the ledger entries of all the fetched files
+func dedup(led *ledger.Ledger, job string, policy config.Dedup, dir string, results []source.Result, count func(ledger.Decision)) (entries []ledger.Entry) {
+	// the duplicates within the same run are not in the ledger yet
+	delivered := make(map[string]string)
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		p := filepath.Join(dir, result.Name)
+		checksum, err := ledger.Checksum(p)
+		if err != nil {
+			logger.Warn("Could not get checksum of " + result.Name + ", the error: " + err.Error())
+		}
+		e := ledger.Entry{Name: result.Name, Size: result.Size, ModTime: result.ModTime, Checksum: checksum}
+		entries = append(entries, e)
+
+		decision, other, err := led.Decide(job, e, policy.ByContent)
+		if err != nil {
+			logger.Warn(err.Error())
+			continue
+		}
+		if name, ok := delivered[checksum]; ok && policy.ByContent && checksum != "" && decision != ledger.Unchanged {
+			decision, other = ledger.Duplicate, name
+		}
+		count(decision)
+
+		switch decision {
+		case ledger.New, ledger.Changed:
+			if decision == ledger.Changed {
+				logger.Info("The file " + result.Name + " was changed (SHA-256 " + checksum + "), it will be delivered again")
+			}
+			delivered[checksum] = result.Name
+			continue
+		case ledger.Unchanged:
+			logger.Info("The file " + result.Name + " has a new size or mtime, but the same SHA-256 " + checksum + ", it is skipped")
+		case ledger.Duplicate:
+			logger.Info("The file " + result.Name + " has the same SHA-256 " + checksum + " as " + other + ", it is skipped")
+		}
+		if err := os.Remove(p); err != nil {
+			logger.Warn("Could not delete the skipped file " + p + ", the error: " + err.Error())
+		}
+	}
+	return entries
+}
+
+// convert converts the file to UTF-8 if the job has the encoding,
+// it returns the note for the log line
+func convert(encoding, p string) (note string) {
+	if encoding == "" || helpers.IsArchive(p) {
+		return ""
+	}
+	from, converted, err := transcode.File(p, encoding)
+	if err != nil {
+		logger.Warn(err.Error())
+		return ""
+	}
+	if !converted {
+		return ""
+	}
+	return ", converted from " + from + " to UTF-8"
+}
+
+// quarantined validates the file against the schema and moves it to the quarantine
+// dir if it's invalid. The archives are skipped, their files are validated
+// after unarchiving
+func quarantined(s *config.Schema, p string, count func(reason string)) bool {
+	if helpers.IsArchive(p) || !schema.Matches(s, p) {
+		return false
+	}
+	err := schema.Validate(p, s)
+	var validationErr *schema.Error
+	if !errors.As(err, &validationErr) {
+		if err != nil {
+			logger.Warn("Could not validate the file " + p + ", the error: " + err.Error())
+		}
+		return false
+	}
+	count(validationErr.Reason)
+	name := filepath.Base(p)
+	logger.Warn("The file " + name + " doesn't match the schema (" + validationErr.Reason + "), " + err.Error() + ", it is moved to " + s.Quarantine)
+	if err := helpers.Move(p, filepath.Join(s.Quarantine, name)); err != nil {
+		logger.Warn("Could not move the file " + p + " to quarantine, the error: " + err.Error())
+	}
+	return true
+}
+
+// prepareUnpacked converts and validates the files unpacked from the archives,
+// the downloaded files are prepared before they are moved to the destination.
+// It returns the unpacked files which are not quarantined
+func prepareUnpacked(opts config.Options, unpacked []string, count func(reason string)) (kept []string) {
+	for _, p := range unpacked {
+		if note := convert(opts.Encoding, p); note != "" {
+			logger.Info("The file " + p + " was unarchived" + note)
+		}
+		if opts.Schema != nil && quarantined(opts.Schema, p, count) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// writeManifest describes the files delivered by the run into dTo in the manifest in dTo
+func writeManifest(job, dFrom, dTo string, startedAt, deliveredAt time.Time, delivered []string, downloaded []ledger.Entry) {
+	files, err := manifest.Files(dTo, delivered, downloaded, deliveredAt)
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	m := &manifest.Manifest{
+		Job:         job,
+		Source:      dFrom,
+		Destination: dTo,
+		StartedAt:   startedAt.UTC(),
+		FinishedAt:  time.Now().UTC(),
+		Files:       files,
+	}
+	p, err := m.Write()
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+	logger.Info("The manifest " + p + " was written")
+}
+
+// partial reports whether the rsync exit code is of the download
+// some of the files failed in, the other files are fetched
+func partial(code int) bool {
+	return code == 23 || code == 24
+}
 
-	if _, err := os.Stat("/usr/bin/rsync"); err != nil {
-		logger.Fatal(err.Error())
+// failedNames returns the names of the files which were not fetched
+func failedNames(results []source.Result) (names []string) {
+	for _, result := range results {
+		if result.Err != nil {
+			names = append(names, result.Name)
+		}
 	}
+	return names
+}
+
+// fetched are the files the run of the job fetched from source into dir
+type fetched struct {
+	job       config.Job
+	source    string
+	dir       string
+	startedAt time.Time
+	results   []source.Result
+}
+
+// counters count what happened to the job's files during the delivery
+type counters struct {
+	decision    func(ledger.Decision)
+	quarantined func(reason string)
+	rejected    func(limit string)
+	extracted   func(archives int)
+}
 
-	dFrom, dTo, standName, podName, err := helpers.PrepareEnv()
+// deliver dedups, converts, validates and unarchives the fetched files of f into the job's
+// destination, with atomic delivery they are prepared in the staging dir and published.
+// The failed files of f.results are skipped. The fetched files are added to the ledger
+// only if they are delivered, the error is returned if they are not
+func deliver(ctx context.Context, led *ledger.Ledger, f fetched, count counters) error {
+	job, opts, dTo := f.job.Name, f.job.Options, f.job.Destination
+	// a failed file may be left in dir by the source
+	for _, name := range failedNames(f.results) {
+		if err := os.Remove(filepath.Join(f.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Could not delete the failed file " + name + ", the error: " + err.Error())
+		}
+	}
+	downloaded := dedup(led, job, opts.Dedup, f.dir, f.results, count.decision)
+	// with atomic delivery the files and the unarchived files are
+	// prepared in the staging dir and published when all is done
+	deliverTo := dTo
+	atomicDelivery := opts.Delivery == config.DeliveryAtomic
+	if atomicDelivery {
+		deliverTo = filepath.Join(dTo, helpers.StagingDir, job) + string(filepath.Separator)
+		if err := os.RemoveAll(deliverTo); err != nil {
+			logger.Warn("Could not clean staging dir " + deliverTo + ", the error: " + err.Error())
+		}
+	}
+	// the files are converted and validated before they are moved, the unarchived
+	// ones after unarchiving. Only the files of this run are unarchived, not the ones left in dTo
+	delivered := []string{}
+	prepare := func(p string) (string, bool) {
+		note := convert(opts.Encoding, p)
+		deliver := opts.Schema == nil || !quarantined(opts.Schema, p, count.quarantined)
+		if deliver {
+			delivered = append(delivered, filepath.Base(p))
+		}
+		return note, deliver
+	}
+	if err := helpers.LogEveryFileAndMoveIt(deliverTo, f.dir, prepare); err != nil {
+		logger.Warn("Something wrong with moving downloaded files from temp location, the error: " + err.Error())
+	}
+	//work with archives
+	extracted, unpacked, rejected, err := helpers.WorkWithArchives(ctx, deliverTo, delivered, opts.Archives)
 	if err != nil {
-		logger.Fatal(err.Error())
+		logger.Warn(err.Error())
+	}
+	count.extracted(extracted)
+	// in the staging dir and, with move delivery, in the destination
+	unpacked = prepareUnpacked(opts, unpacked, count.quarantined)
+	quarantine := filepath.Join(dTo, helpers.QuarantineDir, job)
+	if opts.Schema != nil {
+		quarantine = opts.Schema.Quarantine
+	}
+	for _, r := range rejected {
+		count.rejected(r.Limit)
+		if err := helpers.Move(r.Archive, filepath.Join(quarantine, filepath.Base(r.Archive))); err != nil {
+			logger.Warn("Could not move the archive " + r.Archive + " to quarantine, the error: " + err.Error())
+		}
+	}
+	if !atomicDelivery && opts.Manifest {
+		// the archives are removed or moved to quarantine, their files are in dTo
+		var files []string
+		for _, name := range delivered {
+			if helpers.Exists(filepath.Join(dTo, name)) {
+				files = append(files, name)
+			}
+		}
+		for _, p := range unpacked {
+			if rel, err := filepath.Rel(dTo, p); err == nil {
+				files = append(files, rel)
+			}
+		}
+		if len(files) > 0 {
+			writeManifest(job, f.source, dTo, f.startedAt, time.Now(), files, downloaded)
+		}
+	}
+	if atomicDelivery && helpers.Exists(deliverTo) {
+		published, err := helpers.PublishFiles(deliverTo, dTo, opts.Marker)
+		publishedAt := time.Now()
+		logger.Info(strconv.Itoa(len(published)) + " files were published to " + dTo)
+		if opts.Manifest && len(published) > 0 {
+			writeManifest(job, f.source, dTo, f.startedAt, publishedAt, published, downloaded)
+		}
+		if err != nil {
+			// the files are not in the ledger, so the ones left in the staging dir are downloaded again
+			return errors.New("Something wrong with publishing files from " + deliverTo + ", the error: " + err.Error())
+		}
+	}
+	if err := led.Add(job, downloaded...); err != nil {
+		logger.Warn(err.Error())
+	}
+	return nil
+}
+
+// daySource is the job's source expanded for the day, day is "" if the job doesn't backfill
+type daySource struct {
+	day    string
+	source string
+}
+
+// daySources expands the job's source for today and, if the job backfills, for every
+// day after the last completed one in the ledger (or from from, 2006-01-02)
+// within backfill_days in order. The days with the same source are pulled once
+func daySources(job config.Job, led *ledger.Ledger, now time.Time, from string) ([]daySource, error) {
+	if job.Options.BackfillDays == 0 {
+		source, err := pathtmpl.Expand(job.Source, now, job.Options.Dates)
+		return []daySource{{source: source}}, err
+	}
+
+	today, err := pathtmpl.Today(now, job.Options.Dates)
+	if err != nil {
+		return nil, err
+	}
+	last, err := led.LastDay(job.Name)
+	if err != nil {
+		return nil, err
+	}
+	// with no last day the job pulls only today
+	missed := func(day string) bool {
+		if from != "" {
+			return day >= from
+		}
+		return last != "" && day > last
+	}
+
+	var sources []daySource
+	for d := today.AddDate(0, 0, -job.Options.BackfillDays); !d.After(today); d = d.AddDate(0, 0, 1) {
+		day := d.Format("2006-01-02")
+		if !d.Equal(today) && !missed(day) {
+			continue
+		}
+		source, err := pathtmpl.ExpandDay(job.Source, d)
+		if d.Equal(today) {
+			source, err = pathtmpl.Expand(job.Source, now, job.Options.Dates)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(sources) > 0 && sources[len(sources)-1].source == source {
+			sources[len(sources)-1].day = day
+			continue
+		}
+		sources = append(sources, daySource{day: day, source: source})
+	}
+	if len(sources) > 1 {
+		logger.Info("The job " + job.Name + " catches up " + strconv.Itoa(len(sources)-1) + " missed days since " + sources[0].day)
+	}
+	return sources, nil
+}
+
+// Flags are the command line options of the run
+type Flags struct {
+	// BackfillFrom (2006-01-02) makes the backfilling jobs pull every day
+	// from it on start, not only the ones after the last completed day
+	BackfillFrom string
+}
+
+// ShutdownTimeout is how long the stop waits for the running jobs to finish
+// before it cancels their downloads
+const ShutdownTimeout = 20 * time.Second
+
+// rsyncFileIOExitCode is the exit code of the download refused because of the low
+// free space, it's the rsync file I/O error and it's not retried by default
+const rsyncFileIOExitCode = 11
+
+// runTimeoutExitCode is the exit code of the download stopped by options.timeout
+// of the run, like of the timeout command. It differs from the rsync timeouts
+// (30 and 35) of the hung server
+const runTimeoutExitCode = 124
+
+// exitCode is source.ExitCode of err, or runTimeoutExitCode if the download
+// failed because the run timed out
+func exitCode(ctx context.Context, err error) int {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return runTimeoutExitCode
 	}
+	return source.ExitCode(err)
+}
 
-	var exFNfullLocalPath,
-		exFNfullRemotePath []string
+// Pullcsv schedules the jobs, they start with the app. On stop no new runs start,
+// the running ones finish or, after ShutdownTimeout, their downloads are canceled
+func Pullcsv(lc fx.Lifecycle, cfg *config.Config, metrics *prom.Metrics, led *ledger.Ledger, flags Flags, ctl *control.Control) {
+
+	var dFrom, dTo []string
+	for _, job := range cfg.Jobs {
+		dFrom = append(dFrom, job.Source)
+		dTo = append(dTo, job.Destination)
+	}
+	standName, podName := cfg.StandName, cfg.PodName
+
+	var exFNs, exFNfullLocalPath []string
+	// the first run of every backfilling job is on start
+	backfillFrom := make([]string, len(cfg.Jobs))
+	for i := range cfg.Jobs {
+		backfillFrom[i] = flags.BackfillFrom
+	}
 
 	s := gocron.NewScheduler(time.UTC)
 
-	for i, _ := range dFrom {
-		exFN, err := helpers.GetExludeFileName(dFrom[i], dTo[i])
+	// stopping is canceled when the app stops, the jobs don't start the next day then,
+	// runCtx is canceled if they don't finish in time, it interrupts the downloads
+	stopping, stop := context.WithCancel(context.Background())
+	runCtx, cancelRuns := context.WithCancel(context.Background())
+	// tmpDirs are the download dirs of the running jobs
+	var tmpDirsMu sync.Mutex
+	tmpDirs := make(map[string]bool)
+
+	// pull downloads the files of the job j from dFromStr, the source with the expanded
+	// templates, and delivers them. It returns the exit code and the error if the download
+	// failed. The download and the unarchiving stop when ctx is done
+	pull := func(ctx context.Context, j int, dFromStr string) (int, error) {
+		if minFree := cfg.Jobs[j].Options.MinFreePercent; minFree > 0 {
+			free, err := helpers.FreePercent(dTo[j])
+			if err != nil {
+				logger.Warn(err.Error())
+			} else if free < float64(minFree) {
+				metrics.DownloadsRefused.With(prometheus.Labels{"job": cfg.Jobs[j].Name, "stand_name": standName, "pod_name": podName}).Inc()
+				err = errors.New("Only " + strconv.FormatFloat(free, 'f', 1, 64) + "% of the disk of " + dTo[j] + " is free, less than " + strconv.Itoa(minFree) + "%, the download from " + dFromStr + " is refused")
+				logger.Warn(err.Error())
+				return rsyncFileIOExitCode, err
+			}
+		}
+
+		src, err := source.New(ctx, dFromStr, source.Options{PartialDir: cfg.Jobs[j].Options.PartialDir})
+		if err != nil {
+			code := exitCode(ctx, err)
+			err = errors.New("Could not connect to " + dFromStr + ", the error: " + err.Error())
+			logger.Warn(err.Error())
+			return code, err
+		}
+		defer src.Close()
+
+		jobName := cfg.Jobs[j].Name
+		if cfg.Jobs[j].Options.ExcludeFileSync {
+			if err := src.Get(ctx, exFNs[j], exFNfullLocalPath[j]); err == nil {
+				excludes, err := rsync.ReadExcludeFile(exFNfullLocalPath[j])
+				if err != nil {
+					logger.Warn("Could not read exclude file " + exFNfullLocalPath[j] + ", the error: " + err.Error())
+				} else if added, err := led.Import(jobName, excludes); err != nil {
+					logger.Warn(err.Error())
+				} else if added > 0 {
+					logger.Info(strconv.Itoa(added) + " file names were imported into the ledger from the exclude file " + exFNs[j])
+				}
+			}
+		}
+
+		tmpDirDownloadTo, err := os.MkdirTemp("/tmp/", strings.ReplaceAll(dTo[j], "/", "_"))
 		if err != nil {
 			logger.Fatal(err.Error())
 		}
+		tmpDirsMu.Lock()
+		tmpDirs[tmpDirDownloadTo] = true
+		tmpDirsMu.Unlock()
+		defer func() {
+			if err := os.RemoveAll(tmpDirDownloadTo); err != nil {
+				logger.Warn("Couldn't delete tmp dir " + tmpDirDownloadTo + ", the error: " + err.Error())
+			}
+			tmpDirsMu.Lock()
+			delete(tmpDirs, tmpDirDownloadTo)
+			tmpDirsMu.Unlock()
+		}()
 
-		re := regexp.MustCompile(`rsync.+@[a-zA-z0-9-_]+/`)
-		exFNfullRemotePath = append(exFNfullRemotePath, re.FindString(dFrom[i])+"pullcsv-exclude-files/"+exFN)
-		exFNfullLocalPath = append(exFNfullLocalPath, "/tmp/"+exFN)
+		logger.Info("Start downloading files from " + dFromStr + " to " + tmpDirDownloadTo)
 
-		_, err = s.Cron(os.Getenv("DOWNLOAD_CRON")).SingletonMode().Do(func(j int) {
-			var dFromStr string
-			dFromStr = helpers.EnvReplacement(dFrom[j])
-			if helpers.Rsync("/usr/bin/rsync "+exFNfullRemotePath[j]+" "+exFNfullLocalPath[j]) != 0 {
-				os.Create(exFNfullLocalPath[j])
+		rsyncCSVstartTime := time.Now().Unix()
+		files, err := src.List(ctx)
+		if err == nil {
+			files, err = notDownloaded(led, jobName, cfg.Jobs[j].Options.Dedup, files)
+		}
+		var results []source.Result
+		if err == nil {
+			results, err = src.Fetch(ctx, files, tmpDirDownloadTo)
+		}
+		rsyncCSVstopTime := time.Now().Unix()
+		rsyncExitCode := exitCode(ctx, err)
+		jobLabels := prometheus.Labels{"job": jobName, "stand_name": standName, "pod_name": podName}
+		for _, result := range results {
+			if result.Err != nil {
+				logger.Warn("Could not download " + result.Name + " from " + dFromStr + ", the error: " + result.Err.Error())
+				continue
 			}
+			metrics.DownloadedFiles.With(jobLabels).Inc()
+			metrics.DownloadedBytes.With(jobLabels).Add(float64(result.Size))
+			metrics.FileSize.With(jobLabels).Observe(float64(result.Size))
+		}
+		metrics.RsyncCSVExitCode.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncExitCode))
+		metrics.RsyncCSVStartTime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncCSVstartTime))
+		metrics.RsyncCSVStopTime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncCSVstopTime))
 
-			tmpDirDownloadTo, err := os.MkdirTemp("/tmp/", strings.ReplaceAll(dTo[j], "/", "_"))
+		var pullErr error
+		if rsyncExitCode != 0 {
+			pullErr = errors.New("A problem with rsync (from " + dFromStr + " to " + tmpDirDownloadTo + "), the exit code: " + strconv.Itoa(rsyncExitCode) + ", it means: " + helpers.GetRsyncExitCodeMeaning(rsyncExitCode) + ", the error: " + err.Error())
+			if failed := failedNames(results); partial(rsyncExitCode) && len(failed) > 0 {
+				pullErr = errors.New("Could not download " + strings.Join(failed, ", ") + " from " + dFromStr + ", the rest of the files are delivered, the exit code: " + strconv.Itoa(rsyncExitCode) + ", it means: " + helpers.GetRsyncExitCodeMeaning(rsyncExitCode) + ", the error: " + err.Error())
+			}
+			logger.Warn(pullErr.Error())
+		}
+		// after a partial failure the fetched files are delivered too, the failed ones
+		// are not added to the ledger, so only they are downloaded again
+		if rsyncExitCode == 0 || partial(rsyncExitCode) {
+			fetchedFiles := fetched{job: cfg.Jobs[j], source: dFromStr, dir: tmpDirDownloadTo, startedAt: time.Unix(rsyncCSVstartTime, 0), results: results}
+			err := deliver(ctx, led, fetchedFiles, counters{
+				decision: func(d ledger.Decision) {
+					metrics.DedupDecisions.With(prometheus.Labels{"job": jobName, "decision": string(d), "stand_name": standName, "pod_name": podName}).Inc()
+				},
+				quarantined: func(reason string) {
+					metrics.QuarantinedFiles.With(prometheus.Labels{"job": jobName, "reason": reason, "stand_name": standName, "pod_name": podName}).Inc()
+				},
+				rejected: func(limit string) {
+					metrics.ArchivesRejected.With(prometheus.Labels{"job": jobName, "limit": limit, "stand_name": standName, "pod_name": podName}).Inc()
+				},
+				extracted: func(archives int) {
+					metrics.ArchivesExtracted.With(jobLabels).Add(float64(archives))
+				},
+			})
 			if err != nil {
-				logger.Fatal(err.Error())
+				rsyncExitCode = rsyncFileIOExitCode
+				pullErr = errors.Join(pullErr, err)
+				logger.Warn(err.Error())
 			}
+			newestFileTimestamp, oldestFileTimestamp, countFiles := helpers.GetOldestNewestCountFiles(dTo[j])
+			metrics.MaxModifiedFileLifetime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(oldestFileTimestamp))
+			metrics.MinModifiedFileLifetime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(newestFileTimestamp))
+			metrics.CountFiles.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(countFiles))
 
-			logger.Info("Start downloading files from " + dFromStr + " to " + tmpDirDownloadTo)
-
-			rsyncCSVstartTime := time.Now().Unix()
-			rsyncExitCode := helpers.Rsync("/usr/bin/rsync -azq --partial --exclude-from=" + exFNfullLocalPath[j] + " " + dFromStr + " " + tmpDirDownloadTo)
-			rsyncCSVstopTime := time.Now().Unix()
-			metrics.RsyncCSVExitCode.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncExitCode))
-			metrics.RsyncCSVStartTime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncCSVstartTime))
-			metrics.RsyncCSVStopTime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncCSVstopTime))
-
-			if rsyncExitCode != 0 {
-				logger.Warn("A problem with rsync (from " + dFromStr + " to " + tmpDirDownloadTo + "), the exit code: " + strconv.Itoa(rsyncExitCode) + ", it means: " + helpers.GetRsyncExitCodeMeaning(rsyncExitCode))
-			} else if rsyncExitCode == 0 {
-				if err := helpers.LogEveryFileAndMoveIt(dTo[j], tmpDirDownloadTo); err != nil {
-					logger.Warn("Something wrong with moving downloaded files from temp location, the error: " + err.Error())
+			if cfg.Jobs[j].Options.ExcludeFileSync {
+				var names []string
+				entries, err := led.Entries(jobName)
+				for _, e := range entries {
+					names = append(names, e.Name)
 				}
-				//work with archives
-				if err := helpers.WorkWithArchives(dTo[j]); err != nil {
-					logger.Warn(err.Error())
+				if err == nil {
+					_, err = script.Slice(names).WriteFile(exFNfullLocalPath[j])
 				}
-				newestFileTimestamp, oldestFileTimestamp, countFiles := helpers.GetOldestNewestCountFiles(dTo[j])
-				metrics.MaxModifiedFileLifetime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(oldestFileTimestamp))
-				metrics.MinModifiedFileLifetime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(newestFileTimestamp))
-				metrics.CountFiles.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(countFiles))
-
-				saveToExFN, err := helpers.SaveExcludeFile(dTo[j], exFNfullLocalPath[j])
 				if err != nil {
 					logger.Warn("Something was wrong with saving exclude file " + exFNfullLocalPath[j] + ", the error: " + err.Error())
 				} else {
-					script.Slice(saveToExFN).WriteFile(exFNfullLocalPath[j])
-					//truncate excludeFiles
-					helpers.TruncateExcludeFile(exFNfullLocalPath[j], j, 20000, 9437184)
+					//truncate excludeFiles, the ledger itself keeps all the files
+					helpers.TruncateExcludeFile(exFNfullLocalPath[j], j, cfg.Jobs[j].Options.ExcludeMaxLines, cfg.Jobs[j].Options.ExcludeMaxSize)
 
 					rsyncEXfileStartTime := time.Now().Unix()
-					rsyncExitCode = helpers.Rsync("/usr/bin/rsync " + exFNfullLocalPath[j] + " " + exFNfullRemotePath[j])
+					err = src.Put(ctx, exFNfullLocalPath[j], exFNs[j])
 					rsyncEXfileStopTime := time.Now().Unix()
-					if rsyncExitCode != 0 {
-						logger.Warn("A problem with uploading exclude file to the server ( " + exFNfullLocalPath[j] + " to " + exFNfullRemotePath[j] + "), the exit code: " + strconv.Itoa(rsyncExitCode) + ", it means: " + helpers.GetRsyncExitCodeMeaning(rsyncExitCode))
+					rsyncEXfileExitCode := source.ExitCode(err)
+					if rsyncEXfileExitCode != 0 {
+						logger.Warn("A problem with uploading exclude file to the server ( " + exFNfullLocalPath[j] + " to " + source.StateDir + "/" + exFNs[j] + "), the exit code: " + strconv.Itoa(rsyncEXfileExitCode) + ", it means: " + helpers.GetRsyncExitCodeMeaning(rsyncEXfileExitCode) + ", the error: " + err.Error())
 					}
 					metrics.RsyncEXfileStartTime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncEXfileStartTime))
-					metrics.RsyncEXfileExitCode.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncExitCode))
+					metrics.RsyncEXfileExitCode.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncEXfileExitCode))
 					metrics.RsyncEXfileStopTime.With(prometheus.Labels{"path": dTo[j], "stand_name": standName, "pod_name": podName}).Set(float64(rsyncEXfileStopTime))
 				}
 			}
-			logger.Info("Stop downloading files from " + dFromStr + " to " + tmpDirDownloadTo)
-			if err := os.RemoveAll(tmpDirDownloadTo); err != nil {
-				logger.Warn("Couldn't delete tmp dir " + tmpDirDownloadTo + ", the error: " + err.Error())
+		}
+		logger.Info("Stop downloading files from " + dFromStr + " to " + tmpDirDownloadTo)
+		if pullErr != nil {
+			return rsyncExitCode, pullErr
+		}
+		return 0, nil
+	}
+
+	for i, _ := range dFrom {
+		// the exclude file is needed only to sync it with the source
+		var exFN string
+		if cfg.Jobs[i].Options.ExcludeFileSync {
+			var err error
+			if exFN, err = helpers.GetExludeFileName(dFrom[i], dTo[i]); err != nil {
+				logger.Fatal(err.Error())
+			}
+		}
+
+		exFNs = append(exFNs, exFN)
+		exFNfullLocalPath = append(exFNfullLocalPath, "/tmp/"+exFN)
+
+		job, err := s.Cron(cfg.Jobs[i].Cron).Tag(cfg.Jobs[i].Name).SingletonMode().Do(func(j int) {
+			jobName := cfg.Jobs[j].Name
+			trigger, ok := ctl.Start(jobName)
+			if !ok {
+				logger.Info("The job " + jobName + " is paused, the run is skipped")
+				return
+			}
+			if trigger == control.TriggerManual {
+				logger.Info("The job " + jobName + " is run manually")
+			}
+			timeout, _ := time.ParseDuration(cfg.Jobs[j].Options.Timeout)
+			ctx, cancel := context.WithTimeout(runCtx, timeout)
+			// the waits between the retries end when the app stops
+			retryCtx, cancelRetries := context.WithCancel(ctx)
+			stopRetries := context.AfterFunc(stopping, cancelRetries)
+			startedAt := time.Now()
+			var runErr error
+			defer func() {
+				outcome := prom.OutcomeSuccess
+				if runErr != nil {
+					outcome = prom.OutcomeFailure
+				}
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					outcome = prom.OutcomeTimeout
+					msg := "The run of the job " + jobName + " timed out after " + timeout.String()
+					if runErr != nil {
+						msg += ", the error: " + runErr.Error()
+					}
+					runErr = errors.New(msg)
+					logger.Warn(runErr.Error())
+				}
+				stopRetries()
+				cancelRetries()
+				cancel()
+				metrics.Runs.With(prometheus.Labels{"job": jobName, "outcome": outcome, "stand_name": standName, "pod_name": podName}).Inc()
+				metrics.RunDuration.With(prometheus.Labels{"job": jobName, "stand_name": standName, "pod_name": podName}).Observe(time.Since(startedAt).Seconds())
+				ctl.Finish(jobName, runErr)
+			}()
+
+			policy := cfg.Jobs[j].Options.Retry.Policy()
+			sources, err := daySources(cfg.Jobs[j], led, time.Now(), backfillFrom[j])
+			backfillFrom[j] = ""
+			if err != nil {
+				runErr = errors.New("Could not expand the templates of " + dFrom[j] + ", the error: " + err.Error())
+				logger.Warn(runErr.Error())
+				return
+			}
+			// the missed days are pulled in order until the first failure,
+			// the next run starts from it
+			for _, ds := range sources {
+				if stopping.Err() != nil {
+					logger.Info("The app is stopping, the job " + jobName + " will pull the rest of the days on the next start")
+					return
+				}
+				attempts, _, err := retry.Do(retryCtx, policy, func(attempt int) (int, error) {
+					code, err := pull(ctx, j, ds.source)
+					metrics.DownloadAttempts.With(prometheus.Labels{"job": jobName, "exit_code": strconv.Itoa(code), "stand_name": standName, "pod_name": podName}).Inc()
+					return code, err
+				}, func(attempt, code int, delay time.Duration) {
+					logger.Info("The download of the job " + jobName + " failed with the transient exit code " + strconv.Itoa(code) + " (attempt " + strconv.Itoa(attempt) + " of " + strconv.Itoa(policy.Attempts) + "), retrying in " + delay.Round(time.Second).String())
+				})
+				metrics.DownloadLastAttempts.With(prometheus.Labels{"job": jobName, "stand_name": standName, "pod_name": podName}).Set(float64(attempts))
+				if runErr = err; runErr != nil {
+					return
+				}
+				if ds.day == "" {
+					continue
+				}
+				if err := led.SetLastDay(jobName, ds.day); err != nil {
+					logger.Warn(err.Error())
+				}
 			}
 		}, i)
 		if err != nil {
 			logger.Fatal("Something was wrong with rsync cron jobs, the error:" + err.Error())
 		}
+		ctl.Add(s, cfg.Jobs[i], job.NextRun)
 	}
 
-	uniqueDdTo := helpers.GetUniqueSlice(dTo)
-	for _, v := range uniqueDdTo {
-		_, err := s.Cron(os.Getenv("DELETE_CRON")).SingletonMode().Do(func(pathToDir string) {
-			if err = helpers.DeleteFiles(pathToDir); err != nil {
-				logger.Warn("Could not walk through " + pathToDir + ", the error: " + err.Error())
+	for _, cleanup := range cfg.Cleanups() {
+		_, err := s.Cron(cleanup.Cron).SingletonMode().Do(func(cleanup config.Cleanup) {
+			count := func(p string, deleted []helpers.Deletion) {
+				for _, d := range deleted {
+					labels := prometheus.Labels{"path": p, "reason": d.Reason, "stand_name": standName, "pod_name": podName}
+					if d.Archive != "" {
+						metrics.ArchivedFiles.With(labels).Inc()
+						metrics.ArchivedBytes.With(labels).Add(float64(d.Size))
+						continue
+					}
+					metrics.DeletedFiles.With(labels).Inc()
+					metrics.DeletedBytes.With(labels).Add(float64(d.Size))
+				}
+			}
+
+			deleted, err := helpers.DeleteFiles(cleanup.Destination, cleanup.Policy(), cleanup.DryRun)
+			if err != nil {
+				logger.Warn(err.Error())
+			}
+			if !cleanup.DryRun {
+				count(cleanup.Destination, deleted)
+			}
+			// the archive area has its own retention
+			if cleanup.Archive == nil || !helpers.Exists(cleanup.Archive.Dir) {
+				return
+			}
+			deleted, err = helpers.DeleteFiles(cleanup.Archive.Dir, helpers.Retention{OlderThan: cleanup.Archive.OlderThan}, cleanup.DryRun)
+			if err != nil {
+				logger.Warn(err.Error())
+			}
+			if !cleanup.DryRun {
+				count(cleanup.Archive.Dir, deleted)
 			}
-		}, v)
+		}, cleanup)
 		if err != nil {
-			logger.Fatal("Something was wrong with deleting files in " + v + ", the error:" + err.Error())
+			logger.Fatal("Something was wrong with deleting files in " + cleanup.Destination + ", the error:" + err.Error())
 		}
 	}
 
-	s.StartAsync()
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			s.StartAsync()
+			for _, job := range cfg.Jobs {
+				if job.Options.BackfillDays > 0 {
+					if err := s.RunByTag(job.Name); err != nil {
+						logger.Warn("Could not start backfilling of " + job.Name + ", the error: " + err.Error())
+					}
+				}
+			}
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			logger.Info("Stopping the jobs, waiting for the running ones to finish")
+			stop()
+			stopped := make(chan struct{})
+			go func() {
+				// it waits for the running jobs
+				s.Stop()
+				close(stopped)
+			}()
+
+			drain, cancel := context.WithTimeout(ctx, ShutdownTimeout)
+			defer cancel()
+			var err error
+			select {
+			case <-stopped:
+			case <-drain.Done():
+				logger.Warn("The running jobs didn't finish in time, their downloads are canceled")
+				cancelRuns()
+				select {
+				case <-stopped:
+				case <-ctx.Done():
+					err = errors.New("Could not wait for the canceled jobs, the error: " + ctx.Err().Error())
+				}
+			}
+			cancelRuns()
+
+			// the dirs of the jobs which didn't stop
+			tmpDirsMu.Lock()
+			defer tmpDirsMu.Unlock()
+			for dir := range tmpDirs {
+				if errRemove := os.RemoveAll(dir); errRemove != nil {
+					logger.Warn("Couldn't delete tmp dir " + dir + ", the error: " + errRemove.Error())
+				}
+			}
+			logger.Info("The jobs are stopped")
+			return err
+		},
+	})
 }
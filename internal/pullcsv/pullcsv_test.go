@@ -0,0 +1,243 @@
+package pullcsv
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"pullcsv/internal/helpers"
+	"pullcsv/internal/ledger"
+	"pullcsv/internal/logger"
+	"pullcsv/internal/source"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+func provideFX() {
+	fx.New(
+		logger.WithZapLoggerFx(),
+		fx.Invoke(func(logger *zap.Logger) {
+		}),
+	)
+}
+
+// noCounters counts nothing
+var noCounters = counters{
+	decision:    func(ledger.Decision) {},
+	quarantined: func(string) {},
+	rejected:    func(string) {},
+	extracted:   func(int) {},
+}
+
+// regularFiles returns the names of the regular files in dir
+func regularFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDeliverPartial(t *testing.T) {
+	provideFX()
+
+	for _, delivery := range []string{config.DeliveryMove, config.DeliveryAtomic} {
+		src := t.TempDir()
+		for _, name := range []string{"a.csv", "b.csv", "c.csv"} {
+			os.WriteFile(filepath.Join(src, name), []byte(name+";1\n"), 0644)
+		}
+		led, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer led.Close()
+
+		s, err := source.New(context.Background(), src+"/*.csv", source.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// b.csv vanishes after it was listed, so it's not fetched
+		os.Rename(filepath.Join(src, "b.csv"), filepath.Join(src, "b.csv.bak"))
+		tmp := t.TempDir()
+		results, err := s.Fetch(context.Background(), files, tmp)
+		if code := source.ExitCode(err); !partial(code) {
+			t.Fatalf("%s: want a partial exit code, got: %d (%v)", delivery, code, err)
+		}
+		if want, got := []string{"b.csv"}, failedNames(results); !cmp.Equal(want, got) {
+			t.Errorf("%s: want failed: %v, got: %v", delivery, want, got)
+		}
+
+		dTo := t.TempDir() + string(filepath.Separator)
+		job := config.Job{Name: "stocks", Destination: dTo, Options: config.Options{Delivery: delivery, Manifest: true}}
+		if err := deliver(context.Background(), led, fetched{job: job, source: src, dir: tmp, results: results}, noCounters); err != nil {
+			t.Fatalf("%s: want nil, got error: %v", delivery, err)
+		}
+		manifests, _ := filepath.Glob(filepath.Join(dTo, "pullcsv-manifest-stocks-*.json"))
+		if len(manifests) != 1 {
+			t.Fatalf("%s: want the manifest, got: %v", delivery, manifests)
+		}
+		os.Remove(manifests[0])
+		if want, got := []string{"a.csv", "c.csv"}, regularFiles(t, dTo); !cmp.Equal(want, got) {
+			t.Errorf("%s: want delivered: %v, got: %v", delivery, want, got)
+		}
+
+		// the next run downloads only the failed file
+		os.Rename(filepath.Join(src, "b.csv.bak"), filepath.Join(src, "b.csv"))
+		files, err = s.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err = notDownloaded(led, job.Name, job.Options.Dedup, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		if want := []string{"b.csv"}; !cmp.Equal(want, names) {
+			t.Errorf("%s: want to download again: %v, got: %v", delivery, want, names)
+		}
+		s.Close()
+	}
+}
+
+// writeZip writes the zip with files into dir and returns its result
+func writeZip(t *testing.T, dir, name string, files map[string]string) source.Result {
+	t.Helper()
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for member, content := range files {
+		w, err := zw.Create(member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	zw.Close()
+	f.Close()
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source.Result{File: source.File{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}}
+}
+
+func TestDeliverUnpacked(t *testing.T) {
+	provideFX()
+
+	for _, delivery := range []string{config.DeliveryMove, config.DeliveryAtomic} {
+		led, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer led.Close()
+
+		tmp := t.TempDir()
+		// "Привет;1" in windows-1251
+		results := []source.Result{writeZip(t, tmp, "stocks.zip", map[string]string{"stocks.csv": "\xcf\xf0\xe8\xe2\xe5\xf2;1\n"})}
+		dTo := t.TempDir() + string(filepath.Separator)
+		job := config.Job{Name: "stocks", Destination: dTo, Options: config.Options{Delivery: delivery, Encoding: "windows-1251"}}
+		if err := deliver(context.Background(), led, fetched{job: job, dir: tmp, results: results}, noCounters); err != nil {
+			t.Fatalf("%s: want nil, got error: %v", delivery, err)
+		}
+		files := regularFiles(t, dTo)
+		if len(files) != 1 {
+			t.Fatalf("%s: want the unpacked file, got: %v", delivery, files)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dTo, files[0])); string(got) != "Привет;1\n" {
+			t.Errorf("%s: want the unpacked file converted to UTF-8, got: %q", delivery, got)
+		}
+	}
+}
+
+func TestDeliverSchema(t *testing.T) {
+	provideFX()
+
+	for _, delivery := range []string{config.DeliveryMove, config.DeliveryAtomic} {
+		led, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer led.Close()
+
+		tmp := t.TempDir()
+		os.WriteFile(filepath.Join(tmp, "bad.csv"), []byte("a;1;2\n"), 0644)
+		fi, _ := os.Stat(filepath.Join(tmp, "bad.csv"))
+		results := []source.Result{
+			{File: source.File{Name: "bad.csv", Size: fi.Size(), ModTime: fi.ModTime()}},
+			writeZip(t, tmp, "stocks.zip", map[string]string{"good.csv": "a;1\n", "wide.csv": "a;1;2\n"}),
+		}
+		dTo := t.TempDir() + string(filepath.Separator)
+		quarantine := t.TempDir()
+		opts := config.Options{
+			Delivery: delivery,
+			Archives: helpers.ArchiveOptions{Policy: helpers.PolicyExtractAndKeep, Naming: helpers.NamingOriginal},
+			Manifest: true,
+			Schema:   &config.Schema{Files: "*.csv", Delimiter: ";", Columns: 2, Quarantine: quarantine},
+		}
+		job := config.Job{Name: "stocks", Destination: dTo, Options: opts}
+		if err := deliver(context.Background(), led, fetched{job: job, dir: tmp, results: results}, noCounters); err != nil {
+			t.Fatalf("%s: want nil, got error: %v", delivery, err)
+		}
+
+		// the kept archive is delivered as it is
+		manifests, _ := filepath.Glob(filepath.Join(dTo, "pullcsv-manifest-stocks-*.json"))
+		for _, m := range manifests {
+			os.Remove(m)
+		}
+		if want, got := []string{"good.csv", "stocks.zip"}, regularFiles(t, dTo); !cmp.Equal(want, got) {
+			t.Errorf("%s: want delivered: %v, got: %v", delivery, want, got)
+		}
+		if want, got := []string{"bad.csv", "wide.csv"}, regularFiles(t, quarantine); !cmp.Equal(want, got) {
+			t.Errorf("%s: want quarantined: %v, got: %v", delivery, want, got)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+
+	if want, got := 0, exitCode(context.Background(), nil); want != got {
+		t.Errorf("want: %d, got: %d", want, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if want, got := runTimeoutExitCode, exitCode(ctx, ctx.Err()); want != got {
+		t.Errorf("timed out: want: %d, got: %d", want, got)
+	}
+	if want, got := 0, exitCode(ctx, nil); want != got {
+		t.Errorf("timed out without error: want: %d, got: %d", want, got)
+	}
+
+	// the stop of the app is not the run's timeout
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if want, got := 30, exitCode(ctx, ctx.Err()); want != got {
+		t.Errorf("canceled: want: %d, got: %d", want, got)
+	}
+}
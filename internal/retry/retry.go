@@ -0,0 +1,75 @@
+// Package retry retries the downloads failed with the transient rsync
+// exit codes within the run, so the feed doesn't wait for the next cron tick
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// DefaultExitCodes are the transient failures: socket I/O, protocol data stream,
+// timeout in data send/receive and timeout waiting for the daemon connection
+var DefaultExitCodes = []int{10, 12, 30, 35}
+
+// Policy is the job's retry policy
+type Policy struct {
+	// Attempts is the max number of attempts, 1 not to retry
+	Attempts int
+	// Backoff is the delay before the first retry, it doubles with every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// ExitCodes are the retryable exit codes
+	ExitCodes []int
+}
+
+// Retryable reports whether the failure with the exit code is retried
+func (p Policy) Retryable(code int) bool {
+	for _, c := range p.ExitCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the delay before the retry after the attempt (from 1):
+// Backoff*2^(attempt-1) up to MaxBackoff, randomly shortened by up to a half,
+// so the pods don't retry all at once
+func (p Policy) Delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Do calls fn until it succeeds, fails with a non-retryable exit code or
+// the attempts are over, waiting between the attempts. retrying is called
+// before every wait. It doesn't retry when ctx is done.
+// It returns the number of attempts and the result of the last one
+func Do(ctx context.Context, p Policy, fn func(attempt int) (code int, err error), retrying func(attempt, code int, delay time.Duration)) (attempts, code int, err error) {
+	for attempts = 1; ; attempts++ {
+		code, err = fn(attempts)
+		if err == nil || attempts >= p.Attempts || !p.Retryable(code) || ctx.Err() != nil {
+			return attempts, code, err
+		}
+		delay := p.Delay(attempts)
+		if retrying != nil {
+			retrying(attempts, code, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempts, code, err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"pullcsv/internal/retry"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	t.Parallel()
+
+	p := retry.Policy{Backoff: 10 * time.Second, MaxBackoff: time.Minute}
+	for i, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: 10 * time.Second},
+		{attempt: 2, max: 20 * time.Second},
+		{attempt: 3, max: 40 * time.Second},
+		{attempt: 4, max: time.Minute},
+		{attempt: 100, max: time.Minute},
+	} {
+		for range 20 {
+			if got := p.Delay(tc.attempt); got < tc.max/2 || got > tc.max {
+				t.Fatalf("Case %d: want a delay from %s to %s, got: %s", i, tc.max/2, tc.max, got)
+			}
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	t.Parallel()
+
+	p := retry.Policy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, ExitCodes: retry.DefaultExitCodes}
+	failed := errors.New("failed")
+
+	type testCase struct {
+		codes        []int
+		wantAttempts int
+		wantCode     int
+		wantErr      bool
+	}
+
+	testCases := []testCase{
+		{codes: []int{0}, wantAttempts: 1},
+		{codes: []int{12, 30, 0}, wantAttempts: 3},
+		{codes: []int{10, 35, 12}, wantAttempts: 3, wantCode: 12, wantErr: true},
+		// not a transient failure
+		{codes: []int{23, 0}, wantAttempts: 1, wantCode: 23, wantErr: true},
+		{codes: []int{12, 5, 0}, wantAttempts: 2, wantCode: 5, wantErr: true},
+	}
+
+	for i, tc := range testCases {
+		var retried []int
+		attempts, code, err := retry.Do(context.Background(), p, func(attempt int) (int, error) {
+			if c := tc.codes[attempt-1]; c != 0 {
+				return c, failed
+			}
+			return 0, nil
+		}, func(attempt, code int, delay time.Duration) {
+			retried = append(retried, code)
+		})
+		if attempts != tc.wantAttempts || code != tc.wantCode || (err != nil) != tc.wantErr {
+			t.Errorf("Case %d, want: %d attempts, code %d, error %v, got: %d, %d, %v", i, tc.wantAttempts, tc.wantCode, tc.wantErr, attempts, code, err)
+		}
+		if len(retried) != attempts-1 {
+			t.Errorf("Case %d: want %d retries, got: %v", i, attempts-1, retried)
+		}
+	}
+
+	// the canceled run is not retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts, _, err := retry.Do(ctx, p, func(int) (int, error) { return 30, failed }, nil)
+	if attempts != 1 || err == nil {
+		t.Errorf("want 1 failed attempt, got: %d, %v", attempts, err)
+	}
+}
@@ -0,0 +1,98 @@
+package rsync
+
+import (
+	"encoding/binary"
+	"hash"
+	"math"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	// sumLength is the length of the strong (MD4) checksums
+	sumLength    = 16
+	minBlockSize = 700
+	maxBlockSize = 1 << 17
+	// oldMaxBlockSize is the largest block before protocol 30, the daemon
+	// aborts with "Invalid block length" on a larger one
+	oldMaxBlockSize = 1 << 13
+	chunkSize       = 32 * 1024
+)
+
+// sumHead describes the block checksums of the basis file
+type sumHead struct {
+	count     int32
+	blength   int32
+	s2length  int32
+	remainder int32
+}
+
+// newSumHead chooses the block size the same way rsync does: the square
+// root of the file size, but not less than 700 bytes and not more than
+// the maximum of the protocol
+func newSumHead(size int64, protocol int) sumHead {
+	if size <= 0 {
+		return sumHead{}
+	}
+
+	blength := int64(minBlockSize)
+	if size > minBlockSize*minBlockSize {
+		blength = int64(math.Sqrt(float64(size))) &^ 7
+		maxBlength := int64(maxBlockSize)
+		if protocol < 30 {
+			maxBlength = oldMaxBlockSize
+		}
+		if blength > maxBlength {
+			blength = maxBlength
+		}
+	}
+
+	return sumHead{
+		count:     int32((size + blength - 1) / blength),
+		blength:   int32(blength),
+		s2length:  sumLength,
+		remainder: int32(size % blength),
+	}
+}
+
+// blockLen returns the length of the i-th block
+func (sh sumHead) blockLen(i int32) int32 {
+	if i == sh.count-1 && sh.remainder != 0 {
+		return sh.remainder
+	}
+	return sh.blength
+}
+
+// checksum1 is the rsync rolling checksum. The bytes are signed
+// as they are in the C implementation
+func checksum1(b []byte) uint32 {
+	var s1, s2 uint32
+	for _, c := range b {
+		s1 += uint32(int8(c))
+		s2 += s1
+	}
+	return s1&0xffff | s2<<16
+}
+
+// checksum2 is the strong block checksum: MD4 of the block
+// followed by the checksum seed (protocol < 30)
+func checksum2(b []byte, seed int32) []byte {
+	h := md4.New()
+	h.Write(b)
+	if seed != 0 {
+		var s [4]byte
+		binary.LittleEndian.PutUint32(s[:], uint32(seed))
+		h.Write(s[:])
+	}
+	return h.Sum(nil)
+}
+
+// newFileHash returns the whole-file checksum: MD4 of the checksum seed
+// followed by the file data (protocol < 30)
+func newFileHash(seed int32) hash.Hash {
+	h := md4.New()
+	var s [4]byte
+	binary.LittleEndian.PutUint32(s[:], uint32(seed))
+	h.Write(s[:])
+	return h
+}
@@ -0,0 +1,413 @@
+package rsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	// protocolVersion is the rsync protocol spoken by the client,
+	// supported by rsync daemons from 2.6.4 to 3.x
+	protocolVersion = 29
+	defaultPort     = "873"
+
+	mplexBase    = 7
+	msgData      = 0
+	msgErrorXfer = 1
+	msgInfo      = 2
+	msgError     = 3
+	msgWarning   = 4
+
+	ndxDone              = -1
+	itemBasisTypeFollows = 1 << 11
+	itemXnameFollows     = 1 << 12
+	itemTransfer         = 1 << 15
+
+	// maxPhase is the number of phases after the first one for protocol >= 29
+	maxPhase = 2
+)
+
+// deadlineConn sets the IO timeout before every Read and Write,
+// so a hung daemon doesn't block the transfer forever
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (dc *deadlineConn) Read(p []byte) (int, error) {
+	if dc.timeout > 0 {
+		dc.Conn.SetReadDeadline(time.Now().Add(dc.timeout))
+	}
+	return dc.Conn.Read(p)
+}
+
+func (dc *deadlineConn) Write(p []byte) (int, error) {
+	if dc.timeout > 0 {
+		dc.Conn.SetWriteDeadline(time.Now().Add(dc.timeout))
+	}
+	return dc.Conn.Write(p)
+}
+
+// conn is a connection to the rsync daemon. After the handshake everything
+// the daemon sends is multiplexed, the client side is not (protocol < 30)
+type conn struct {
+	nc       net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	protocol int
+	seed     int32
+
+	mplexIn   bool
+	remaining int
+
+	mu       sync.Mutex
+	errors   []string
+	warnings []string
+
+	ctx       context.Context
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func dial(ctx context.Context, u *URL, timeout time.Duration) (*conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", u.Addr())
+	if err != nil {
+		return nil, &Error{Code: 10, Msg: "Could not connect to " + u.Addr() + ", the error: " + err.Error(), Err: err}
+	}
+
+	dc := &deadlineConn{Conn: nc, timeout: timeout}
+	c := &conn{
+		nc:   nc,
+		r:    bufio.NewReader(dc),
+		w:    bufio.NewWriter(dc),
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+	// closing the connection unblocks any Read or Write when ctx is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-c.done:
+		}
+	}()
+
+	line, err := c.readLine()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "@RSYNCD: ") {
+		c.Close()
+		return nil, &Error{Code: 5, Msg: "Unexpected greeting from " + u.Addr() + ": " + line}
+	}
+	version := strings.TrimPrefix(line, "@RSYNCD: ")
+	if i := strings.IndexAny(version, ". "); i >= 0 {
+		version = version[:i]
+	}
+	remote, err := strconv.Atoi(version)
+	if err != nil {
+		c.Close()
+		return nil, &Error{Code: 5, Msg: "Could not parse the protocol version from " + u.Addr() + ": " + line}
+	}
+	if remote < protocolVersion {
+		c.Close()
+		return nil, &Error{Code: 2, Msg: "The rsync daemon " + u.Addr() + " speaks too old protocol " + version}
+	}
+	c.protocol = protocolVersion
+
+	if err := c.writeLine("@RSYNCD: " + strconv.Itoa(protocolVersion)); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *conn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.nc.Close()
+	})
+	return err
+}
+
+// err converts a network error into the context error if the connection
+// was closed because of ctx
+func (c *conn) err(err error) error {
+	if ctxErr := c.ctx.Err(); ctxErr != nil {
+		return &Error{Code: 30, Msg: "The transfer was interrupted: " + ctxErr.Error(), Err: ctxErr}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return &Error{Code: 30, Msg: "Timeout in data send/receive: " + err.Error(), Err: err}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		msg := "The connection was closed by the rsync daemon"
+		if errs := c.serverErrors(); len(errs) > 0 {
+			msg += ": " + strings.Join(errs, "; ")
+		}
+		return &Error{Code: 12, Msg: msg, Err: err}
+	}
+	return &Error{Code: 10, Msg: "Error in socket I/O: " + err.Error(), Err: err}
+}
+
+func (c *conn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", c.err(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *conn) writeLine(line string) error {
+	if _, err := c.w.WriteString(line + "\n"); err != nil {
+		return c.err(err)
+	}
+	return c.flush()
+}
+
+func (c *conn) flush() error {
+	if err := c.w.Flush(); err != nil {
+		return c.err(err)
+	}
+	return nil
+}
+
+// selectModule asks the daemon for the module and authenticates if needed
+func (c *conn) selectModule(module, user, password string) error {
+	if err := c.writeLine(module); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "@RSYNCD: OK":
+			return nil
+		case strings.HasPrefix(line, "@RSYNCD: AUTHREQD "):
+			challenge := strings.TrimPrefix(line, "@RSYNCD: AUTHREQD ")
+			if err := c.writeLine(user + " " + authResponse(password, challenge)); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "@ERROR"):
+			return &Error{Code: 5, Msg: "The rsync daemon refused module " + module + ": " + line}
+		case line == "@RSYNCD: EXIT":
+			return &Error{Code: 5, Msg: "The rsync daemon closed the session for module " + module}
+		}
+		// everything else is the MOTD
+	}
+}
+
+// authResponse is the MD4 digest of the password and the challenge
+// (prefixed by the zero checksum seed for protocol < 30)
+func authResponse(password, challenge string) string {
+	h := md4.New()
+	h.Write([]byte{0, 0, 0, 0})
+	h.Write([]byte(password))
+	h.Write([]byte(challenge))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// start sends the server args and reads the checksum seed, after that
+// the daemon's output is multiplexed
+func (c *conn) start(args []string) error {
+	for _, arg := range args {
+		if _, err := c.w.WriteString(arg + "\n"); err != nil {
+			return c.err(err)
+		}
+	}
+	if err := c.writeLine(""); err != nil {
+		return err
+	}
+
+	seed, err := c.readInt()
+	if err != nil {
+		return err
+	}
+	c.seed = seed
+	c.mplexIn = true
+
+	return nil
+}
+
+// Read reads the MSG_DATA payload of the multiplexed stream, saving
+// the daemon's errors and warnings on the way
+func (c *conn) Read(p []byte) (int, error) {
+	if !c.mplexIn {
+		return c.r.Read(p)
+	}
+
+	for c.remaining == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return 0, err
+		}
+		h := binary.LittleEndian.Uint32(header[:])
+		tag := int(h>>24) - mplexBase
+		length := int(h & 0xffffff)
+		if tag == msgData {
+			c.remaining = length
+			continue
+		}
+		if tag < 0 {
+			return 0, &Error{Code: 12, Msg: "Unexpected tag " + strconv.Itoa(tag+mplexBase) + " in the multiplexed stream"}
+		}
+
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(c.r, msg); err != nil {
+			return 0, err
+		}
+		text := strings.TrimRight(string(msg), "\n")
+		c.mu.Lock()
+		switch tag {
+		case msgError, msgErrorXfer:
+			c.errors = append(c.errors, text)
+		case msgWarning, msgInfo:
+			c.warnings = append(c.warnings, text)
+		}
+		c.mu.Unlock()
+	}
+
+	if len(p) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= n
+	return n, err
+}
+
+func (c *conn) serverErrors() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.errors...)
+}
+
+func (c *conn) serverWarnings() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.warnings...)
+}
+
+func (c *conn) readFull(p []byte) error {
+	if _, err := io.ReadFull(c, p); err != nil {
+		var re *Error
+		if errors.As(err, &re) {
+			return err
+		}
+		return c.err(err)
+	}
+	return nil
+}
+
+func (c *conn) readByte() (byte, error) {
+	var b [1]byte
+	err := c.readFull(b[:])
+	return b[0], err
+}
+
+func (c *conn) readShort() (uint16, error) {
+	var b [2]byte
+	err := c.readFull(b[:])
+	return binary.LittleEndian.Uint16(b[:]), err
+}
+
+func (c *conn) readInt() (int32, error) {
+	var b [4]byte
+	err := c.readFull(b[:])
+	return int32(binary.LittleEndian.Uint32(b[:])), err
+}
+
+// readLongint reads int32 or, if it's -1, the following int64 (protocol < 30)
+func (c *conn) readLongint() (int64, error) {
+	n, err := c.readInt()
+	if err != nil || n != -1 {
+		return int64(n), err
+	}
+	var b [8]byte
+	err = c.readFull(b[:])
+	return int64(binary.LittleEndian.Uint64(b[:])), err
+}
+
+func (c *conn) readVstring() (string, error) {
+	l, err := c.readByte()
+	if err != nil {
+		return "", err
+	}
+	length := int(l)
+	if length&0x80 != 0 {
+		l2, err := c.readByte()
+		if err != nil {
+			return "", err
+		}
+		length = (length&^0x80)*0x100 + int(l2)
+	}
+	b := make([]byte, length)
+	err = c.readFull(b)
+	return string(b), err
+}
+
+func (c *conn) write(p []byte) error {
+	if _, err := c.w.Write(p); err != nil {
+		return c.err(err)
+	}
+	return nil
+}
+
+func (c *conn) writeByte(v byte) error {
+	return c.write([]byte{v})
+}
+
+func (c *conn) writeShort(v uint16) error {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], v)
+	return c.write(b[:])
+}
+
+func (c *conn) writeInt(v int32) error {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	return c.write(b[:])
+}
+
+func (c *conn) writeLongint(v int64) error {
+	if v >= 0 && v <= 0x7fffffff {
+		return c.writeInt(int32(v))
+	}
+	if err := c.writeInt(-1); err != nil {
+		return err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	return c.write(b[:])
+}
+
+func (c *conn) writeVstring(s string) error {
+	if len(s) > 0x7fff {
+		return &Error{Code: 1, Msg: "The string is too long to send: " + s[:64] + "..."}
+	}
+	if len(s) > 0x7f {
+		if err := c.writeByte(byte(len(s)/0x100) | 0x80); err != nil {
+			return err
+		}
+	}
+	if err := c.writeByte(byte(len(s))); err != nil {
+		return err
+	}
+	return c.write([]byte(s))
+}
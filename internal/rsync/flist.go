@@ -0,0 +1,287 @@
+package rsync
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	xmitTopDir        = 1 << 0
+	xmitSameMode      = 1 << 1
+	xmitExtendedFlags = 1 << 2
+	xmitSameName      = 1 << 5
+	xmitLongName      = 1 << 6
+	xmitSameTime      = 1 << 7
+
+	sIFMT  = 0170000
+	sIFDIR = 0040000
+	sIFREG = 0100000
+)
+
+// File is an entry of the file list sent by the rsync daemon
+type File struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Mode    uint32
+}
+
+func (f File) IsDir() bool {
+	return f.Mode&sIFMT == sIFDIR
+}
+
+func (f File) IsRegular() bool {
+	return f.Mode&sIFMT == sIFREG
+}
+
+// readFileList reads the file list (protocol 29 without uid/gid, devices,
+// links and checksums, the client never asks for them) and sorts it the way
+// the daemon does, so the indexes of the files match
+func (c *conn) readFileList() ([]File, error) {
+	var (
+		files    []File
+		prevName string
+		prevMode uint32
+		prevTime int64
+	)
+
+	for {
+		b, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		flags := int(b)
+		if flags == 0 {
+			break
+		}
+		if flags&xmitExtendedFlags != 0 {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			flags |= int(b) << 8
+		}
+
+		var l1, l2 int
+		if flags&xmitSameName != 0 {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			l1 = int(b)
+		}
+		if flags&xmitLongName != 0 {
+			n, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			l2 = int(n)
+		} else {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			l2 = int(b)
+		}
+		if l1 > len(prevName) || l2 < 0 || l2 > 4096 {
+			return nil, &Error{Code: 12, Msg: "Invalid file name length in the file list: " + strconv.Itoa(l1) + "+" + strconv.Itoa(l2)}
+		}
+		suffix := make([]byte, l2)
+		if err := c.readFull(suffix); err != nil {
+			return nil, err
+		}
+		name := prevName[:l1] + string(suffix)
+
+		size, err := c.readLongint()
+		if err != nil {
+			return nil, err
+		}
+		modTime := prevTime
+		if flags&xmitSameTime == 0 {
+			t, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			modTime = int64(t)
+		}
+		mode := prevMode
+		if flags&xmitSameMode == 0 {
+			m, err := c.readInt()
+			if err != nil {
+				return nil, err
+			}
+			mode = uint32(m)
+		}
+
+		files = append(files, File{Name: name, Size: size, ModTime: time.Unix(modTime, 0), Mode: mode})
+		prevName, prevMode, prevTime = name, mode, modTime
+	}
+
+	// io_error is sent after the file list for protocol < 30
+	if _, err := c.readInt(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return fileNameCmp(files[i], files[j]) < 0
+	})
+
+	return files, nil
+}
+
+// writeFile sends the file list of the single file f
+func (c *conn) writeFile(f File) error {
+	if err := c.writeByte(xmitLongName); err != nil {
+		return err
+	}
+	if err := c.writeInt(int32(len(f.Name))); err != nil {
+		return err
+	}
+	if err := c.write([]byte(f.Name)); err != nil {
+		return err
+	}
+	if err := c.writeLongint(f.Size); err != nil {
+		return err
+	}
+	if err := c.writeInt(int32(f.ModTime.Unix())); err != nil {
+		return err
+	}
+	if err := c.writeInt(int32(f.Mode)); err != nil {
+		return err
+	}
+	// the end of the list and io_error
+	if err := c.writeByte(0); err != nil {
+		return err
+	}
+	return c.writeInt(0)
+}
+
+type fncState int
+
+const (
+	sDir fncState = iota
+	sSlash
+	sBase
+	sTrailing
+)
+
+type fncType int
+
+const (
+	tPath fncType = iota
+	tItem
+)
+
+// fileNameCmp is f_name_cmp from rsync's flist.c (protocol >= 29):
+// the files of a directory go before its subdirectories
+func fileNameCmp(f1, f2 File) int {
+	dir1, base1 := splitName(f1.Name)
+	dir2, base2 := splitName(f2.Name)
+	if dir1 == dir2 {
+		dir1, dir2 = "", ""
+	}
+
+	baseState := func(f File, base string) (string, fncState, fncType) {
+		if !f.IsDir() {
+			return base, sBase, tItem
+		}
+		if base == "." {
+			return "", sTrailing, tItem
+		}
+		return base, sBase, tPath
+	}
+
+	var (
+		c1, c2         string
+		state1, state2 fncState
+		type1, type2   fncType
+	)
+	if dir1 == "" {
+		c1, state1, type1 = baseState(f1, base1)
+	} else {
+		c1, state1, type1 = dir1, sDir, tPath
+	}
+	if dir2 == "" {
+		c2, state2, type2 = baseState(f2, base2)
+	} else {
+		c2, state2, type2 = dir2, sDir, tPath
+	}
+
+	typeCmp := func() int {
+		if type1 == tPath {
+			return 1
+		}
+		return -1
+	}
+
+	if type1 != type2 {
+		return typeCmp()
+	}
+
+	for {
+		if c1 == "" {
+			switch state1 {
+			case sDir:
+				state1, c1 = sSlash, "/"
+			case sSlash:
+				c1, state1, type1 = baseState(f1, base1)
+			case sBase:
+				state1 = sTrailing
+				if type1 == tPath {
+					c1 = "/"
+				} else {
+					type1 = tItem
+				}
+			case sTrailing:
+				type1 = tItem
+			}
+			if c2 != "" && type1 != type2 {
+				return typeCmp()
+			}
+		}
+		if c2 == "" {
+			switch state2 {
+			case sDir:
+				state2, c2 = sSlash, "/"
+			case sSlash:
+				c2, state2, type2 = baseState(f2, base2)
+			case sBase:
+				state2 = sTrailing
+				if type2 == tPath {
+					c2 = "/"
+				} else {
+					type2 = tItem
+				}
+			case sTrailing:
+				if c1 == "" {
+					return 0
+				}
+				type2 = tItem
+			}
+			if type1 != type2 {
+				return typeCmp()
+			}
+		}
+
+		var ch1, ch2 int
+		if c1 != "" {
+			ch1, c1 = int(c1[0]), c1[1:]
+		}
+		if c2 != "" {
+			ch2, c2 = int(c2[0]), c2[1:]
+		}
+		if dif := ch1 - ch2; dif != 0 {
+			return dif
+		}
+	}
+}
+
+func splitName(name string) (dir, base string) {
+	dir, base = path.Split(name)
+	if dir != "" && dir != "/" {
+		dir = dir[:len(dir)-1]
+	}
+	return dir, base
+}
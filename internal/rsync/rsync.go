@@ -0,0 +1,892 @@
+// Package rsync is a client of the rsync daemon (rsync://) protocol,
+// so pullcsv doesn't need the rsync binary
+package rsync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultTimeout = 5 * time.Minute
+
+// URL is a parsed rsync://[USER@]HOST[:PORT]/MODULE/PATH
+type URL struct {
+	User   string
+	Host   string
+	Port   string
+	Module string
+	Path   string
+}
+
+// ParseURL parses rsync URL. net/url is not used on purpose: the path
+// is a glob and may contain '?', '#' and '%'
+func ParseURL(s string) (*URL, error) {
+	if !strings.HasPrefix(s, "rsync://") {
+		return nil, errors.New("The URL " + s + " doesn't start with rsync://")
+	}
+	rest := strings.TrimPrefix(s, "rsync://")
+
+	u := &URL{}
+	hostPart, pathPart, _ := strings.Cut(rest, "/")
+	if i := strings.LastIndex(hostPart, "@"); i >= 0 {
+		u.User, hostPart = hostPart[:i], hostPart[i+1:]
+	}
+	host, port, err := net.SplitHostPort(hostPart)
+	if err != nil {
+		host, port = hostPart, defaultPort
+	}
+	if host == "" {
+		return nil, errors.New("The URL " + s + " has no host")
+	}
+	u.Host, u.Port = host, port
+	u.Module, u.Path, _ = strings.Cut(pathPart, "/")
+
+	return u, nil
+}
+
+func (u *URL) Addr() string {
+	return net.JoinHostPort(u.Host, u.Port)
+}
+
+// String returns the URL without the user
+func (u *URL) String() string {
+	s := "rsync://" + u.Addr() + "/" + u.Module
+	if u.Path != "" {
+		s += "/" + u.Path
+	}
+	return s
+}
+
+// Error is an rsync error with the exit code the rsync binary
+// would have returned (see helpers.GetRsyncExitCodeMeaning)
+type Error struct {
+	Code int
+	Msg  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns rsync exit code for err, 0 for nil
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var re *Error
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return 30
+	}
+	return 12
+}
+
+// Client talks to rsync daemons
+type Client struct {
+	// Password is used if the module requires authentication,
+	// the user is taken from the URL
+	Password string
+	// Timeout is the IO timeout, DefaultTimeout if zero
+	Timeout time.Duration
+}
+
+// Module is an rsync daemon module
+type Module struct {
+	Name    string
+	Comment string
+}
+
+// Result is the result of a single file transfer
+type Result struct {
+	File
+	// Literal is the number of bytes transferred, Matched - reused from the basis file
+	Literal int64
+	Matched int64
+	Err     error
+}
+
+// DownloadOptions tunes Download
+type DownloadOptions struct {
+	// Excludes are the exclude patterns, applied by the daemon
+	Excludes []string
+	// PartialDir keeps the partially downloaded files to resume them
+	// next time. Partial files are not kept if it's empty
+	PartialDir string
+	// Filter selects the files to download from the daemon's file list,
+	// all of them are downloaded if it's nil
+	Filter func(File) bool
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+func (c *Client) open(ctx context.Context, u *URL) (*conn, error) {
+	cn, err := dial(ctx, u, c.timeout())
+	if err != nil {
+		return nil, err
+	}
+	if err := cn.selectModule(u.Module, u.User, c.Password); err != nil {
+		cn.Close()
+		return nil, err
+	}
+	return cn, nil
+}
+
+// ListModules returns the modules of the daemon at rawURL (rsync://HOST[:PORT]/)
+func (c *Client) ListModules(ctx context.Context, rawURL string) ([]Module, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, &Error{Code: 1, Msg: err.Error()}
+	}
+	cn, err := dial(ctx, u, c.timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+
+	if err := cn.writeLine("#list"); err != nil {
+		return nil, err
+	}
+
+	var modules []Module
+	for {
+		line, err := cn.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "@RSYNCD: EXIT" {
+			return modules, nil
+		}
+		if strings.HasPrefix(line, "@ERROR") {
+			return nil, &Error{Code: 5, Msg: "The rsync daemon refused to list modules: " + line}
+		}
+		// modules are "name\tcomment", everything else is the MOTD
+		name, comment, found := strings.Cut(line, "\t")
+		if !found {
+			continue
+		}
+		modules = append(modules, Module{Name: strings.TrimSpace(name), Comment: strings.TrimSpace(comment)})
+	}
+}
+
+// List returns the regular files matching rawURL (rsync://[USER@]HOST[:PORT]/MODULE/PATH)
+// without downloading them
+func (c *Client) List(ctx context.Context, rawURL string) ([]File, error) {
+	var files []File
+	_, err := c.Download(ctx, rawURL, "", DownloadOptions{Filter: func(f File) bool {
+		files = append(files, f)
+		return false
+	}})
+	return files, err
+}
+
+// Download downloads the files matching rawURL (rsync://[USER@]HOST[:PORT]/MODULE/PATH,
+// PATH may be a glob or a directory with the trailing slash) into dstDir.
+// It returns the result of every requested file. The error is
+// an *Error if the transfer or some of the files failed
+func (c *Client) Download(ctx context.Context, rawURL, dstDir string, opts DownloadOptions) ([]Result, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, &Error{Code: 1, Msg: err.Error()}
+	}
+	cn, err := c.open(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer cn.Close()
+
+	// -d transfers a directory's content without recursion, -t sends mtimes
+	if err := cn.start([]string{"--server", "--sender", "-dt", ".", u.Module + "/" + u.Path}); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range opts.Excludes {
+		rule := "- " + pattern
+		if err := cn.writeInt(int32(len(rule))); err != nil {
+			return nil, err
+		}
+		if err := cn.write([]byte(rule)); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.writeInt(0); err != nil {
+		return nil, err
+	}
+	if err := cn.flush(); err != nil {
+		return nil, err
+	}
+
+	files, err := cn.readFileList()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &download{
+		cn:         cn,
+		files:      files,
+		dstDir:     dstDir,
+		partialDir: opts.PartialDir,
+		filter:     opts.Filter,
+		results:    make(map[int32]*Result),
+		received:   make(map[int32]bool),
+		phases:     make(chan []int32, maxPhase+1),
+	}
+	return d.run()
+}
+
+type download struct {
+	cn         *conn
+	files      []File
+	dstDir     string
+	partialDir string
+	filter     func(File) bool
+
+	mu      sync.Mutex
+	results map[int32]*Result
+	// received are the files the daemon sent, the rest are failed at the end
+	received map[int32]bool
+	order    []int32
+	redo     []int32
+	phases   chan []int32
+	err      error
+}
+
+// fail saves the first error of the generator or the receiver and closes
+// the connection, so the other one doesn't wait for the daemon forever
+func (d *download) fail(err error) {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.mu.Unlock()
+	d.cn.Close()
+}
+
+// run is the generator and the receiver of rsync: the generator goroutine
+// sends the block checksums of the basis files, the receiver reads
+// the files back. They must work concurrently since the daemon skips
+// the files that vanished without telling the client (protocol < 30)
+func (d *download) run() ([]Result, error) {
+	genDone := make(chan struct{})
+	go func() {
+		defer close(genDone)
+		if err := d.generate(); err != nil {
+			d.fail(err)
+		}
+	}()
+
+	if err := d.receive(); err != nil {
+		d.fail(err)
+		// unblock the generator waiting for the next phase
+		close(d.phases)
+	}
+	<-genDone
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var results []Result
+	failed, missing := 0, 0
+	for _, ndx := range d.order {
+		result := d.results[ndx]
+		if result.Err != nil {
+			failed++
+		} else if !d.received[ndx] {
+			// the daemon couldn't open it or it vanished, or the transfer was interrupted
+			result.Err = errors.New("The daemon didn't send the file " + result.Name)
+			missing++
+		}
+		results = append(results, *result)
+	}
+
+	if d.err != nil {
+		return results, d.err
+	}
+	if errs := d.cn.serverErrors(); len(errs) > 0 {
+		return results, &Error{Code: 23, Msg: "Partial transfer due to error: " + strings.Join(errs, "; ")}
+	}
+	if failed > 0 {
+		return results, &Error{Code: 23, Msg: "Partial transfer due to error: " + strconv.Itoa(failed) + " file(s) failed"}
+	}
+	for _, w := range d.cn.serverWarnings() {
+		if strings.Contains(w, "vanished") {
+			return results, &Error{Code: 24, Msg: "Partial transfer due to vanished source files: " + w}
+		}
+	}
+	if missing > 0 {
+		return results, &Error{Code: 23, Msg: "Partial transfer due to error: " + strconv.Itoa(missing) + " file(s) were not sent"}
+	}
+
+	return results, nil
+}
+
+func (d *download) generate() error {
+	cn := d.cn
+	for i, f := range d.files {
+		if !f.IsRegular() || (d.filter != nil && !d.filter(f)) {
+			continue
+		}
+		ndx := int32(i)
+		d.mu.Lock()
+		d.results[ndx] = &Result{File: f}
+		d.order = append(d.order, ndx)
+		d.mu.Unlock()
+
+		if err := d.request(ndx, d.basisPath(f)); err != nil {
+			return err
+		}
+	}
+	if err := cn.writeInt(ndxDone); err != nil {
+		return err
+	}
+	if err := cn.flush(); err != nil {
+		return err
+	}
+
+	// phase 1 re-requests the files whose checksum didn't match as whole files,
+	// phase 2 is empty, and the last ndxDone is the goodbye
+	for phase := 1; phase <= maxPhase+1; phase++ {
+		redo, ok := <-d.phases
+		if !ok {
+			return nil
+		}
+		for _, ndx := range redo {
+			if err := d.request(ndx, ""); err != nil {
+				return err
+			}
+		}
+		if err := cn.writeInt(ndxDone); err != nil {
+			return err
+		}
+		if err := cn.flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// basisPath returns the existing local file to build the new one from:
+// the partial file of the previous download or the file in dstDir
+func (d *download) basisPath(f File) string {
+	name := filepath.FromSlash(f.Name)
+	if d.partialDir != "" {
+		if p := filepath.Join(d.partialDir, name); isRegular(p) {
+			return p
+		}
+	}
+	if p := filepath.Join(d.dstDir, name); isRegular(p) {
+		return p
+	}
+	return ""
+}
+
+func isRegular(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// request asks the daemon for the file ndx sending the block checksums
+// of basis, the whole file is requested if basis is empty
+func (d *download) request(ndx int32, basis string) error {
+	cn := d.cn
+	if err := cn.writeInt(ndx); err != nil {
+		return err
+	}
+	if err := cn.writeShort(itemTransfer); err != nil {
+		return err
+	}
+
+	var sh sumHead
+	var bf *os.File
+	if basis != "" {
+		var err error
+		if bf, err = os.Open(basis); err == nil {
+			defer bf.Close()
+			if fi, err := bf.Stat(); err == nil {
+				sh = newSumHead(fi.Size(), cn.protocol)
+			}
+		}
+	}
+	for _, v := range []int32{sh.count, sh.blength, sh.s2length, sh.remainder} {
+		if err := cn.writeInt(v); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, sh.blength)
+	r := bufio.NewReader(bf)
+	for i := int32(0); i < sh.count; i++ {
+		block := buf[:sh.blockLen(i)]
+		if _, err := io.ReadFull(r, block); err != nil {
+			return &Error{Code: 11, Msg: "Could not read the basis file " + basis + ", the error: " + err.Error(), Err: err}
+		}
+		if err := cn.writeInt(int32(checksum1(block))); err != nil {
+			return err
+		}
+		if err := cn.write(checksum2(block, cn.seed)[:sh.s2length]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *download) receive() error {
+	cn := d.cn
+	phase := 0
+	for {
+		ndx, err := cn.readInt()
+		if err != nil {
+			return err
+		}
+		if ndx == ndxDone {
+			phase++
+			if phase > maxPhase {
+				// the daemon's stats: total read, written, size, file list build and transfer time
+				for i := 0; i < 5; i++ {
+					if _, err := cn.readLongint(); err != nil {
+						return err
+					}
+				}
+				d.phases <- nil
+				return nil
+			}
+			d.mu.Lock()
+			redo := d.redo
+			d.redo = nil
+			d.mu.Unlock()
+			d.phases <- redo
+			continue
+		}
+
+		if ndx < 0 || int(ndx) >= len(d.files) {
+			return &Error{Code: 12, Msg: "Invalid file index " + strconv.Itoa(int(ndx)) + " from the daemon"}
+		}
+		iflags, err := cn.readShort()
+		if err != nil {
+			return err
+		}
+		if iflags&itemBasisTypeFollows != 0 {
+			if _, err := cn.readByte(); err != nil {
+				return err
+			}
+		}
+		if iflags&itemXnameFollows != 0 {
+			if _, err := cn.readVstring(); err != nil {
+				return err
+			}
+		}
+		if iflags&itemTransfer == 0 {
+			continue
+		}
+
+		var sh sumHead
+		for _, v := range []*int32{&sh.count, &sh.blength, &sh.s2length, &sh.remainder} {
+			if *v, err = cn.readInt(); err != nil {
+				return err
+			}
+		}
+
+		d.mu.Lock()
+		result := d.results[ndx]
+		d.mu.Unlock()
+		if result == nil {
+			return &Error{Code: 12, Msg: "The daemon sent the file " + d.files[ndx].Name + " which wasn't requested"}
+		}
+
+		basis := ""
+		if sh.count > 0 {
+			basis = d.basisPath(result.File)
+		}
+		redo, err := d.receiveFile(result, sh, basis)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		if redo {
+			d.redo = append(d.redo, ndx)
+		} else {
+			d.received[ndx] = true
+		}
+		d.mu.Unlock()
+	}
+}
+
+// receiveFile rebuilds the file from the literal data and the blocks of basis.
+// It returns redo=true if the checksum doesn't match, so the file must be
+// requested again as a whole. The returned error is only a connection error,
+// the file's errors are saved in the result
+func (d *download) receiveFile(result *Result, sh sumHead, basis string) (redo bool, err error) {
+	cn := d.cn
+	f := result.File
+	result.Err, result.Literal, result.Matched = nil, 0, 0
+
+	var bf *os.File
+	if basis != "" {
+		if bf, err = os.Open(basis); err != nil {
+			result.Err = err
+		} else {
+			defer bf.Close()
+		}
+	}
+
+	dst := filepath.Join(d.dstDir, filepath.FromSlash(f.Name))
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil && result.Err == nil {
+		result.Err = err
+	}
+	// the data must be read from the connection even if the file can't be written
+	var out io.Writer = io.Discard
+	if tmp != nil {
+		out = bufio.NewWriterSize(tmp, chunkSize)
+		defer func() {
+			if tmp != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+			}
+		}()
+	}
+	h := newFileHash(cn.seed)
+	w := io.MultiWriter(out, h)
+
+	buf := make([]byte, chunkSize)
+	for {
+		token, err := cn.readInt()
+		if err != nil {
+			d.savePartial(f, tmp, out)
+			return false, err
+		}
+		if token == 0 {
+			break
+		}
+		if token > 0 {
+			if _, err := io.CopyBuffer(w, io.LimitReader(cn, int64(token)), buf); err != nil {
+				d.savePartial(f, tmp, out)
+				return false, cn.err(err)
+			}
+			result.Literal += int64(token)
+			continue
+		}
+
+		block := -(token + 1)
+		if block >= sh.count || bf == nil {
+			if result.Err == nil {
+				result.Err = errors.New("The daemon referenced block " + strconv.Itoa(int(block)) + " which doesn't exist in " + basis)
+			}
+			continue
+		}
+		length := sh.blockLen(block)
+		if _, err := io.CopyBuffer(w, io.NewSectionReader(bf, int64(block)*int64(sh.blength), int64(length)), buf); err != nil && result.Err == nil {
+			result.Err = err
+		}
+		result.Matched += int64(length)
+	}
+
+	sum := make([]byte, sumLength)
+	if err := cn.readFull(sum); err != nil {
+		return false, err
+	}
+	if result.Err != nil {
+		return false, nil
+	}
+	if string(sum) != string(h.Sum(nil)) {
+		if basis != "" {
+			return true, nil
+		}
+		result.Err = errors.New("Checksum mismatch for " + f.Name)
+		return false, nil
+	}
+
+	if err := out.(*bufio.Writer).Flush(); err != nil {
+		result.Err = err
+		return false, nil
+	}
+	if err := tmp.Chmod(os.FileMode(f.Mode & 0777)); err != nil {
+		result.Err = err
+		return false, nil
+	}
+	if err := tmp.Close(); err != nil {
+		result.Err = err
+		return false, nil
+	}
+	if err := os.Chtimes(tmp.Name(), f.ModTime, f.ModTime); err != nil {
+		result.Err = err
+		return false, nil
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		result.Err = err
+		return false, nil
+	}
+	tmp = nil
+
+	if d.partialDir != "" {
+		os.Remove(filepath.Join(d.partialDir, filepath.FromSlash(f.Name)))
+	}
+
+	return false, nil
+}
+
+// savePartial keeps the received part of the file in partialDir
+// to resume the download next time
+func (d *download) savePartial(f File, tmp *os.File, out io.Writer) {
+	if d.partialDir == "" || tmp == nil {
+		return
+	}
+	if bw, ok := out.(*bufio.Writer); ok {
+		bw.Flush()
+	}
+	if fi, err := tmp.Stat(); err != nil || fi.Size() == 0 {
+		return
+	}
+	partial := filepath.Join(d.partialDir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(partial), 0770); err != nil {
+		return
+	}
+	tmp.Close()
+	// the temp file may be on another device, so copy it
+	if err := copyFile(tmp.Name(), partial); err != nil {
+		os.Remove(partial)
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Upload uploads the local file src to rawURL (rsync://[USER@]HOST[:PORT]/MODULE/PATH),
+// PATH is the name of the remote file
+func (c *Client) Upload(ctx context.Context, src, rawURL string) error {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return &Error{Code: 1, Msg: err.Error()}
+	}
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return &Error{Code: 1, Msg: "The URL " + rawURL + " must contain the remote file name"}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return &Error{Code: 11, Msg: "Could not open " + src + ", the error: " + err.Error(), Err: err}
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return &Error{Code: 11, Msg: "Could not stat " + src + ", the error: " + err.Error(), Err: err}
+	}
+
+	cn, err := c.open(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer cn.Close()
+
+	// -I transfers the file even if its size and mtime are the same
+	if err := cn.start([]string{"--server", "-It", ".", u.Module + "/" + u.Path}); err != nil {
+		return err
+	}
+
+	file := File{
+		Name:    path.Base(u.Path),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Mode:    sIFREG | uint32(fi.Mode().Perm()),
+	}
+	if err := cn.writeFile(file); err != nil {
+		return err
+	}
+	if err := cn.flush(); err != nil {
+		return err
+	}
+
+	// the sender's loop: answer the daemon's requests, echo ndxDone
+	// at the end of every phase
+	phase := 0
+	for {
+		ndx, err := cn.readInt()
+		if err != nil {
+			return err
+		}
+		if ndx == ndxDone {
+			phase++
+			if phase > maxPhase {
+				break
+			}
+			if err := cn.writeInt(ndxDone); err != nil {
+				return err
+			}
+			if err := cn.flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if ndx != 0 {
+			return &Error{Code: 12, Msg: "Invalid file index " + strconv.Itoa(int(ndx)) + " from the daemon"}
+		}
+
+		iflags, err := cn.readShort()
+		if err != nil {
+			return err
+		}
+		var basisType byte
+		var xname string
+		if iflags&itemBasisTypeFollows != 0 {
+			if basisType, err = cn.readByte(); err != nil {
+				return err
+			}
+		}
+		if iflags&itemXnameFollows != 0 {
+			if xname, err = cn.readVstring(); err != nil {
+				return err
+			}
+		}
+		if iflags&itemTransfer == 0 {
+			continue
+		}
+
+		var sh sumHead
+		for _, v := range []*int32{&sh.count, &sh.blength, &sh.s2length, &sh.remainder} {
+			if *v, err = cn.readInt(); err != nil {
+				return err
+			}
+		}
+		// the block checksums of the remote file are not used,
+		// the exclude files are small enough to send them as a whole
+		skip := make([]byte, 4+sh.s2length)
+		for i := int32(0); i < sh.count; i++ {
+			if err := cn.readFull(skip); err != nil {
+				return err
+			}
+		}
+
+		if err := cn.writeInt(ndx); err != nil {
+			return err
+		}
+		if err := cn.writeShort(iflags); err != nil {
+			return err
+		}
+		if iflags&itemBasisTypeFollows != 0 {
+			if err := cn.writeByte(basisType); err != nil {
+				return err
+			}
+		}
+		if iflags&itemXnameFollows != 0 {
+			if err := cn.writeVstring(xname); err != nil {
+				return err
+			}
+		}
+		for _, v := range []int32{sh.count, sh.blength, sh.s2length, sh.remainder} {
+			if err := cn.writeInt(v); err != nil {
+				return err
+			}
+		}
+		if err := sendFile(cn, f); err != nil {
+			return err
+		}
+		if err := cn.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := cn.writeInt(ndxDone); err != nil {
+		return err
+	}
+	if err := cn.flush(); err != nil {
+		return err
+	}
+	// the final goodbye
+	if _, err := cn.readInt(); err != nil {
+		return err
+	}
+	if errs := cn.serverErrors(); len(errs) > 0 {
+		return &Error{Code: 23, Msg: "Partial transfer due to error: " + strings.Join(errs, "; ")}
+	}
+
+	return nil
+}
+
+// sendFile sends the whole file as the literal data followed by the file checksum
+func sendFile(cn *conn, f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return &Error{Code: 11, Msg: "Could not read " + f.Name() + ", the error: " + err.Error(), Err: err}
+	}
+	h := newFileHash(cn.seed)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			if err := cn.writeInt(int32(n)); err != nil {
+				return err
+			}
+			if err := cn.write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &Error{Code: 11, Msg: "Could not read " + f.Name() + ", the error: " + err.Error(), Err: err}
+		}
+	}
+	if err := cn.writeInt(0); err != nil {
+		return err
+	}
+	return cn.write(h.Sum(nil))
+}
+
+// ReadExcludeFile reads the patterns of --exclude-from file:
+// one pattern per line, empty lines and comments (';' or '#') are skipped
+func ReadExcludeFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
@@ -0,0 +1,836 @@
+package rsync_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"pullcsv/internal/rsync"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/md4"
+)
+
+// fakeDaemon is a local stand-in for rsyncd speaking protocol 29
+// (as rsync 3.x does for the old clients)
+type fakeDaemon struct {
+	t        *testing.T
+	ln       net.Listener
+	modules  map[string]string
+	user     string
+	password string
+	seed     int32
+
+	mu sync.Mutex
+	// vanish lists the files the daemon pretends to have lost after the file list was sent
+	vanish map[string]bool
+	// cutAfter closes the connection after sending so many bytes of a file
+	cutAfter int
+	// matched is the number of bytes the daemon didn't send thanks to the basis files
+	matched int
+	// args are the server args of the last session
+	args []string
+}
+
+func newFakeDaemon(t *testing.T, modules map[string]string) *fakeDaemon {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := &fakeDaemon{t: t, ln: ln, modules: modules, seed: 0x5eed, vanish: map[string]bool{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fd.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+
+	return fd
+}
+
+func (fd *fakeDaemon) url(s string) string {
+	return "rsync://" + fd.user + "@" + fd.ln.Addr().String() + "/" + s
+}
+
+type daemonConn struct {
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+	// mplex is the multiplexed output buffer
+	mplex bytes.Buffer
+}
+
+func (dc *daemonConn) line(s string) {
+	dc.w.WriteString(s + "\n")
+	dc.w.Flush()
+}
+
+func (dc *daemonConn) readLine() (string, error) {
+	s, err := dc.r.ReadString('\n')
+	return strings.TrimSuffix(s, "\n"), err
+}
+
+func (dc *daemonConn) readInt() int32 {
+	var b [4]byte
+	if _, err := io.ReadFull(dc.r, b[:]); err != nil {
+		panic(err)
+	}
+	return int32(binary.LittleEndian.Uint32(b[:]))
+}
+
+func (dc *daemonConn) readShort() uint16 {
+	var b [2]byte
+	if _, err := io.ReadFull(dc.r, b[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint16(b[:])
+}
+
+func (dc *daemonConn) readBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(dc.r, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (dc *daemonConn) putInt(v int32) {
+	binary.Write(&dc.mplex, binary.LittleEndian, v)
+}
+
+func (dc *daemonConn) putLongint(v int64) {
+	if v <= 0x7fffffff {
+		dc.putInt(int32(v))
+		return
+	}
+	dc.putInt(-1)
+	binary.Write(&dc.mplex, binary.LittleEndian, v)
+}
+
+// send flushes the multiplexed data in MSG_DATA frames
+func (dc *daemonConn) send() {
+	data := dc.mplex.Bytes()
+	for len(data) > 0 {
+		n := len(data)
+		if n > 0xffffff {
+			n = 0xffffff
+		}
+		binary.Write(dc.w, binary.LittleEndian, uint32(7<<24|n))
+		dc.w.Write(data[:n])
+		data = data[n:]
+	}
+	dc.mplex.Reset()
+	dc.w.Flush()
+}
+
+// message sends MSG_ERROR(3) or MSG_WARNING(4)
+func (dc *daemonConn) message(code int, text string) {
+	dc.send()
+	binary.Write(dc.w, binary.LittleEndian, uint32((7+code)<<24|(len(text)+1)))
+	dc.w.WriteString(text + "\n")
+	dc.w.Flush()
+}
+
+func md4Sum(parts ...[]byte) []byte {
+	h := md4.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func le32(v int32) []byte {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	return b[:]
+}
+
+func rolling(b []byte) uint32 {
+	var s1, s2 uint32
+	for _, c := range b {
+		s1 += uint32(int8(c))
+		s2 += s1
+	}
+	return s1&0xffff | s2<<16
+}
+
+func (fd *fakeDaemon) serve(c net.Conn) {
+	defer c.Close()
+	defer func() {
+		// the client closed the connection
+		recover()
+	}()
+
+	dc := &daemonConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	dc.line("@RSYNCD: 31.0 md5 md4")
+	if v, _ := dc.readLine(); v != "@RSYNCD: 29" {
+		dc.line("@ERROR: protocol startup error")
+		return
+	}
+	dc.line("Welcome to the fake rsyncd")
+
+	module, _ := dc.readLine()
+	if module == "#list" {
+		var names []string
+		for name := range fd.modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			dc.line(name + "\tfake module " + name)
+		}
+		dc.line("@RSYNCD: EXIT")
+		return
+	}
+	dir, ok := fd.modules[module]
+	if !ok {
+		dc.line("@ERROR: Unknown module '" + module + "'")
+		return
+	}
+
+	if fd.password != "" {
+		challenge := "Y2hhbGxlbmdl"
+		dc.line("@RSYNCD: AUTHREQD " + challenge)
+		resp, _ := dc.readLine()
+		want := fd.user + " " + base64.RawStdEncoding.EncodeToString(md4Sum(le32(0), []byte(fd.password), []byte(challenge)))
+		if resp != want {
+			dc.line("@ERROR: auth failed on module " + module)
+			return
+		}
+	}
+	dc.line("@RSYNCD: OK")
+
+	var args []string
+	for {
+		arg, err := dc.readLine()
+		if err != nil {
+			return
+		}
+		if arg == "" {
+			break
+		}
+		args = append(args, arg)
+	}
+	fd.mu.Lock()
+	fd.args = args
+	fd.mu.Unlock()
+
+	binary.Write(dc.w, binary.LittleEndian, fd.seed)
+	dc.w.Flush()
+
+	target := strings.TrimPrefix(args[len(args)-1], module+"/")
+	if args[1] == "--sender" {
+		fd.sender(dc, dir, target)
+	} else {
+		fd.receiver(dc, dir, target)
+	}
+}
+
+func (fd *fakeDaemon) sender(dc *daemonConn, dir, pattern string) {
+	var excludes []string
+	for {
+		n := dc.readInt()
+		if n == 0 {
+			break
+		}
+		excludes = append(excludes, strings.TrimPrefix(string(dc.readBytes(int(n))), "- "))
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+	var names []string
+	for _, m := range matches {
+		excluded := false
+		for _, e := range excludes {
+			if ok, _ := path.Match(e, filepath.Base(m)); ok {
+				excluded = true
+			}
+		}
+		if fi, err := os.Stat(m); err == nil && fi.Mode().IsRegular() && !excluded {
+			names = append(names, filepath.Base(m))
+		}
+	}
+	if len(matches) == 0 {
+		dc.message(3, "rsync: link_stat \""+pattern+"\" (in fake) failed: No such file or directory (2)")
+	}
+	// send the list unsorted, the client must sort it itself
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	prevName := ""
+	for i, name := range names {
+		fi, _ := os.Stat(filepath.Join(dir, name))
+		flags := byte(0x40) // long name
+		l1 := 0
+		for l1 < len(name) && l1 < len(prevName) && l1 < 255 && name[l1] == prevName[l1] {
+			l1++
+		}
+		if l1 > 0 {
+			flags |= 0x20 // same name
+		}
+		if i > 0 {
+			flags |= 0x02 // same mode, all the files have 0644
+		}
+		dc.mplex.WriteByte(flags)
+		if l1 > 0 {
+			dc.mplex.WriteByte(byte(l1))
+		}
+		dc.putInt(int32(len(name) - l1))
+		dc.mplex.WriteString(name[l1:])
+		dc.putLongint(fi.Size())
+		dc.putInt(int32(fi.ModTime().Unix()))
+		if i == 0 {
+			dc.putInt(0100644)
+		}
+		prevName = name
+	}
+	dc.mplex.WriteByte(0)
+	dc.putInt(0)
+	dc.send()
+	sort.Strings(names)
+
+	phase := 0
+	for {
+		ndx := dc.readInt()
+		if ndx == -1 {
+			phase++
+			if phase > 2 {
+				break
+			}
+			dc.putInt(-1)
+			dc.send()
+			continue
+		}
+		iflags := dc.readShort()
+		count, blength, s2length, remainder := dc.readInt(), dc.readInt(), dc.readInt(), dc.readInt()
+		type block struct {
+			sum1 uint32
+			sum2 []byte
+		}
+		blocks := make([]block, count)
+		bySum1 := make(map[uint32][]int)
+		for i := range blocks {
+			blocks[i] = block{sum1: uint32(dc.readInt()), sum2: dc.readBytes(int(s2length))}
+			bySum1[blocks[i].sum1] = append(bySum1[blocks[i].sum1], i)
+		}
+		// like rsync before protocol 30
+		if blength > 1<<13 {
+			dc.message(3, "Invalid block length "+strconv.Itoa(int(blength))+" [sender]")
+			dc.c.Close()
+			return
+		}
+
+		name := names[ndx]
+		fd.mu.Lock()
+		vanish, cutAfter := fd.vanish[name], fd.cutAfter
+		fd.mu.Unlock()
+		if vanish {
+			dc.message(4, "file has vanished: \""+name+"\" (in fake)")
+			continue
+		}
+
+		data, _ := os.ReadFile(filepath.Join(dir, name))
+		dc.putInt(ndx)
+		binary.Write(&dc.mplex, binary.LittleEndian, iflags)
+		for _, v := range []int32{count, blength, s2length, remainder} {
+			dc.putInt(v)
+		}
+
+		var literal []byte
+		flushLiteral := func() {
+			if len(literal) > 0 {
+				dc.putInt(int32(len(literal)))
+				dc.mplex.Write(literal)
+				literal = nil
+			}
+		}
+		blockLen := func(i int) int {
+			if i == len(blocks)-1 && remainder != 0 {
+				return int(remainder)
+			}
+			return int(blength)
+		}
+		sent := 0
+		for off := 0; off < len(data); {
+			found := -1
+			for _, l := range []int{int(blength), int(remainder)} {
+				if l == 0 || off+l > len(data) || found >= 0 {
+					continue
+				}
+				chunk := data[off : off+l]
+				for _, i := range bySum1[rolling(chunk)] {
+					if blockLen(i) != l {
+						continue
+					}
+					if bytes.Equal(md4Sum(chunk, le32(fd.seed))[:s2length], blocks[i].sum2) {
+						found = i
+						flushLiteral()
+						dc.putInt(int32(-(i + 1)))
+						off += l
+						fd.mu.Lock()
+						fd.matched += l
+						fd.mu.Unlock()
+						break
+					}
+				}
+			}
+			if found < 0 {
+				literal = append(literal, data[off])
+				off++
+				sent++
+				if cutAfter > 0 && sent >= cutAfter {
+					flushLiteral()
+					dc.send()
+					dc.c.Close()
+					return
+				}
+			}
+		}
+		flushLiteral()
+		dc.putInt(0)
+		dc.mplex.Write(md4Sum(le32(fd.seed), data))
+		dc.send()
+	}
+
+	dc.putInt(-1)
+	for i := 0; i < 5; i++ {
+		dc.putLongint(int64(i))
+	}
+	dc.send()
+	dc.readInt()
+}
+
+func (fd *fakeDaemon) receiver(dc *daemonConn, dir, target string) {
+	flags := dc.readBytes(1)[0]
+	if flags&0x40 == 0 {
+		panic("the fake daemon wants long names only")
+	}
+	name := string(dc.readBytes(int(dc.readInt())))
+	size := int64(dc.readInt())
+	mtime := dc.readInt()
+	dc.readInt()
+	if end := dc.readBytes(1)[0]; end != 0 {
+		panic("the fake daemon wants a single file")
+	}
+	dc.readInt()
+
+	dst := filepath.Join(dir, target)
+	if strings.HasSuffix(target, "/") {
+		dst = filepath.Join(dst, name)
+	}
+
+	// ask for the whole file
+	dc.putInt(0)
+	binary.Write(&dc.mplex, binary.LittleEndian, uint16(1<<15))
+	for i := 0; i < 4; i++ {
+		dc.putInt(0)
+	}
+	dc.send()
+
+	if ndx := dc.readInt(); ndx != 0 {
+		panic("unexpected ndx")
+	}
+	dc.readShort()
+	for i := 0; i < 4; i++ {
+		dc.readInt()
+	}
+	var data []byte
+	for {
+		n := dc.readInt()
+		if n == 0 {
+			break
+		}
+		data = append(data, dc.readBytes(int(n))...)
+	}
+	if !bytes.Equal(dc.readBytes(16), md4Sum(le32(fd.seed), data)) || int64(len(data)) != size {
+		dc.message(3, "rsync: checksum mismatch for "+name)
+	} else {
+		os.MkdirAll(filepath.Dir(dst), 0755)
+		os.WriteFile(dst, data, 0644)
+		os.Chtimes(dst, time.Unix(int64(mtime), 0), time.Unix(int64(mtime), 0))
+	}
+
+	for i := 0; i < 3; i++ {
+		dc.putInt(-1)
+		dc.send()
+		if ndx := dc.readInt(); ndx != -1 {
+			panic("unexpected ndx")
+		}
+	}
+	dc.putInt(-1)
+	dc.send()
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)
+		os.Chtimes(p, mtime, mtime)
+	}
+}
+
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	got := map[string]string{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[e.Name()] = string(data)
+	}
+	return got
+}
+
+func TestParseURL(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		url  string
+		want rsync.URL
+	}
+
+	testCases := []testCase{
+		{url: "rsync://USERNAME@server-name/pullcsv/some-files/*_TODAY_*csv", want: rsync.URL{User: "USERNAME", Host: "server-name", Port: "873", Module: "pullcsv", Path: "some-files/*_TODAY_*csv"}},
+		{url: "rsync://server-name:8873/pullcsv-exclude-files/exFN", want: rsync.URL{Host: "server-name", Port: "8873", Module: "pullcsv-exclude-files", Path: "exFN"}},
+		{url: "rsync://user@example.com@server-name/pullcsv/file?.csv", want: rsync.URL{User: "user@example.com", Host: "server-name", Port: "873", Module: "pullcsv", Path: "file?.csv"}},
+		{url: "rsync://server-name/", want: rsync.URL{Host: "server-name", Port: "873"}},
+	}
+
+	for _, tc := range testCases {
+		got, err := rsync.ParseURL(tc.url)
+		if err != nil {
+			t.Errorf("%s: want nil, got error: %v", tc.url, err)
+			continue
+		}
+		if *got != tc.want {
+			t.Errorf("%s: want: %+v, got: %+v", tc.url, tc.want, *got)
+		}
+	}
+
+	for _, url := range []string{"server-name/pullcsv", "ftp://server-name/pullcsv", "rsync:///pullcsv"} {
+		if _, err := rsync.ParseURL(url); err == nil {
+			t.Errorf("%s: want error for invalid input, got nil", url)
+		}
+	}
+}
+
+func TestListModules(t *testing.T) {
+	t.Parallel()
+
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": t.TempDir(), "pullcsv-exclude-files": t.TempDir()})
+	c := &rsync.Client{Timeout: 5 * time.Second}
+
+	got, err := c.ListModules(context.Background(), fd.url(""))
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	want := []rsync.Module{
+		{Name: "pullcsv", Comment: "fake module pullcsv"},
+		{Name: "pullcsv-exclude-files", Comment: "fake module pullcsv-exclude-files"},
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	t.Parallel()
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{
+		"prices_20240224.csv": "sku;price\n1;100\n",
+		"stocks_20240224.csv": "sku;stock\n1;5\n",
+		"stocks_20240223.csv": "sku;stock\n1;4\n",
+		"readme.txt":          "not a csv",
+	})
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": src})
+	fd.user, fd.password = "USERNAME", "123"
+
+	dst := t.TempDir()
+	c := &rsync.Client{Password: "123", Timeout: 5 * time.Second}
+	results, err := c.Download(context.Background(), fd.url("pullcsv/*csv"), dst, rsync.DownloadOptions{Excludes: []string{"stocks_20240223.csv"}})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+
+	want := map[string]string{
+		"prices_20240224.csv": "sku;price\n1;100\n",
+		"stocks_20240224.csv": "sku;stock\n1;5\n",
+	}
+	if got := readDir(t, dst); !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Name)
+		if r.Err != nil {
+			t.Errorf("%s: want nil, got error: %v", r.Name, r.Err)
+		}
+		if !r.ModTime.Equal(time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: mtime is not preserved: %v", r.Name, r.ModTime)
+		}
+	}
+	if wantNames := []string{"prices_20240224.csv", "stocks_20240224.csv"}; !cmp.Equal(wantNames, names) {
+		t.Errorf("want: %v, got: %v", wantNames, names)
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "prices_20240224.csv"))
+	if err != nil || !fi.ModTime().Equal(time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("mtime is not set on the downloaded file: %v, %v", fi, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	t.Parallel()
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"b.csv": "b", "a.csv": "a", "readme.txt": "c"})
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": src})
+	c := &rsync.Client{Timeout: 5 * time.Second}
+
+	files, err := c.List(context.Background(), fd.url("pullcsv/*.csv"))
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if want := []string{"a.csv", "b.csv"}; !cmp.Equal(want, names) {
+		t.Errorf("want: %v, got: %v", want, names)
+	}
+
+	dst := t.TempDir()
+	opts := rsync.DownloadOptions{Filter: func(f rsync.File) bool { return f.Name == "b.csv" }}
+	if _, err := c.Download(context.Background(), fd.url("pullcsv/*.csv"), dst, opts); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if want, got := map[string]string{"b.csv": "b"}, readDir(t, dst); !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestDownloadInvalid(t *testing.T) {
+	t.Parallel()
+
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": t.TempDir()})
+	fd.user, fd.password = "USERNAME", "123"
+
+	type testCase struct {
+		url, password string
+		code          int
+	}
+
+	testCases := []testCase{
+		{url: fd.url("pullcsv/*csv"), password: "wrong", code: 5},
+		{url: fd.url("doesntexist/*csv"), password: "123", code: 5},
+		{url: fd.url("pullcsv/*csv"), password: "123", code: 23},
+		{url: "rsync://127.0.0.1:1/pullcsv/*csv", password: "123", code: 10},
+		{url: "blablabla", password: "123", code: 1},
+	}
+
+	for _, tc := range testCases {
+		c := &rsync.Client{Password: tc.password, Timeout: 5 * time.Second}
+		_, err := c.Download(context.Background(), tc.url, t.TempDir(), rsync.DownloadOptions{})
+		if got := rsync.ExitCode(err); got != tc.code {
+			t.Errorf("%s: want exit code %d, got: %d (%v)", tc.url, tc.code, got, err)
+		}
+	}
+}
+
+func TestDownloadVanished(t *testing.T) {
+	t.Parallel()
+
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"a.csv": "a", "b.csv": "b", "c.csv": "c"})
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": src})
+	fd.vanish["b.csv"] = true
+
+	dst := t.TempDir()
+	c := &rsync.Client{Timeout: 5 * time.Second}
+	results, err := c.Download(context.Background(), fd.url("pullcsv/*.csv"), dst, rsync.DownloadOptions{})
+	if got := rsync.ExitCode(err); got != 24 {
+		t.Errorf("want exit code 24, got: %d (%v)", got, err)
+	}
+	for _, r := range results {
+		if failed := r.Err != nil; failed != (r.Name == "b.csv") {
+			t.Errorf("%s: want only the vanished file to be failed, got error: %v", r.Name, r.Err)
+		}
+	}
+	if want, got := map[string]string{"a.csv": "a", "c.csv": "c"}, readDir(t, dst); !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
+
+func TestDownloadPartial(t *testing.T) {
+	t.Parallel()
+
+	content := strings.Repeat("sku;stock;warehouse\n", 5000)
+	src := t.TempDir()
+	writeFiles(t, src, map[string]string{"stocks.csv": content})
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": src})
+	fd.cutAfter = 60000
+
+	partialDir := filepath.Join(t.TempDir(), "partial")
+	c := &rsync.Client{Timeout: 5 * time.Second}
+	opts := rsync.DownloadOptions{PartialDir: partialDir}
+
+	if _, err := c.Download(context.Background(), fd.url("pullcsv/stocks.csv"), t.TempDir(), opts); err == nil {
+		t.Fatal("want error for the interrupted transfer, got nil")
+	}
+	partial, err := os.ReadFile(filepath.Join(partialDir, "stocks.csv"))
+	if err != nil || len(partial) == 0 || !strings.HasPrefix(content, string(partial)) {
+		t.Fatalf("want the partial file to be kept, got %d bytes, error: %v", len(partial), err)
+	}
+
+	fd.mu.Lock()
+	fd.cutAfter = 0
+	fd.mu.Unlock()
+
+	dst := t.TempDir()
+	results, err := c.Download(context.Background(), fd.url("pullcsv/stocks.csv"), dst, opts)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if got := readDir(t, dst)["stocks.csv"]; got != content {
+		t.Errorf("the resumed file differs, want %d bytes, got %d", len(content), len(got))
+	}
+	if len(results) != 1 || results[0].Matched == 0 || results[0].Literal >= int64(len(content)) {
+		t.Errorf("want the partial file to be reused, got: %+v", results)
+	}
+	if _, err := os.Stat(filepath.Join(partialDir, "stocks.csv")); !os.IsNotExist(err) {
+		t.Errorf("want the partial file to be removed, got: %v", err)
+	}
+}
+
+func TestDownloadPartialLarge(t *testing.T) {
+	t.Parallel()
+
+	// over 64 MiB the square root of the size exceeds the block
+	// length the daemon accepts in protocol 29
+	content := make([]byte, 65<<20+12345)
+	rand.New(rand.NewSource(1)).Read(content)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "stocks.csv"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd := newFakeDaemon(t, map[string]string{"pullcsv": src})
+
+	partialDir := filepath.Join(t.TempDir(), "partial")
+	os.MkdirAll(partialDir, 0755)
+	if err := os.WriteFile(filepath.Join(partialDir, "stocks.csv"), content[:65<<20], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &rsync.Client{Timeout: 30 * time.Second}
+	dst := t.TempDir()
+	results, err := c.Download(context.Background(), fd.url("pullcsv/stocks.csv"), dst, rsync.DownloadOptions{PartialDir: partialDir})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "stocks.csv")); !bytes.Equal(content, got) {
+		t.Errorf("the resumed file differs, want %d bytes, got %d", len(content), len(got))
+	}
+	if len(results) != 1 || results[0].Matched < 65<<20-1<<13 || results[0].Literal > 1<<15 {
+		t.Errorf("want the partial file to be reused, got: %+v", results)
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the daemon accepts the connection and never says anything
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	c := &rsync.Client{Timeout: time.Minute}
+	_, err = c.Download(ctx, "rsync://"+ln.Addr().String()+"/pullcsv/*csv", t.TempDir(), rsync.DownloadOptions{})
+	if got := rsync.ExitCode(err); got != 30 {
+		t.Errorf("want exit code 30, got: %d (%v)", got, err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	t.Parallel()
+
+	remote := t.TempDir()
+	fd := newFakeDaemon(t, map[string]string{"pullcsv-exclude-files": remote})
+	fd.user, fd.password = "USERNAME", "123"
+
+	local := filepath.Join(t.TempDir(), "exFN")
+	content := strings.Repeat("prices_20240224.csv\n", 3000)
+	if err := os.WriteFile(local, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &rsync.Client{Password: "123", Timeout: 5 * time.Second}
+	if err := c.Upload(context.Background(), local, fd.url("pullcsv-exclude-files/some-pod-name-excludeFile")); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(remote, "some-pod-name-excludeFile"))
+	if err != nil || string(got) != content {
+		t.Errorf("the uploaded file differs, want %d bytes, got %d, error: %v", len(content), len(got), err)
+	}
+
+	if err := c.Upload(context.Background(), "/tmp/doesntexist/exFN", fd.url("pullcsv-exclude-files/exFN")); rsync.ExitCode(err) != 11 {
+		t.Errorf("want exit code 11 for missing local file, got: %v", err)
+	}
+}
+
+func TestReadExcludeFile(t *testing.T) {
+	t.Parallel()
+
+	name := filepath.Join(t.TempDir(), "exFN")
+	os.WriteFile(name, []byte("first\n\n# comment\n; comment\nsecond\r\n"), 0644)
+
+	got, err := rsync.ReadExcludeFile(name)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if want := []string{"first", "second"}; !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
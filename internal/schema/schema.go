@@ -0,0 +1,143 @@
+// Package schema validates the downloaded CSV files against the job's schema
+package schema
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The reasons of the validation errors, they are used in the metric labels
+const (
+	ReasonFormat   = "format"
+	ReasonEncoding = "encoding"
+	ReasonHeader   = "header"
+	ReasonColumns  = "columns"
+	ReasonType     = "type"
+)
+
+// Error is the first line of the file which doesn't match the schema
+type Error struct {
+	Line   int
+	Reason string
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return "line " + strconv.Itoa(e.Line) + ": " + e.Msg
+}
+
+// Matches reports whether the file name is validated by the schema
+func Matches(s *config.Schema, name string) bool {
+	if s.Files == "" {
+		return true
+	}
+	ok, _ := filepath.Match(s.Files, filepath.Base(name))
+	return ok
+}
+
+// Validate reads the whole file and returns *Error for the first line which
+// doesn't match the schema, any other error means the file couldn't be read
+func Validate(path string, s *config.Schema) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma, _ = utf8.DecodeRuneInString(s.Delimiter)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	types := columnTypes(s)
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return &Error{Line: parseErr.Line, Reason: ReasonFormat, Msg: parseErr.Err.Error()}
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := r.FieldPos(0)
+
+		for i, v := range record {
+			if !utf8.ValidString(v) {
+				return &Error{Line: line, Reason: ReasonEncoding, Msg: "column " + strconv.Itoa(i+1) + " is not valid UTF-8"}
+			}
+		}
+		if first && len(record) > 0 {
+			record[0] = strings.TrimPrefix(record[0], "\ufeff")
+		}
+		if s.Columns > 0 && len(record) != s.Columns {
+			return &Error{Line: line, Reason: ReasonColumns, Msg: "want " + strconv.Itoa(s.Columns) + " columns, got " + strconv.Itoa(len(record))}
+		}
+		if first && len(s.Header) > 0 {
+			for i, name := range s.Header {
+				if i >= len(record) || record[i] != name {
+					return &Error{Line: line, Reason: ReasonHeader, Msg: "want header " + strings.Join(s.Header, s.Delimiter) + ", got " + strings.Join(record, s.Delimiter)}
+				}
+			}
+			continue
+		}
+		for i, v := range record {
+			if i >= len(types) || v == "" || validValue(types[i], v) {
+				continue
+			}
+			return &Error{Line: line, Reason: ReasonType, Msg: "column " + strconv.Itoa(i+1) + " must be " + types[i] + ", got " + strconv.Quote(v)}
+		}
+	}
+}
+
+// columnTypes returns the types by the column index
+func columnTypes(s *config.Schema) []string {
+	var types []string
+	for column, columnType := range s.Types {
+		i := -1
+		for j, name := range s.Header {
+			if name == column {
+				i = j
+			}
+		}
+		if i < 0 {
+			n, err := strconv.Atoi(column)
+			if err != nil || n < 1 {
+				continue
+			}
+			i = n - 1
+		}
+		for len(types) <= i {
+			types = append(types, "string")
+		}
+		types[i] = columnType
+	}
+	return types
+}
+
+func validValue(columnType, v string) bool {
+	var err error
+	switch columnType {
+	case "int":
+		_, err = strconv.ParseInt(v, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(v, 64)
+	case "bool":
+		_, err = strconv.ParseBool(v)
+	case "date":
+		_, err = time.Parse("2006-01-02", v)
+	case "datetime":
+		_, err = time.Parse(time.RFC3339, v)
+	}
+	return err == nil
+}
@@ -0,0 +1,89 @@
+package schema_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/config"
+	"pullcsv/internal/schema"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	stocks := &config.Schema{
+		Delimiter: ";",
+		Header:    []string{"sku", "qty", "price", "date"},
+		Columns:   4,
+		Types:     map[string]string{"qty": "int", "price": "float", "4": "date"},
+	}
+	noHeader := &config.Schema{Delimiter: ",", Columns: 2, Types: map[string]string{"2": "bool"}}
+
+	type testCase struct {
+		schema     *config.Schema
+		content    string
+		wantLine   int
+		wantReason string
+	}
+
+	testCases := []testCase{
+		{schema: stocks, content: "sku;qty;price;date\na1;10;1.5;2024-02-24\na2;;;\n"},
+		{schema: stocks, content: "\ufeffsku;qty;price;date\r\na1;10;1.5;2024-02-24\r\n"},
+		{schema: stocks, content: "sku;qty;price;date\n\"a;1\";10;1.5;2024-02-24\n"},
+		{schema: stocks, content: ""},
+		{schema: stocks, content: "sku,qty,price,date\na1,10,1.5,2024-02-24\n", wantLine: 1, wantReason: schema.ReasonColumns},
+		{schema: stocks, content: "sku;amount;price;date\n", wantLine: 1, wantReason: schema.ReasonHeader},
+		{schema: stocks, content: "sku;qty;price;date\na1;10;1.5;2024-02-24\na2;10;1.5\n", wantLine: 3, wantReason: schema.ReasonColumns},
+		{schema: stocks, content: "sku;qty;price;date\na1;10;1.5;2024-02-24\na2;ten;1.5;2024-02-24\n", wantLine: 3, wantReason: schema.ReasonType},
+		{schema: stocks, content: "sku;qty;price;date\na1;10;1,5;2024-02-24\n", wantLine: 2, wantReason: schema.ReasonType},
+		{schema: stocks, content: "sku;qty;price;date\na1;10;1.5;24.02.2024\n", wantLine: 2, wantReason: schema.ReasonType},
+		{schema: stocks, content: "sku;qty;price;date\n\xcf\xf0\xe8;10;1.5;2024-02-24\n", wantLine: 2, wantReason: schema.ReasonEncoding},
+		{schema: stocks, content: "sku;qty;price;date\n\"a1;10;1.5;2024-02-24\n", wantLine: 2, wantReason: schema.ReasonFormat},
+		{schema: noHeader, content: "a,true\nb,false\n"},
+		{schema: noHeader, content: "a,true\nb,no\n", wantLine: 2, wantReason: schema.ReasonType},
+		{schema: &config.Schema{Delimiter: "\t"}, content: "a\tb\nc\n"},
+	}
+
+	dir := t.TempDir()
+	for i, tc := range testCases {
+		path := filepath.Join(dir, "stocks.csv")
+		os.WriteFile(path, []byte(tc.content), 0644)
+
+		err := schema.Validate(path, tc.schema)
+		if tc.wantReason == "" {
+			if err != nil {
+				t.Errorf("Case %d: want nil, got error: %v", i, err)
+			}
+			continue
+		}
+		var validationErr *schema.Error
+		if !errors.As(err, &validationErr) {
+			t.Errorf("Case %d: want validation error, got: %v", i, err)
+			continue
+		}
+		if validationErr.Line != tc.wantLine || validationErr.Reason != tc.wantReason {
+			t.Errorf("Case %d, want: line %d %s, got: line %d %s (%v)", i, tc.wantLine, tc.wantReason, validationErr.Line, validationErr.Reason, err)
+		}
+	}
+
+	var validationErr *schema.Error
+	if err := schema.Validate(filepath.Join(dir, "doesntexist.csv"), stocks); err == nil || errors.As(err, &validationErr) {
+		t.Errorf("want read error for missing file, got: %v", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	t.Parallel()
+
+	s := &config.Schema{Files: "*.csv"}
+	if !schema.Matches(s, "/tmp/dir/stocks.csv") {
+		t.Error("want stocks.csv to match *.csv")
+	}
+	if schema.Matches(s, "/tmp/dir/stocks.txt") {
+		t.Error("want stocks.txt not to match *.csv")
+	}
+	if !schema.Matches(&config.Schema{}, "stocks.txt") {
+		t.Error("want every file to match the empty glob")
+	}
+}
@@ -0,0 +1,179 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"os"
+	"path"
+	"pullcsv/internal/rsync"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// timeoutConn sets the IO timeout before every Read and Write,
+// so a hung server doesn't block the job forever
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+	conns   *connSet
+}
+
+func (tc *timeoutConn) Read(p []byte) (int, error) {
+	tc.Conn.SetReadDeadline(time.Now().Add(tc.timeout))
+	return tc.Conn.Read(p)
+}
+
+func (tc *timeoutConn) Write(p []byte) (int, error) {
+	tc.Conn.SetWriteDeadline(time.Now().Add(tc.timeout))
+	return tc.Conn.Write(p)
+}
+
+func (tc *timeoutConn) Close() error {
+	tc.conns.remove(tc)
+	return tc.Conn.Close()
+}
+
+// connSet keeps the open connections of the backend. They are closed when
+// the ctx of the operation is done, so the job's timeout interrupts
+// the transfer without waiting for the IO timeout
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*timeoutConn]bool
+}
+
+// wrap returns nc with the IO timeout, it's kept in the set until it's closed
+func (cs *connSet) wrap(nc net.Conn) net.Conn {
+	tc := &timeoutConn{Conn: nc, timeout: rsync.DefaultTimeout, conns: cs}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.conns == nil {
+		cs.conns = make(map[*timeoutConn]bool)
+	}
+	cs.conns[tc] = true
+	return tc
+}
+
+func (cs *connSet) remove(tc *timeoutConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.conns, tc)
+}
+
+// watch closes the connections when ctx is done, until stop is called
+func (cs *connSet) watch(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		cs.mu.Lock()
+		conns := cs.conns
+		cs.conns = nil
+		cs.mu.Unlock()
+		for tc := range conns {
+			tc.Conn.Close()
+		}
+	})
+}
+
+// ftpBackend talks to the FTP server in the passive mode,
+// the user is anonymous if the URL has none
+type ftpBackend struct {
+	c     *ftp.ServerConn
+	conns *connSet
+}
+
+func newFTP(ctx context.Context, rawURL string) (backend, string, error) {
+	user, host, p, err := parseURL(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "21")
+	}
+	if user == "" {
+		user = "anonymous"
+	}
+
+	conns := &connSet{}
+	stop := conns.watch(ctx)
+	defer stop()
+	// the data connections are dialed with it too
+	dialer := net.Dialer{Timeout: time.Minute}
+	c, err := ftp.Dial(host, ftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+		nc, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return conns.wrap(nc), nil
+	}))
+	if err != nil {
+		return nil, "", errors.New("Could not connect to " + host + ", the error: " + err.Error())
+	}
+	if err := c.Login(user, os.Getenv("FTP_PASSWORD")); err != nil {
+		c.Quit()
+		return nil, "", errors.New("Could not log in to " + host + " as " + user + ", the error: " + err.Error())
+	}
+
+	return &ftpBackend{c: c, conns: conns}, p, nil
+}
+
+// ftpErr converts "550 No such file" into fs.ErrNotExist
+func ftpErr(op, p string, err error) error {
+	var te *textproto.Error
+	if errors.As(err, &te) && te.Code == ftp.StatusFileUnavailable {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return err
+}
+
+func (f *ftpBackend) list(ctx context.Context, dir string) ([]File, error) {
+	defer f.conns.watch(ctx)()
+	entries, err := f.c.List(dir)
+	if err != nil {
+		return nil, ftpErr("LIST", dir, err)
+	}
+
+	var files []File
+	for _, e := range entries {
+		if e.Type != ftp.EntryTypeFile {
+			continue
+		}
+		files = append(files, File{Name: e.Name, Size: int64(e.Size), ModTime: e.Time})
+	}
+	return files, nil
+}
+
+// ftpFile is the file being downloaded, ctx is watched until it's closed
+type ftpFile struct {
+	*ftp.Response
+	stop func() bool
+}
+
+func (f *ftpFile) Close() error {
+	f.stop()
+	return f.Response.Close()
+}
+
+func (f *ftpBackend) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	stop := f.conns.watch(ctx)
+	resp, err := f.c.Retr(p)
+	if err != nil {
+		stop()
+		return nil, ftpErr("RETR", p, err)
+	}
+	return &ftpFile{Response: resp, stop: stop}, nil
+}
+
+func (f *ftpBackend) create(ctx context.Context, p string, r io.Reader) error {
+	defer f.conns.watch(ctx)()
+	// the directory may already exist
+	f.c.MakeDir(path.Dir(p))
+	return f.c.Stor(p, r)
+}
+
+func (f *ftpBackend) Close() error {
+	return f.c.Quit()
+}
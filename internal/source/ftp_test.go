@@ -0,0 +1,204 @@
+package source_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/source"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFTP serves root in the extended passive mode, it knows just
+// enough commands for the FTP client: MLSD, RETR, STOR and MKD.
+// RETR of hang.csv never completes
+func fakeFTP(t *testing.T, root, password string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTP(conn, root, password)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFTP(conn net.Conn, root, password string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var pasv net.Listener
+	// data accepts the connection opened after EPSV
+	data := func() net.Conn {
+		if pasv == nil {
+			return nil
+		}
+		defer func() { pasv.Close(); pasv = nil }()
+		dc, err := pasv.Accept()
+		if err != nil {
+			return nil
+		}
+		return dc
+	}
+
+	reply("220 fake FTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		p := filepath.Join(root, filepath.FromSlash(arg))
+
+		switch cmd {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			if arg != password {
+				reply("530 login incorrect")
+				continue
+			}
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n MLST type*;size*;modify*;\r\n211 End")
+		case "TYPE":
+			reply("200 ok")
+		case "EPSV":
+			if pasv, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 can't open data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", pasv.Addr().(*net.TCPAddr).Port)
+		case "MLSD":
+			dc := data()
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				dc.Close()
+				reply("550 no such directory")
+				continue
+			}
+			reply("150 listing")
+			for _, e := range entries {
+				fi, _ := e.Info()
+				typ := "file"
+				if e.IsDir() {
+					typ = "dir"
+				}
+				fmt.Fprintf(dc, "type=%s;size=%d;modify=%s; %s\r\n", typ, fi.Size(), fi.ModTime().UTC().Format("20060102150405"), e.Name())
+			}
+			dc.Close()
+			reply("226 done")
+		case "RETR":
+			dc := data()
+			f, err := os.Open(p)
+			if err != nil {
+				dc.Close()
+				reply("550 no such file")
+				continue
+			}
+			reply("150 sending")
+			io.Copy(dc, f)
+			f.Close()
+			if filepath.Base(p) == "hang.csv" {
+				// the server hangs until the client gives up
+				io.Copy(io.Discard, dc)
+			}
+			dc.Close()
+			reply("226 done")
+		case "STOR":
+			dc := data()
+			reply("150 receiving")
+			content, _ := io.ReadAll(dc)
+			dc.Close()
+			if err := os.WriteFile(p, content, 0644); err != nil {
+				reply("550 could not store")
+				continue
+			}
+			reply("226 done")
+		case "MKD":
+			if err := os.Mkdir(p, 0755); err != nil {
+				reply("550 could not create")
+				continue
+			}
+			reply("257 created")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTP(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"in/a.csv": "a;1\n", "in/b.csv": "b;2\n", "in/readme.txt": "c"})
+	os.Mkdir(filepath.Join(dir, "in", "dir.csv"), 0755)
+	addr := fakeFTP(t, dir, "123")
+
+	t.Setenv("FTP_PASSWORD", "123")
+	src, err := source.New(context.Background(), "ftp://USERNAME@"+addr+"/in/*.csv", source.Options{})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	defer src.Close()
+	testSource(t, src, true)
+
+	t.Setenv("FTP_PASSWORD", "wrong")
+	if _, err := source.New(context.Background(), "ftp://USERNAME@"+addr+"/in/*.csv", source.Options{}); err == nil {
+		t.Error("want error for the wrong password, got nil")
+	}
+}
+
+func TestFTPTimeout(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"in/hang.csv": "a;1\n"})
+	addr := fakeFTP(t, dir, "123")
+
+	t.Setenv("FTP_PASSWORD", "123")
+	src, err := source.New(context.Background(), "ftp://USERNAME@"+addr+"/in/*.csv", source.Options{})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	defer src.Close()
+	files, err := src.List(context.Background())
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+
+	// the transfer is interrupted by ctx, not by the IO timeout of minutes
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := src.Fetch(ctx, files, t.TempDir())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want context.DeadlineExceeded, got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("want the fetch to stop at the timeout, it hangs")
+	}
+}
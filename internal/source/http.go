@@ -0,0 +1,156 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// httpBackend lists the directory index page (HTML or the JSON of nginx
+// autoindex_format json) and downloads the files with GET. The state
+// files are uploaded with PUT, so the server must accept it (WebDAV)
+type httpBackend struct {
+	client   *http.Client
+	base     string
+	user     string
+	password string
+}
+
+var hrefRe = regexp.MustCompile(`(?i)href\s*=\s*"([^"]+)"`)
+
+func newHTTP(ctx context.Context, rawURL string) (backend, string, error) {
+	user, host, p, err := parseURL(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	scheme, _, _ := strings.Cut(rawURL, "://")
+
+	return &httpBackend{
+		client:   &http.Client{},
+		base:     strings.ToLower(scheme) + "://" + host,
+		user:     user,
+		password: os.Getenv("HTTP_PASSWORD"),
+	}, p, nil
+}
+
+func (h *httpBackend) do(ctx context.Context, method, p string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.base+(&url.URL{Path: p}).EscapedPath(), body)
+	if err != nil {
+		return nil, err
+	}
+	if h.user != "" {
+		req.SetBasicAuth(h.user, h.password)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &fs.PathError{Op: method, Path: p, Err: fs.ErrNotExist}
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, errors.New(method + " " + p + " returned " + resp.Status)
+	}
+	return resp, nil
+}
+
+type autoindexEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	MTime string `json:"mtime"`
+	Size  int64  `json:"size"`
+}
+
+func (h *httpBackend) list(ctx context.Context, dir string) ([]File, error) {
+	resp, err := h.do(ctx, http.MethodGet, strings.TrimSuffix(dir, "/")+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var files []File
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var entries []autoindexEntry
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			return nil, errors.New("Could not parse the index of " + dir + ", the error: " + err.Error())
+		}
+		for _, e := range entries {
+			if e.Type != "file" {
+				continue
+			}
+			mtime, _ := time.Parse(time.RFC1123, e.MTime)
+			files = append(files, File{Name: e.Name, Size: e.Size, ModTime: mtime})
+		}
+		return files, nil
+	}
+
+	// the size and mtime are unknown from the HTML index
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, m := range hrefRe.FindAllSubmatch(page, -1) {
+		href, err := url.PathUnescape(string(m[1]))
+		if err != nil || strings.ContainsAny(href, "?#") || strings.HasSuffix(href, "/") {
+			continue
+		}
+		// absolute links are fine while they point into dir
+		if strings.Contains(href, "://") {
+			continue
+		}
+		if strings.HasPrefix(href, "/") {
+			prefix := strings.TrimSuffix(dir, "/") + "/"
+			if !strings.HasPrefix(href, prefix) {
+				continue
+			}
+			href = strings.TrimPrefix(href, prefix)
+		}
+		href = strings.TrimPrefix(href, "./")
+		if href == "" || strings.Contains(href, "/") || seen[href] {
+			continue
+		}
+		seen[href] = true
+		files = append(files, File{Name: href, Size: -1})
+	}
+	return files, nil
+}
+
+func (h *httpBackend) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, err := h.do(ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (h *httpBackend) create(ctx context.Context, p string, r io.Reader) error {
+	// the body is read into memory to send Content-Length,
+	// the state files are small
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := h.do(ctx, http.MethodPut, p, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (h *httpBackend) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,71 @@
+package source
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// local is a directory on the local filesystem (a mounted volume)
+type local struct{}
+
+func newLocal(ctx context.Context, rawURL string) (backend, string, error) {
+	p := strings.TrimPrefix(rawURL, "file://")
+	abs, err := filepath.Abs(filepath.FromSlash(p))
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.HasSuffix(p, "/") {
+		abs += "/"
+	}
+	return local{}, filepath.ToSlash(abs), nil
+}
+
+func (local) list(ctx context.Context, dir string) ([]File, error) {
+	entries, err := os.ReadDir(filepath.FromSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	for _, e := range entries {
+		// Stat follows the symlinks
+		fi, err := os.Stat(filepath.Join(filepath.FromSlash(dir), e.Name()))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, File{Name: e.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return files, nil
+}
+
+func (local) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	return os.Open(filepath.FromSlash(p))
+}
+
+func (local) create(ctx context.Context, p string, r io.Reader) error {
+	dst := filepath.FromSlash(p)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (local) Close() error {
+	return nil
+}
@@ -0,0 +1,86 @@
+package source
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/rsync"
+)
+
+// rsyncSource pulls the files from the rsync daemon. The state files
+// are kept in the pullcsv-exclude-files module of the same daemon
+type rsyncSource struct {
+	client     *rsync.Client
+	rawURL     string
+	stateURL   string
+	partialDir string
+}
+
+func newRsync(rawURL string, opts Options) (Source, error) {
+	u, err := rsync.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	state := &rsync.URL{User: u.User, Host: u.Host, Port: u.Port, Module: StateDir}
+
+	return &rsyncSource{
+		client:     &rsync.Client{Password: os.Getenv("RSYNC_PASSWORD")},
+		rawURL:     rawURL,
+		stateURL:   "rsync://" + userPrefix(u.User) + state.Addr() + "/" + state.Module + "/",
+		partialDir: opts.PartialDir,
+	}, nil
+}
+
+func userPrefix(user string) string {
+	if user == "" {
+		return ""
+	}
+	return user + "@"
+}
+
+func (s *rsyncSource) List(ctx context.Context) ([]File, error) {
+	rfiles, err := s.client.List(ctx, s.rawURL)
+	files := make([]File, 0, len(rfiles))
+	for _, f := range rfiles {
+		files = append(files, File{Name: f.Name, Size: f.Size, ModTime: f.ModTime})
+	}
+	return files, err
+}
+
+// Fetch downloads files in one rsync session, so the daemon
+// sends only the missing parts of the partial files
+func (s *rsyncSource) Fetch(ctx context.Context, files []File, dstDir string) ([]Result, error) {
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		names[f.Name] = true
+	}
+
+	rresults, err := s.client.Download(ctx, s.rawURL, dstDir, rsync.DownloadOptions{
+		PartialDir: s.partialDir,
+		Filter:     func(f rsync.File) bool { return names[f.Name] },
+	})
+	results := make([]Result, 0, len(rresults))
+	for _, r := range rresults {
+		results = append(results, Result{File: File{Name: r.Name, Size: r.Size, ModTime: r.ModTime}, Err: r.Err})
+	}
+	return results, err
+}
+
+func (s *rsyncSource) Get(ctx context.Context, name, localPath string) error {
+	dir := filepath.Dir(localPath)
+	if _, err := s.client.Download(ctx, s.stateURL+name, dir, rsync.DownloadOptions{}); err != nil {
+		return err
+	}
+	if filepath.Base(localPath) == name {
+		return nil
+	}
+	return os.Rename(filepath.Join(dir, name), localPath)
+}
+
+func (s *rsyncSource) Put(ctx context.Context, localPath, name string) error {
+	return s.client.Upload(ctx, localPath, s.stateURL+name)
+}
+
+func (s *rsyncSource) Close() error {
+	return nil
+}
@@ -0,0 +1,472 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP protocol version 3 (draft-ietf-secsh-filexfer-02), the version
+// every server supports
+const (
+	sftpVersion = 3
+
+	fxpInit      = 1
+	fxpVersion   = 2
+	fxpOpen      = 3
+	fxpClose     = 4
+	fxpRead      = 5
+	fxpWrite     = 6
+	fxpOpendir   = 11
+	fxpReaddir   = 12
+	fxpRemove    = 13
+	fxpMkdir     = 14
+	fxpRename    = 18
+	fxpStatus    = 101
+	fxpHandle    = 102
+	fxpData      = 103
+	fxpName      = 104
+	fxpAttrs     = 105
+	fxfRead      = 0x01
+	fxfWrite     = 0x02
+	fxfCreat     = 0x08
+	fxfTrunc     = 0x10
+	fxOK         = 0
+	fxEOF        = 1
+	fxNoSuchFile = 2
+
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+
+	sftpChunkSize = 32 * 1024
+	// sftpMaxPacket limits the packets from the server
+	sftpMaxPacket = 256 * 1024
+)
+
+// sftpBackend is the SFTP client over the SSH connection. The requests
+// are sent one by one, the host key is checked against SFTP_KNOWN_HOSTS
+type sftpBackend struct {
+	client *ssh.Client
+	sess   *ssh.Session
+	w      io.WriteCloser
+	r      *bufio.Reader
+
+	conns *connSet
+
+	mu sync.Mutex
+	id uint32
+}
+
+func newSFTP(ctx context.Context, rawURL string) (backend, string, error) {
+	user, host, p, err := parseURL(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	knownHosts := os.Getenv("SFTP_KNOWN_HOSTS")
+	if knownHosts == "" {
+		return nil, "", errors.New("Env variable SFTP_KNOWN_HOSTS must be set for " + rawURL)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, "", errors.New("Could not read known hosts " + knownHosts + ", the error: " + err.Error())
+	}
+
+	var auth []ssh.AuthMethod
+	if keyFile := os.Getenv("SFTP_PRIVATE_KEY"); keyFile != "" {
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, "", errors.New("Could not read private key " + keyFile + ", the error: " + err.Error())
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, "", errors.New("Could not parse private key " + keyFile + ", the error: " + err.Error())
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	conns := &connSet{}
+	stop := conns.watch(ctx)
+	defer stop()
+	dialer := net.Dialer{Timeout: time.Minute}
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, "", errors.New("Could not connect to " + host + ", the error: " + err.Error())
+	}
+	conn, chans, reqs, err := ssh.NewClientConn(conns.wrap(nc), host, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         time.Minute,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, "", errors.New("Could not establish SSH connection to " + host + ", the error: " + err.Error())
+	}
+	s := &sftpBackend{client: ssh.NewClient(conn, chans, reqs), conns: conns}
+
+	if err := s.start(); err != nil {
+		s.Close()
+		return nil, "", errors.New("Could not start SFTP session on " + host + ", the error: " + err.Error())
+	}
+
+	return s, p, nil
+}
+
+func (s *sftpBackend) start() (err error) {
+	if s.sess, err = s.client.NewSession(); err != nil {
+		return err
+	}
+	if s.w, err = s.sess.StdinPipe(); err != nil {
+		return err
+	}
+	stdout, err := s.sess.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	s.r = bufio.NewReaderSize(stdout, sftpChunkSize+1024)
+	if err := s.sess.RequestSubsystem("sftp"); err != nil {
+		return err
+	}
+
+	hello := binary.BigEndian.AppendUint32(nil, 5)
+	hello = append(hello, fxpInit)
+	hello = binary.BigEndian.AppendUint32(hello, sftpVersion)
+	if _, err := s.w.Write(hello); err != nil {
+		return err
+	}
+	typ, data, err := s.readPacket()
+	if err != nil {
+		return err
+	}
+	if typ != fxpVersion || len(data) < 4 {
+		return errors.New("unexpected SFTP packet " + strconv.Itoa(int(typ)) + " instead of the version")
+	}
+	if v := binary.BigEndian.Uint32(data); v < sftpVersion {
+		return errors.New("the server speaks too old SFTP version " + strconv.Itoa(int(v)))
+	}
+	return nil
+}
+
+func (s *sftpBackend) readPacket() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > sftpMaxPacket {
+		return 0, nil, errors.New("invalid SFTP packet length " + strconv.Itoa(int(length)))
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(s.r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// request sends the packet and returns the response without the request id
+func (s *sftpBackend) request(ctx context.Context, typ byte, payload []byte) (byte, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.conns.watch(ctx)()
+
+	s.id++
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+4+len(payload)))
+	packet = append(packet, typ)
+	packet = binary.BigEndian.AppendUint32(packet, s.id)
+	packet = append(packet, payload...)
+	if _, err := s.w.Write(packet); err != nil {
+		return 0, nil, err
+	}
+
+	respType, data, err := s.readPacket()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != s.id {
+		return 0, nil, errors.New("unexpected SFTP response id")
+	}
+	return respType, data[4:], nil
+}
+
+// sftpBuffer decodes the SFTP data types
+type sftpBuffer struct {
+	b   []byte
+	err error
+}
+
+func (b *sftpBuffer) uint32() uint32 {
+	if len(b.b) < 4 {
+		b.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.b)
+	b.b = b.b[4:]
+	return v
+}
+
+func (b *sftpBuffer) uint64() uint64 {
+	return uint64(b.uint32())<<32 | uint64(b.uint32())
+}
+
+func (b *sftpBuffer) string() string {
+	n := b.uint32()
+	if uint32(len(b.b)) < n {
+		b.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	v := string(b.b[:n])
+	b.b = b.b[n:]
+	return v
+}
+
+type sftpAttrs struct {
+	size    int64
+	mode    uint32
+	modTime time.Time
+	hasMode bool
+}
+
+func (b *sftpBuffer) attrs() (a sftpAttrs) {
+	flags := b.uint32()
+	if flags&attrSize != 0 {
+		a.size = int64(b.uint64())
+	}
+	if flags&attrUIDGID != 0 {
+		b.uint32()
+		b.uint32()
+	}
+	if flags&attrPermissions != 0 {
+		a.mode, a.hasMode = b.uint32(), true
+	}
+	if flags&attrACModTime != 0 {
+		b.uint32()
+		a.modTime = time.Unix(int64(b.uint32()), 0)
+	}
+	if flags&attrExtended != 0 {
+		for n := b.uint32(); n > 0 && b.err == nil; n-- {
+			b.string()
+			b.string()
+		}
+	}
+	return a
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// status returns the error of the SSH_FXP_STATUS response, nil for SSH_FX_OK
+func status(op, p string, typ byte, data []byte) error {
+	if typ != fxpStatus {
+		return errors.New(op + " " + p + ": unexpected SFTP response " + strconv.Itoa(int(typ)))
+	}
+	b := &sftpBuffer{b: data}
+	code, msg := b.uint32(), b.string()
+	switch code {
+	case fxOK:
+		return nil
+	case fxEOF:
+		return io.EOF
+	case fxNoSuchFile:
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return errors.New(op + " " + p + ": " + msg + " (SFTP status " + strconv.Itoa(int(code)) + ")")
+}
+
+func (s *sftpBackend) handle(ctx context.Context, op, p string, typ byte, payload []byte) (string, error) {
+	respType, data, err := s.request(ctx, typ, payload)
+	if err != nil {
+		return "", err
+	}
+	if respType != fxpHandle {
+		return "", status(op, p, respType, data)
+	}
+	b := &sftpBuffer{b: data}
+	h := b.string()
+	return h, b.err
+}
+
+func (s *sftpBackend) close(h string) error {
+	typ, data, err := s.request(context.Background(), fxpClose, appendString(nil, h))
+	if err != nil {
+		return err
+	}
+	return status("close", h, typ, data)
+}
+
+func (s *sftpBackend) list(ctx context.Context, dir string) ([]File, error) {
+	if dir == "" {
+		dir = "."
+	}
+	h, err := s.handle(ctx, "opendir", dir, fxpOpendir, appendString(nil, dir))
+	if err != nil {
+		return nil, err
+	}
+	defer s.close(h)
+
+	var files []File
+	for {
+		typ, data, err := s.request(ctx, fxpReaddir, appendString(nil, h))
+		if err != nil {
+			return nil, err
+		}
+		if typ != fxpName {
+			if err := status("readdir", dir, typ, data); err != io.EOF {
+				return nil, err
+			}
+			return files, nil
+		}
+
+		b := &sftpBuffer{b: data}
+		for n := b.uint32(); n > 0 && b.err == nil; n-- {
+			name := b.string()
+			b.string() // longname
+			a := b.attrs()
+			if a.hasMode && a.mode&0170000 != 0100000 {
+				continue
+			}
+			files = append(files, File{Name: name, Size: a.size, ModTime: a.modTime})
+		}
+		if b.err != nil {
+			return nil, errors.New("readdir " + dir + ": malformed SFTP response")
+		}
+	}
+}
+
+// sftpFile reads the remote file chunk by chunk
+type sftpFile struct {
+	ctx    context.Context
+	s      *sftpBackend
+	p      string
+	h      string
+	offset uint64
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if len(p) > sftpChunkSize {
+		p = p[:sftpChunkSize]
+	}
+	payload := appendString(nil, f.h)
+	payload = binary.BigEndian.AppendUint64(payload, f.offset)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(p)))
+	typ, data, err := f.s.request(f.ctx, fxpRead, payload)
+	if err != nil {
+		return 0, err
+	}
+	if typ != fxpData {
+		return 0, status("read", f.p, typ, data)
+	}
+	b := &sftpBuffer{b: data}
+	chunk := b.string()
+	if b.err != nil || len(chunk) > len(p) {
+		return 0, errors.New("read " + f.p + ": malformed SFTP response")
+	}
+	n := copy(p, chunk)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	return f.s.close(f.h)
+}
+
+func (s *sftpBackend) open(ctx context.Context, p string) (io.ReadCloser, error) {
+	payload := appendString(nil, p)
+	payload = binary.BigEndian.AppendUint32(payload, fxfRead)
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	h, err := s.handle(ctx, "open", p, fxpOpen, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{ctx: ctx, s: s, p: p, h: h}, nil
+}
+
+// create writes a temp file and renames it to p,
+// so the state file is never seen half written
+func (s *sftpBackend) create(ctx context.Context, p string, r io.Reader) error {
+	// the directory may already exist
+	payload := appendString(nil, path.Dir(p))
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	s.request(ctx, fxpMkdir, payload)
+
+	tmp := path.Join(path.Dir(p), "."+path.Base(p)+".tmp")
+	payload = appendString(nil, tmp)
+	payload = binary.BigEndian.AppendUint32(payload, fxfWrite|fxfCreat|fxfTrunc)
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	h, err := s.handle(ctx, "open", tmp, fxpOpen, payload)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sftpChunkSize)
+	var offset uint64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			payload := appendString(nil, h)
+			payload = binary.BigEndian.AppendUint64(payload, offset)
+			payload = appendString(payload, string(buf[:n]))
+			typ, data, werr := s.request(ctx, fxpWrite, payload)
+			if werr == nil {
+				werr = status("write", tmp, typ, data)
+			}
+			if werr != nil {
+				s.close(h)
+				return werr
+			}
+			offset += uint64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.close(h)
+			return err
+		}
+	}
+	if err := s.close(h); err != nil {
+		return err
+	}
+
+	// SSH_FXP_RENAME of SFTP v3 fails if p exists, so the old file is removed first
+	s.request(ctx, fxpRemove, appendString(nil, p))
+	typ, data, err := s.request(ctx, fxpRename, appendString(appendString(nil, tmp), p))
+	if err != nil {
+		return err
+	}
+	return status("rename", tmp, typ, data)
+}
+
+func (s *sftpBackend) Close() error {
+	if s.sess != nil {
+		s.sess.Close()
+	}
+	return s.client.Close()
+}
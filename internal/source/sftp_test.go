@@ -0,0 +1,301 @@
+package source_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/source"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// fakeSFTP serves root over the SSH "sftp" subsystem with the password
+// auth and returns its address with the known_hosts file of the host key
+func fakeSFTP(t *testing.T, root, password string) (string, string) {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() != "USERNAME" || string(pass) != password {
+				return nil, errors.New("access denied")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				_, chans, reqs, err := ssh.NewServerConn(nc, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nch := range chans {
+					ch, reqs, err := nch.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						for req := range reqs {
+							ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+							req.Reply(ok, nil)
+							if ok {
+								go func() {
+									serveSFTP(ch, root)
+									ch.Close()
+								}()
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(ln.Addr().String())}, hostKey.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ln.Addr().String(), knownHosts
+}
+
+type sftpPacket struct {
+	b []byte
+}
+
+func (p *sftpPacket) uint32() uint32 {
+	if len(p.b) < 4 {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *sftpPacket) string() string {
+	n := int(p.uint32())
+	if n > len(p.b) {
+		n = len(p.b)
+	}
+	v := string(p.b[:n])
+	p.b = p.b[n:]
+	return v
+}
+
+func putString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// serveSFTP is a minimal SFTP v3 server: a request is answered before the next one is read
+func serveSFTP(rw io.ReadWriter, root string) {
+	files := map[string]*os.File{}
+	dirs := map[string][]fs.DirEntry{}
+	dirDirs := map[string]string{}
+	next := 0
+
+	send := func(typ byte, id uint32, payload []byte) {
+		packet := binary.BigEndian.AppendUint32(nil, uint32(5+len(payload)))
+		packet = append(packet, typ)
+		packet = binary.BigEndian.AppendUint32(packet, id)
+		rw.Write(append(packet, payload...))
+	}
+	status := func(id uint32, err error) {
+		code := uint32(0)
+		switch {
+		case err == io.EOF:
+			code = 1
+		case errors.Is(err, fs.ErrNotExist):
+			code = 2
+		case err != nil:
+			code = 4
+		}
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		send(101, id, putString(putString(binary.BigEndian.AppendUint32(nil, code), msg), ""))
+	}
+	handle := func(id uint32) string {
+		next++
+		h := strconv.Itoa(next)
+		send(102, id, putString(nil, h))
+		return h
+	}
+
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(rw, header[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return
+		}
+		if header[4] == 1 {
+			rw.Write([]byte{0, 0, 0, 5, 2, 0, 0, 0, 3})
+			continue
+		}
+
+		p := &sftpPacket{b: data}
+		id := p.uint32()
+		switch header[4] {
+		case 3: // open
+			name := filepath.Join(root, p.string())
+			flags := p.uint32()
+			mode := os.O_RDONLY
+			if flags&0x02 != 0 {
+				mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			}
+			f, err := os.OpenFile(name, mode, 0644)
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			files[handle(id)] = f
+		case 4: // close
+			h := p.string()
+			if f, ok := files[h]; ok {
+				f.Close()
+			}
+			delete(files, h)
+			delete(dirs, h)
+			status(id, nil)
+		case 5: // read
+			f := files[p.string()]
+			offset := uint64(p.uint32())<<32 | uint64(p.uint32())
+			buf := make([]byte, p.uint32())
+			n, err := f.ReadAt(buf, int64(offset))
+			if n == 0 {
+				status(id, err)
+				continue
+			}
+			send(103, id, putString(nil, string(buf[:n])))
+		case 6: // write
+			f := files[p.string()]
+			offset := uint64(p.uint32())<<32 | uint64(p.uint32())
+			_, err := f.WriteAt([]byte(p.string()), int64(offset))
+			status(id, err)
+		case 11: // opendir
+			name := filepath.Join(root, p.string())
+			entries, err := os.ReadDir(name)
+			if err != nil {
+				status(id, err)
+				continue
+			}
+			h := handle(id)
+			dirs[h], dirDirs[h] = entries, name
+		case 12: // readdir
+			h := p.string()
+			entries := dirs[h]
+			if len(entries) == 0 {
+				status(id, io.EOF)
+				continue
+			}
+			dirs[h] = nil
+			payload := binary.BigEndian.AppendUint32(nil, uint32(len(entries)))
+			for _, e := range entries {
+				fi, _ := os.Stat(filepath.Join(dirDirs[h], e.Name()))
+				mode := uint32(0100644)
+				if fi.IsDir() {
+					mode = 040755
+				}
+				payload = putString(putString(payload, e.Name()), e.Name())
+				payload = binary.BigEndian.AppendUint32(payload, 0x01|0x04|0x08)
+				payload = binary.BigEndian.AppendUint64(payload, uint64(fi.Size()))
+				payload = binary.BigEndian.AppendUint32(payload, mode)
+				payload = binary.BigEndian.AppendUint32(payload, uint32(fi.ModTime().Unix()))
+				payload = binary.BigEndian.AppendUint32(payload, uint32(fi.ModTime().Unix()))
+			}
+			send(104, id, payload)
+		case 13: // remove
+			status(id, os.Remove(filepath.Join(root, p.string())))
+		case 14: // mkdir
+			status(id, os.Mkdir(filepath.Join(root, p.string()), 0755))
+		case 18: // rename
+			from := filepath.Join(root, p.string())
+			to := filepath.Join(root, p.string())
+			if _, err := os.Stat(to); err == nil {
+				status(id, errors.New("file exists"))
+				continue
+			}
+			status(id, os.Rename(from, to))
+		default:
+			status(id, errors.New("unsupported"))
+		}
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"in/a.csv": "a;1\n", "in/b.csv": "b;2\n", "in/readme.txt": "c"})
+	os.Mkdir(filepath.Join(dir, "in", "dir.csv"), 0755)
+	addr, knownHosts := fakeSFTP(t, dir, "123")
+	rawURL := "sftp://USERNAME@" + addr + "/in/*.csv"
+
+	t.Setenv("SFTP_PASSWORD", "123")
+	if _, err := source.New(context.Background(), rawURL, source.Options{}); err == nil {
+		t.Error("want error without known hosts, got nil")
+	}
+
+	t.Setenv("SFTP_KNOWN_HOSTS", knownHosts)
+	src, err := source.New(context.Background(), rawURL, source.Options{})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	defer src.Close()
+	testSource(t, src, true)
+
+	// the state file is replaced on the second put
+	state := filepath.Join(t.TempDir(), "exFN")
+	os.WriteFile(state, []byte("c.csv\n"), 0644)
+	if err := src.Put(context.Background(), state, "exFN"); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "in", source.StateDir, "exFN")); string(got) != "c.csv\n" {
+		t.Errorf("want the replaced state file, got: %q", got)
+	}
+
+	t.Setenv("SFTP_PASSWORD", "wrong")
+	if _, err := source.New(context.Background(), rawURL, source.Options{}); err == nil {
+		t.Error("want error for the wrong password, got nil")
+	}
+
+	other, _ := fakeSFTP(t, dir, "123")
+	t.Setenv("SFTP_PASSWORD", "123")
+	if _, err := source.New(context.Background(), "sftp://USERNAME@"+other+"/in/*.csv", source.Options{}); err == nil {
+		t.Error("want error for the unknown host key, got nil")
+	}
+}
@@ -0,0 +1,281 @@
+// Package source abstracts the places pullcsv pulls the files from.
+// The implementation is selected by the scheme of the source URL:
+// rsync://, sftp://, ftp://, http(s)://, s3:// or a local path (file://)
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"pullcsv/internal/rsync"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StateDir is the remote directory keeping the state (exclude) files:
+// the rsync module of the daemon or the subdirectory of the source directory
+// for the other sources
+const StateDir = "pullcsv-exclude-files"
+
+// ErrPartial is returned by Fetch if some of the files were not fetched
+var ErrPartial = errors.New("Some files could not be fetched")
+
+// File is a remote file. Size is -1 and ModTime is zero
+// if the source doesn't report them
+type File struct {
+	// Name is the file name relative to the source directory
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Result is the result of fetching a single file
+type Result struct {
+	File
+	Err error
+}
+
+// Source lists and fetches the files matching the source URL
+// and keeps the state file next to them
+type Source interface {
+	// List returns the files matching the source URL
+	List(ctx context.Context) ([]File, error)
+	// Fetch downloads files into dstDir keeping their mtime
+	Fetch(ctx context.Context, files []File, dstDir string) ([]Result, error)
+	// Get downloads the state file name from StateDir to localPath
+	Get(ctx context.Context, name, localPath string) error
+	// Put uploads the local state file to StateDir as name
+	Put(ctx context.Context, localPath, name string) error
+	Close() error
+}
+
+// Options tunes the sources
+type Options struct {
+	// PartialDir keeps the interrupted downloads to resume them (rsync only)
+	PartialDir string
+}
+
+// New returns the Source for rawURL. The credentials are taken
+// from the env variables, see the README. Connecting stops when ctx is done
+func New(ctx context.Context, rawURL string, opts Options) (Source, error) {
+	scheme := "file"
+	if i := strings.Index(rawURL, "://"); i > 0 {
+		scheme = strings.ToLower(rawURL[:i])
+	}
+
+	switch scheme {
+	case "rsync":
+		return newRsync(rawURL, opts)
+	case "sftp":
+		return newRemote(ctx, rawURL, newSFTP)
+	case "ftp":
+		return newRemote(ctx, rawURL, newFTP)
+	case "http", "https":
+		return newRemote(ctx, rawURL, newHTTP)
+	case "s3":
+		return newRemote(ctx, rawURL, newS3)
+	case "file":
+		return newRemote(ctx, rawURL, newLocal)
+	}
+
+	return nil, errors.New("Unsupported scheme " + scheme + " in " + rawURL)
+}
+
+// ExitCode returns the rsync exit code for err (see helpers.GetRsyncExitCodeMeaning),
+// so the exit code metrics mean the same whatever the source is
+func ExitCode(err error) int {
+	var re *rsync.Error
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &re):
+		return re.Code
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return 30
+	case errors.Is(err, ErrPartial), errors.Is(err, os.ErrNotExist):
+		return 23
+	}
+	return 10
+}
+
+// Exclude returns files without the ones matching the exclude patterns
+// (the base name is matched if the pattern has no slash, as rsync does)
+func Exclude(files []File, patterns []string) []File {
+	var result []File
+	for _, f := range files {
+		excluded := false
+		for _, pattern := range patterns {
+			name := f.Name
+			if !strings.Contains(pattern, "/") {
+				name = path.Base(name)
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// parseURL splits SCHEME://[USER@]HOST[:PORT]/PATH into its parts. Like rsync.ParseURL
+// it doesn't use net/url, since the path is a glob and may contain '?', '#' and '%'
+func parseURL(rawURL string) (user, host, p string, err error) {
+	_, rest, found := strings.Cut(rawURL, "://")
+	if !found {
+		return "", "", "", errors.New("The URL " + rawURL + " has no scheme")
+	}
+	host, p, _ = strings.Cut(rest, "/")
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i], host[i+1:]
+	}
+	if host == "" {
+		return "", "", "", errors.New("The URL " + rawURL + " has no host")
+	}
+	return user, host, "/" + p, nil
+}
+
+// backend is the storage behind the remote source,
+// all the paths are slash separated
+type backend interface {
+	// list returns the regular files in dir
+	list(ctx context.Context, dir string) ([]File, error)
+	open(ctx context.Context, p string) (io.ReadCloser, error)
+	create(ctx context.Context, p string, r io.Reader) error
+	Close() error
+}
+
+// remote is the Source on top of the backend: it matches the last
+// element of the URL path as a glob against the files of the directory
+type remote struct {
+	b        backend
+	dir      string
+	pattern  string
+	stateDir string
+}
+
+// connectFunc connects the backend for rawURL and returns the path part of rawURL
+type connectFunc func(ctx context.Context, rawURL string) (b backend, p string, err error)
+
+// newRemote connects the backend and splits the path of rawURL
+// into the directory and the glob
+func newRemote(ctx context.Context, rawURL string, connect connectFunc) (Source, error) {
+	b, p, err := connect(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &remote{b: b}
+	if strings.HasSuffix(p, "/") {
+		r.dir = strings.TrimSuffix(p, "/")
+	} else {
+		r.dir, r.pattern = path.Split(p)
+		r.dir = strings.TrimSuffix(r.dir, "/")
+	}
+	if r.dir == "" && strings.HasPrefix(p, "/") {
+		r.dir = "/"
+	}
+	if _, err := path.Match(r.pattern, ""); err != nil {
+		b.Close()
+		return nil, errors.New("Invalid pattern " + r.pattern + " in " + rawURL)
+	}
+	r.stateDir = path.Join(r.dir, StateDir)
+
+	return r, nil
+}
+
+func (r *remote) List(ctx context.Context) ([]File, error) {
+	all, err := r.b.list(ctx, r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []File
+	for _, f := range all {
+		if ok, _ := path.Match(r.pattern, f.Name); ok || r.pattern == "" {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	return files, nil
+}
+
+func (r *remote) Fetch(ctx context.Context, files []File, dstDir string) ([]Result, error) {
+	var results []Result
+	failed := false
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		err := r.fetch(ctx, path.Join(r.dir, f.Name), filepath.Join(dstDir, filepath.FromSlash(f.Name)), f.ModTime)
+		if err != nil {
+			failed = true
+		}
+		results = append(results, Result{File: f, Err: err})
+	}
+
+	if err := ctx.Err(); err != nil {
+		return results, err
+	}
+	if failed {
+		return results, ErrPartial
+	}
+	return results, nil
+}
+
+// fetch downloads p into a temp file next to dst and renames it,
+// so a failed download doesn't leave half of the file
+func (r *remote) fetch(ctx context.Context, p, dst string, modTime time.Time) error {
+	rc, err := r.b.open(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		return errors.New("Could not download " + p + ", the error: " + err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (r *remote) Get(ctx context.Context, name, localPath string) error {
+	return r.fetch(ctx, path.Join(r.stateDir, name), localPath, time.Time{})
+}
+
+func (r *remote) Put(ctx context.Context, localPath, name string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return r.b.create(ctx, path.Join(r.stateDir, name), f)
+}
+
+func (r *remote) Close() error {
+	return r.b.Close()
+}
@@ -0,0 +1,216 @@
+package source_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pullcsv/internal/rsync"
+	"pullcsv/internal/source"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var mtime = time.Date(2024, 2, 24, 10, 0, 0, 0, time.UTC)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+}
+
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	got := map[string]string{}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[e.Name()] = string(data)
+	}
+	return got
+}
+
+// testSource runs the pullcsv cycle against src: gets the state file, lists
+// and fetches the files which are not in the state file and puts the state back.
+// The remote dir must contain a.csv, b.csv and readme.txt, src must match *.csv
+func testSource(t *testing.T, src source.Source, checkModTime bool) {
+	t.Helper()
+	ctx := context.Background()
+
+	state := filepath.Join(t.TempDir(), "exFN")
+	if err := src.Get(ctx, "exFN", state); !errors.Is(err, os.ErrNotExist) || source.ExitCode(err) != 23 {
+		t.Errorf("want not exist error for missing state file, got: %v", err)
+	}
+
+	files, err := src.List(ctx)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if want := []string{"a.csv", "b.csv"}; !cmp.Equal(want, names) {
+		t.Errorf("want: %v, got: %v", want, names)
+	}
+
+	dst := t.TempDir()
+	results, err := src.Fetch(ctx, source.Exclude(files, []string{"a.csv"}), dst)
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if len(results) != 1 || results[0].Name != "b.csv" || results[0].Err != nil {
+		t.Errorf("want the result of b.csv, got: %+v", results)
+	}
+	if want, got := map[string]string{"b.csv": "b;2\n"}, readDir(t, dst); !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "b.csv")); checkModTime && (err != nil || !fi.ModTime().Equal(mtime)) {
+		t.Errorf("want mtime %v of the fetched file, got: %v, %v", mtime, fi.ModTime(), err)
+	}
+
+	os.WriteFile(state, []byte("a.csv\nb.csv\n"), 0644)
+	if err := src.Put(ctx, state, "exFN"); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	os.Remove(state)
+	if err := src.Get(ctx, "exFN", state); err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	if got, _ := os.ReadFile(state); string(got) != "a.csv\nb.csv\n" {
+		t.Errorf("want the state file back, got: %q", got)
+	}
+
+	results, err = src.Fetch(ctx, []source.File{{Name: "doesntexist.csv"}}, dst)
+	if !errors.Is(err, source.ErrPartial) || len(results) != 1 || results[0].Err == nil {
+		t.Errorf("want partial error for the missing file, got: %v, %+v", err, results)
+	}
+}
+
+var remoteFiles = map[string]string{"a.csv": "a;1\n", "b.csv": "b;2\n", "readme.txt": "c"}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, remoteFiles)
+	os.Mkdir(filepath.Join(dir, "dir.csv"), 0755)
+
+	for _, rawURL := range []string{dir + "/*.csv", "file://" + dir + "/*.csv"} {
+		src, err := source.New(context.Background(), rawURL, source.Options{})
+		if err != nil {
+			t.Fatalf("%s: want nil, got error: %v", rawURL, err)
+		}
+		testSource(t, src, true)
+		src.Close()
+		os.RemoveAll(filepath.Join(dir, source.StateDir))
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"in/a.csv": "a;1\n", "in/b.csv": "b;2\n", "in/readme.txt": "c"})
+	os.Mkdir(filepath.Join(dir, "in", "dir.csv"), 0755)
+
+	t.Setenv("HTTP_PASSWORD", "123")
+	files := http.FileServer(http.Dir(dir))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "USERNAME" || password != "123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPut {
+			p := filepath.Join(dir, filepath.FromSlash(r.URL.Path))
+			os.MkdirAll(filepath.Dir(p), 0755)
+			data, _ := io.ReadAll(r.Body)
+			os.WriteFile(p, data, 0644)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	rawURL := strings.Replace(ts.URL, "http://", "http://USERNAME@", 1) + "/in/*.csv"
+	src, err := source.New(context.Background(), rawURL, source.Options{})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	defer src.Close()
+	testSource(t, src, false)
+
+	t.Setenv("HTTP_PASSWORD", "wrong")
+	src, err = source.New(context.Background(), rawURL, source.Options{})
+	if err != nil {
+		t.Fatalf("want nil, got error: %v", err)
+	}
+	defer src.Close()
+	if _, err := src.List(context.Background()); err == nil {
+		t.Error("want error for the wrong password, got nil")
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, rawURL := range []string{"gopher://server-name/pullcsv/*csv", "rsync://", "sftp:///pullcsv/*csv", "/tmp/[.csv"} {
+		if _, err := source.New(context.Background(), rawURL, source.Options{}); err == nil {
+			t.Errorf("%s: want error for invalid input, got nil", rawURL)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		err  error
+		want int
+	}
+
+	testCases := []testCase{
+		{err: nil, want: 0},
+		{err: &rsync.Error{Code: 5, Msg: "auth failed"}, want: 5},
+		{err: context.DeadlineExceeded, want: 30},
+		{err: source.ErrPartial, want: 23},
+		{err: &os.PathError{Op: "open", Path: "/a", Err: os.ErrNotExist}, want: 23},
+		{err: errors.New("connection refused"), want: 10},
+	}
+
+	for _, tc := range testCases {
+		if got := source.ExitCode(tc.err); got != tc.want {
+			t.Errorf("%v: want: %d, got: %d", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestExclude(t *testing.T) {
+	t.Parallel()
+
+	files := []source.File{{Name: "prices_20240224.csv"}, {Name: "stocks_20240224.csv"}, {Name: "sub/stocks_20240223.csv"}}
+	got := source.Exclude(files, []string{"prices_20240224.csv", "*_20240223.csv"})
+	if want := []source.File{{Name: "stocks_20240224.csv"}}; !cmp.Equal(want, got) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
@@ -0,0 +1,182 @@
+// Package transcode converts the downloaded text files to UTF-8
+// without BOM and with LF line endings
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/saintfish/chardet"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// Auto detects the source encoding of every file
+const Auto = "auto"
+
+// sampleSize is how much of the file the encoding is detected by
+const sampleSize = 64 * 1024
+
+var bom = []byte{0xef, 0xbb, 0xbf}
+
+// Lookup returns the encoding by its WHATWG name or label,
+// e.g. windows-1251, cp1251, koi8-r, utf-16le
+func Lookup(name string) (encoding.Encoding, error) {
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, errors.New("Unknown encoding " + name)
+	}
+	return enc, nil
+}
+
+// File rewrites the file in UTF-8 without BOM and with LF line endings.
+// name is the source encoding or Auto. A file with a BOM is decoded by its BOM and
+// a valid UTF-8 file is never decoded from name, so converting a file twice is safe.
+// It returns the name of the source encoding and whether the file was rewritten
+func File(path, name string) (from string, converted bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	sample := make([]byte, sampleSize)
+	n, err := io.ReadFull(f, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	sample = sample[:n]
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	valid, hasCR, err := scan(f)
+	if err != nil {
+		return "", false, err
+	}
+
+	var enc encoding.Encoding
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xff, 0xfe}):
+		enc, _ = Lookup("utf-16le")
+	case bytes.HasPrefix(sample, []byte{0xfe, 0xff}):
+		enc, _ = Lookup("utf-16be")
+	case valid:
+		if !bytes.HasPrefix(sample, bom) && !hasCR {
+			return "utf-8", false, nil
+		}
+		enc = encoding.Nop
+	case name == Auto:
+		result, err := chardet.NewTextDetector().DetectBest(sample)
+		if err != nil {
+			return "", false, errors.New("Could not detect encoding of " + path + ", the error: " + err.Error())
+		}
+		if enc, err = Lookup(result.Charset); err != nil {
+			return "", false, errors.New("Could not convert " + path + " from the detected encoding " + result.Charset)
+		}
+	default:
+		if enc, err = Lookup(name); err != nil {
+			return "", false, err
+		}
+	}
+	from = "utf-8"
+	if enc != encoding.Nop {
+		from, _ = htmlindex.Name(enc)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	if err := rewrite(path, transform.NewReader(f, enc.NewDecoder())); err != nil {
+		return "", false, errors.New("Could not convert " + path + " from " + from + ", the error: " + err.Error())
+	}
+	return from, true, nil
+}
+
+// scan reports whether r is valid UTF-8 without NUL bytes (so it's
+// not UTF-16 without BOM) and whether it has CR line endings
+func scan(r io.Reader) (valid, hasCR bool, err error) {
+	valid = true
+	buf := make([]byte, sampleSize)
+	carry := 0
+	for {
+		n, err := r.Read(buf[carry:])
+		data := buf[:carry+n]
+		// an incomplete rune at the end is checked with the next chunk
+		cut := len(data)
+		if err == nil {
+			for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+				if utf8.RuneStart(data[i]) {
+					if !utf8.FullRune(data[i:]) {
+						cut = i
+					}
+					break
+				}
+			}
+		}
+		valid = valid && utf8.Valid(data[:cut]) && bytes.IndexByte(data[:cut], 0) < 0
+		hasCR = hasCR || bytes.IndexByte(data[:cut], '\r') >= 0
+		carry = copy(buf, data[cut:])
+		if err == io.EOF {
+			return valid, hasCR, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+	}
+}
+
+// rewrite replaces the file at path with the content of r without
+// the BOM and with CRLF and CR replaced with LF
+func rewrite(path string, r io.Reader) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".utf8-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	br := bufio.NewReaderSize(r, sampleSize)
+	bw := bufio.NewWriterSize(tmp, sampleSize)
+	if head, _ := br.Peek(len(bom)); bytes.Equal(head, bom) {
+		br.Discard(len(bom))
+	}
+	for {
+		chunk, err := br.ReadSlice('\r')
+		if len(chunk) > 0 && chunk[len(chunk)-1] == '\r' {
+			bw.Write(chunk[:len(chunk)-1])
+			bw.WriteByte('\n')
+			if next, _ := br.Peek(1); len(next) == 1 && next[0] == '\n' {
+				br.Discard(1)
+			}
+		} else {
+			bw.Write(chunk)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,97 @@
+package transcode_test
+
+import (
+	"os"
+	"path/filepath"
+	"pullcsv/internal/transcode"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const russian = "артикул;наименование;остаток\r\n1001;Молоко пастеризованное 3,2% жирности;15\r\n1002;Хлеб бородинский нарезанный;7\r\n1003;Сыр российский весовой;3\r\n"
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	want := strings.ReplaceAll(russian, "\r\n", "\n")
+	cp1251, _ := charmap.Windows1251.NewEncoder().String(russian)
+	koi8r, _ := charmap.KOI8R.NewEncoder().String(russian)
+	utf16le, _ := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String(russian)
+	utf16be, _ := unicode.UTF16(unicode.BigEndian, unicode.UseBOM).NewEncoder().String(russian)
+
+	type testCase struct {
+		content       string
+		encoding      string
+		want          string
+		wantFrom      string
+		wantConverted bool
+	}
+
+	testCases := []testCase{
+		{content: cp1251, encoding: "windows-1251", want: want, wantFrom: "windows-1251", wantConverted: true},
+		{content: cp1251, encoding: "cp1251", want: want, wantFrom: "windows-1251", wantConverted: true},
+		{content: cp1251, encoding: transcode.Auto, want: want, wantFrom: "windows-1251", wantConverted: true},
+		{content: koi8r, encoding: "koi8-r", want: want, wantFrom: "koi8-r", wantConverted: true},
+		{content: utf16le, encoding: transcode.Auto, want: want, wantFrom: "utf-16le", wantConverted: true},
+		// the BOM wins over the configured encoding
+		{content: utf16be, encoding: "windows-1251", want: want, wantFrom: "utf-16be", wantConverted: true},
+		{content: "\ufeff" + russian, encoding: "windows-1251", want: want, wantFrom: "utf-8", wantConverted: true},
+		{content: "a;b\rc;d\r", encoding: transcode.Auto, want: "a;b\nc;d\n", wantFrom: "utf-8", wantConverted: true},
+		// valid UTF-8 is never decoded from the configured encoding
+		{content: want, encoding: "windows-1251", want: want, wantFrom: "utf-8"},
+		{content: "", encoding: transcode.Auto, want: "", wantFrom: "utf-8"},
+	}
+
+	dir := t.TempDir()
+	for i, tc := range testCases {
+		path := filepath.Join(dir, "stocks.csv")
+		os.WriteFile(path, []byte(tc.content), 0640)
+
+		from, converted, err := transcode.File(path, tc.encoding)
+		if err != nil {
+			t.Fatalf("Case %d: want nil, got error: %v", i, err)
+		}
+		if from != tc.wantFrom || converted != tc.wantConverted {
+			t.Errorf("Case %d, want: %s %v, got: %s %v", i, tc.wantFrom, tc.wantConverted, from, converted)
+		}
+		got, _ := os.ReadFile(path)
+		if string(got) != tc.want {
+			t.Errorf("Case %d, want: %q, got: %q", i, tc.want, got)
+		}
+		if fi, _ := os.Stat(path); fi.Mode().Perm() != 0640 {
+			t.Errorf("Case %d, want mode 0640, got: %v", i, fi.Mode().Perm())
+		}
+
+		// converting twice changes nothing
+		if _, converted, _ := transcode.File(path, tc.encoding); converted {
+			t.Errorf("Case %d: want the converted file to be left as is", i)
+		}
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("want no temp files left, got: %v", entries)
+	}
+	if _, _, err := transcode.File(filepath.Join(dir, "doesntexist.csv"), transcode.Auto); err == nil {
+		t.Error("want error for missing file, got nil")
+	}
+	os.WriteFile(filepath.Join(dir, "a.csv"), []byte{0xcf, 0xf0}, 0644)
+	if _, _, err := transcode.File(filepath.Join(dir, "a.csv"), "ebcdic-42"); err == nil {
+		t.Error("want error for unknown encoding, got nil")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"windows-1251", "CP1251", "koi8-r", "utf-16le", "utf-8"} {
+		if _, err := transcode.Lookup(name); err != nil {
+			t.Errorf("%s: want nil, got error: %v", name, err)
+		}
+	}
+	if _, err := transcode.Lookup("ebcdic-42"); err == nil {
+		t.Error("want error for unknown encoding, got nil")
+	}
+}